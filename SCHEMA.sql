@@ -1,10 +1,24 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TABLE accounts (
   id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
   email TEXT NOT NULL UNIQUE,
   username TEXT NOT NULL UNIQUE,
   password TEXT NOT NULL,
+  email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+  -- Set on enrollment, used for login once totp_enabled
+  totp_secret TEXT,
+  totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+  -- Last TOTP time step used, so codes cannot be replayed
+  totp_last_step BIGINT,
   picture TEXT,
   bio TEXT,
+  daily_new_limit INT NOT NULL DEFAULT 20,
+  daily_review_limit INT NOT NULL DEFAULT 200,
+  timezone TEXT NOT NULL DEFAULT 'UTC',
+  -- Last sign in with a linked provider to confirm a sensitive change,
+  -- which stands in for the password of accounts without one
+  oidc_reauthenticated TIMESTAMPTZ,
   created TIMESTAMPTZ DEFAULT NOW()
 );
 
@@ -13,7 +27,26 @@ CREATE TABLE sets (
   account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
   name TEXT,
   description TEXT,
-  created TIMESTAMPTZ DEFAULT NOW()
+  algorithm TEXT NOT NULL DEFAULT 'sm2',
+  visibility TEXT NOT NULL DEFAULT 'private'
+    CHECK (visibility IN ('private', 'unlisted', 'public')),
+  share_token TEXT UNIQUE,
+  created TIMESTAMPTZ DEFAULT NOW(),
+  search TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', COALESCE(name, '')), 'A') ||
+    setweight(to_tsvector('simple', COALESCE(description, '')), 'B')
+  ) STORED
+);
+
+CREATE INDEX sets_public_idx ON sets (created DESC) WHERE visibility = 'public';
+CREATE INDEX sets_search_idx ON sets USING GIN (search);
+CREATE INDEX sets_name_trgm_idx ON sets USING GIN (name gin_trgm_ops);
+
+CREATE TABLE set_collaborators (
+  set_id INT REFERENCES sets(id) ON DELETE CASCADE NOT NULL,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  role TEXT NOT NULL CHECK (role IN ('viewer', 'editor')),
+  PRIMARY KEY (set_id, account_id)
 );
 
 CREATE TABLE cards (
@@ -21,13 +54,197 @@ CREATE TABLE cards (
   set_id INT REFERENCES sets(id) ON DELETE CASCADE NOT NULL,
   front TEXT,
   back TEXT,
-  created TIMESTAMPTZ DEFAULT NOW()
+  created TIMESTAMPTZ DEFAULT NOW(),
+  search TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', COALESCE(front, '')), 'A') ||
+    setweight(to_tsvector('simple', COALESCE(back, '')), 'B')
+  ) STORED
 );
 
+CREATE INDEX cards_set_idx ON cards (set_id);
+CREATE INDEX cards_search_idx ON cards USING GIN (search);
+CREATE INDEX cards_front_trgm_idx ON cards USING GIN (front gin_trgm_ops);
+CREATE INDEX cards_back_trgm_idx ON cards USING GIN (back gin_trgm_ops);
+
+CREATE TABLE card_states (
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  card_id INT REFERENCES cards(id) ON DELETE CASCADE NOT NULL,
+  ease REAL NOT NULL DEFAULT 2.5,
+  interval INT NOT NULL DEFAULT 0,
+  repetitions INT NOT NULL DEFAULT 0,
+  lapses INT NOT NULL DEFAULT 0,
+  stability REAL NOT NULL DEFAULT 0,
+  difficulty REAL NOT NULL DEFAULT 0,
+  state TEXT NOT NULL DEFAULT 'new',
+  due TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  introduced TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_reviewed TIMESTAMPTZ,
+  PRIMARY KEY (account_id, card_id)
+);
+
+CREATE INDEX card_states_due_idx ON card_states (account_id, due);
+
+CREATE TABLE reviews (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  card_id INT REFERENCES cards(id) ON DELETE CASCADE NOT NULL,
+  grade SMALLINT NOT NULL CHECK (grade BETWEEN 0 AND 5),
+  duration_ms INT CHECK (duration_ms >= 0),
+  prev_interval INT NOT NULL DEFAULT 0,
+  new_interval INT NOT NULL DEFAULT 0,
+  reviewed TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX reviews_card_idx ON reviews (card_id, account_id, reviewed);
+CREATE INDEX reviews_account_idx ON reviews (account_id, reviewed);
+
+-- The review log is append-only. Rows may only disappear through the
+-- cascade when their card or account is deleted.
+CREATE FUNCTION reviews_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' AND pg_trigger_depth() > 1 THEN
+    RETURN OLD;
+  END IF;
+  RAISE EXCEPTION 'reviews are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER reviews_immutable
+  BEFORE UPDATE OR DELETE ON reviews
+  FOR EACH ROW EXECUTE FUNCTION reviews_immutable();
+
+CREATE TABLE takeouts (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'ready', 'failed', 'expired')),
+  size BIGINT,
+  error TEXT,
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  completed TIMESTAMPTZ
+);
+
+CREATE INDEX takeouts_account_idx ON takeouts (account_id, created);
+-- Only one archive is built at a time
+CREATE UNIQUE INDEX takeouts_pending_idx ON takeouts (account_id) WHERE status = 'pending';
+
+-- Refresh token families, one per login. Each family is a session.
+CREATE SEQUENCE refreshtoken_families;
+
+-- Only a SHA-256 hash of each refresh token is stored. Tokens are replaced
+-- on every refresh; family groups the tokens of one login, and used marks
+-- tokens that have been replaced. created is the time of the login and is
+-- carried over to replacements.
+-- Databases created before tokens were hashed are upgraded with
+-- migrations/001_refresh_token_hashes.sql.
 CREATE TABLE refreshtokens (
   id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
-  account_id INT REFERENCES accounts(id),
-  token TEXT NOT NULL UNIQUE,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE,
+  family INT NOT NULL DEFAULT nextval('refreshtoken_families'),
+  token_hash TEXT NOT NULL UNIQUE,
+  expires TIMESTAMPTZ NOT NULL,
+  used TIMESTAMPTZ,
+  user_agent TEXT NOT NULL DEFAULT '',
+  client_ip TEXT NOT NULL DEFAULT '',
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX refreshtokens_family_idx ON refreshtokens (family);
+CREATE INDEX refreshtokens_expires_idx ON refreshtokens (expires);
+
+-- Only a SHA-256 hash of each reset token is stored
+CREATE TABLE password_resets (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires TIMESTAMPTZ NOT NULL,
+  used TIMESTAMPTZ,
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX password_resets_account_idx ON password_resets (account_id);
+
+-- Tokens confirming the email of an account. When email differs from the
+-- account's current address the token confirms a change of address.
+CREATE TABLE email_verifications (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  email TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires TIMESTAMPTZ NOT NULL,
+  used TIMESTAMPTZ,
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX email_verifications_account_idx ON email_verifications (account_id, created);
+ 
+
+-- Only SHA-256 hashes of recovery codes are stored
+CREATE TABLE recovery_codes (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  code_hash TEXT NOT NULL,
+  used TIMESTAMPTZ
+);
+
+CREATE INDEX recovery_codes_account_idx ON recovery_codes (account_id);
+
+-- Second step of logging in to an account with two-factor authentication
+CREATE TABLE login_challenges (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires TIMESTAMPTZ NOT NULL,
+  attempts INT NOT NULL DEFAULT 0
+);
+
+-- Personal access tokens. Only a SHA-256 hash of each token is stored.
+CREATE TABLE access_tokens (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  name TEXT NOT NULL,
+  scope TEXT NOT NULL CHECK (scope IN ('read', 'write', 'admin')),
+  token_hash TEXT NOT NULL UNIQUE,
+  expires TIMESTAMPTZ,
+  last_used TIMESTAMPTZ,
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX access_tokens_account_idx ON access_tokens (account_id);
+
+-- Accounts at OpenID Connect providers linked to local accounts
+CREATE TABLE identities (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE NOT NULL,
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  created TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX identities_account_idx ON identities (account_id);
+
+-- Authorizations in progress with an OpenID Connect provider. account_id
+-- is set when a logged in account links the provider, or signs in again
+-- with it when reauth is set.
+CREATE TABLE oidc_logins (
+  id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  provider TEXT NOT NULL,
+  state_hash TEXT NOT NULL UNIQUE,
+  nonce TEXT NOT NULL,
+  verifier TEXT NOT NULL,
+  account_id INT REFERENCES accounts(id) ON DELETE CASCADE,
+  reauth BOOLEAN NOT NULL DEFAULT FALSE,
   expires TIMESTAMPTZ NOT NULL
 );
- 
\ No newline at end of file
+
+-- Failed logins, used when LOGIN_LIMIT_STORE=postgres. key is an IP, an
+-- account or a lock.
+CREATE TABLE login_attempts (
+  key TEXT NOT NULL,
+  attempted TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX login_attempts_key_idx ON login_attempts (key, attempted);
+CREATE INDEX login_attempts_attempted_idx ON login_attempts (attempted);
@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/mail"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -19,33 +23,92 @@ import (
 // TYPES
 
 type Account struct {
-	ID       int         `json:"id"`
-	Email    string      `json:"email"`
-	Username string      `json:"username"`
-	Picture  pgtype.Text `json:"picture"`
-	Bio      pgtype.Text `json:"bio"`
-	Created  time.Time   `json:"created"`
+	ID            int         `json:"id"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+	Username      string      `json:"username"`
+	Picture       pgtype.Text `json:"picture"`
+	Bio           pgtype.Text `json:"bio"`
+	Created       time.Time   `json:"created"`
+}
+
+// Fields of PATCH /accounts/{id}. Fields left out are not changed.
+type AccountUpdate struct {
+	Username *string `json:"username"`
+	// Replaces the current email once the new one is confirmed
+	Email    *string `json:"email"`
+	Bio      *string `json:"bio"`
+	Timezone *string `json:"timezone"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	// Current TOTP code, for accounts with 2FA enabled
+	Code string `json:"code"`
+}
+
+// Body of DELETE /accounts/{id}
+type AccountDeletion struct {
+	Password string `json:"password"`
+	// Current TOTP code, for accounts with 2FA enabled
+	Code string `json:"code"`
 }
 
 type AccountHandler struct {
-	db *pgxpool.Pool
+	db             *pgxpool.Pool
+	statsHandler   *StatsHandler
+	takeoutHandler *TakeoutHandler
+	verifier       *EmailVerifier
+	twoFactor      *TwoFactorHandler
+	pictureHandler *PictureHandler
 }
 
-func NewAccountHandler(db *pgxpool.Pool) *AccountHandler {
-	return &AccountHandler{db: db}
+func NewAccountHandler(db *pgxpool.Pool, statsHandler *StatsHandler, takeoutHandler *TakeoutHandler,
+	verifier *EmailVerifier, twoFactor *TwoFactorHandler, pictureHandler *PictureHandler) *AccountHandler {
+	return &AccountHandler{
+		db:             db,
+		statsHandler:   statsHandler,
+		takeoutHandler: takeoutHandler,
+		verifier:       verifier,
+		twoFactor:      twoFactor,
+		pictureHandler: pictureHandler,
+	}
 }
 
+var (
+	errWrongPassword  = errors.New("wrong password")
+	errReauthRequired = errors.New("sign in with a linked provider again first")
+)
+
 ////////////
 // ROUTES
 
 var (
-	AccountRE       = regexp.MustCompile(`^\/accounts\/?$`)
-	AccountREWithID = regexp.MustCompile(`^\/accounts\/(\d+)\/?$`)
+	AccountRE         = regexp.MustCompile(`^\/accounts\/?$`)
+	AccountREWithID   = regexp.MustCompile(`^\/accounts\/(\d+)\/?$`)
+	AccountPasswordRE = regexp.MustCompile(`^\/accounts\/(\d+)\/password\/?$`)
 )
 
 func (h *AccountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path
+	clientIP := r.Context().Value("clientip").(string)
 	switch {
+	// ACCOUNT STATS ROUTE
+	case AccountStatsRE.MatchString(url):
+		h.statsHandler.ServeHTTP(w, r)
+		return
+
+	// ACCOUNT EXPORT ROUTE
+	case TakeoutRE.MatchString(url):
+		h.takeoutHandler.ServeHTTP(w, r)
+		return
+
+	// ACCOUNT PICTURE ROUTE
+	case AccountPictureRE.MatchString(url):
+		h.pictureHandler.ServeHTTP(w, r)
+		return
+
 	// CREATE ACCOUNT
 	case AccountRE.MatchString(url) && r.Method == http.MethodPost:
 		err := r.ParseForm()
@@ -82,12 +145,117 @@ func (h *AccountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Write(bytes)
 		return
+
+	// UPDATE ACCOUNT
+	case AccountREWithID.MatchString(url) && r.Method == http.MethodPatch:
+		claims, ok := accountOwner(w, r, AccountREWithID)
+		if !ok {
+			return
+		}
+		var update AccountUpdate
+		if !readJSONBody(w, r, &update) {
+			return
+		}
+		err := h.UpdateAccount(claims.UserID, update)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error updating account: %v", err), http.StatusBadRequest)
+			return
+		}
+		account, err := h.GetAccountByID(claims.UserID)
+		if err != nil || account == nil {
+			http.Error(w, "error getting account", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, account, http.StatusOK)
+		return
+
+	// CHANGE PASSWORD
+	case AccountPasswordRE.MatchString(url) && r.Method == http.MethodPost:
+		claims, ok := accountOwner(w, r, AccountPasswordRE)
+		if !ok {
+			return
+		}
+		var body PasswordChange
+		if !readJSONBody(w, r, &body) {
+			return
+		}
+		err := h.twoFactor.reauthenticate(claims.UserID, body.CurrentPassword, body.Code)
+		if reauthFailed(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			err = h.UpdatePassword(claims.UserID, body.NewPassword)
+		}
+		var policyErr *passwordPolicyError
+		if errors.As(err, &policyErr) {
+			http.Error(w, policyErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error changing password for %s: %v\n", clientIP, err)
+			http.Error(w, "error changing password", http.StatusInternalServerError)
+			return
+		}
+		// Every session was logged out, this one included
+		clearAuthCookies(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	// DELETE ACCOUNT
+	case AccountREWithID.MatchString(url) && r.Method == http.MethodDelete:
+		claims, ok := accountOwner(w, r, AccountREWithID)
+		if !ok {
+			return
+		}
+		var body AccountDeletion
+		if !readJSONBody(w, r, &body) {
+			return
+		}
+		err := h.twoFactor.reauthenticate(claims.UserID, body.Password, body.Code)
+		if reauthFailed(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			err = h.DeleteAccount(claims.UserID)
+		}
+		if err != nil {
+			log.Printf("error deleting account for %s: %v\n", clientIP, err)
+			http.Error(w, "error deleting account", http.StatusInternalServerError)
+			return
+		}
+		clearAuthCookies(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
 	}
 }
 
 /////////////
 // HELPERS
 
+// Returns the claims of a request to the account in the URL, writing a 403
+// and returning false unless it is the caller's own. Of the personal
+// access tokens only admin ones can change accounts; changing the
+// password or deleting the account still takes reauthentication.
+func accountOwner(w http.ResponseWriter, r *http.Request, re *regexp.Regexp) (*Claims, bool) {
+	claims := r.Context().Value("claims").(*Claims)
+	id, err := strconv.Atoi(re.FindStringSubmatch(r.URL.Path)[1])
+	if err != nil {
+		http.Error(w, "invalid account id", http.StatusBadRequest)
+		return nil, false
+	}
+	if id != claims.UserID || (claims.Scope != "" && claims.Scope != ScopeAdmin) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
 func getAccountIDFromURL(url string) (int, error) {
 	groups := AccountREWithID.FindStringSubmatch(url)
 	if len(groups) != 2 {
@@ -110,6 +278,15 @@ func (h *AccountHandler) CreateAccount(email string, username string, password s
 		strings.TrimSpace(password) == "" {
 		return -1, fmt.Errorf("empty email, username, and/or password")
 	}
+	username = strings.TrimSpace(username)
+	err = validateUsername(username)
+	if err != nil {
+		return -1, err
+	}
+	err = ValidatePassword(password, username, email)
+	if err != nil {
+		return -1, err
+	}
 	// Hash password
 	hashed, err := HashPassword(password)
 	if err != nil {
@@ -129,7 +306,7 @@ func (h *AccountHandler) CreateAccount(email string, username string, password s
 		return -1, fmt.Errorf("account with given email already exists")
 	}
 	// Check that username is unique
-	acc, err = h.GetAccountByUsername(email)
+	acc, err = h.GetAccountByUsername(username)
 	if err != nil {
 		return -1, fmt.Errorf("error checking if account is unique: %w", err)
 	}
@@ -160,7 +337,7 @@ func (h *AccountHandler) CreateAccount(email string, username string, password s
 
 func (h *AccountHandler) GetAllAccounts() (*[]Account, error) {
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, email, username, picture, bio, created
+		`SELECT id, email, email_verified, username, picture, bio, created
 		 FROM accounts`)
 	if err != nil {
 		return nil, err
@@ -174,7 +351,7 @@ func (h *AccountHandler) GetAllAccounts() (*[]Account, error) {
 	var accounts []Account
 	for rows.Next() {
 		var a Account
-		err = rows.Scan(&a.ID, &a.Email, &a.Username, &a.Picture, &a.Bio, &a.Created)
+		err = rows.Scan(&a.ID, &a.Email, &a.EmailVerified, &a.Username, &a.Picture, &a.Bio, &a.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -186,7 +363,7 @@ func (h *AccountHandler) GetAllAccounts() (*[]Account, error) {
 
 func (h *AccountHandler) GetAccountByID(id int) (*Account, error) {
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, email, username, picture, bio, created
+		`SELECT id, email, email_verified, username, picture, bio, created
 		 FROM accounts WHERE id=$1`, id)
 	if err != nil {
 		return nil, err
@@ -196,7 +373,7 @@ func (h *AccountHandler) GetAccountByID(id int) (*Account, error) {
 	if !rows.Next() {
 		return nil, nil
 	}
-	err = rows.Scan(&a.ID, &a.Email, &a.Username, &a.Picture, &a.Bio, &a.Created)
+	err = rows.Scan(&a.ID, &a.Email, &a.EmailVerified, &a.Username, &a.Picture, &a.Bio, &a.Created)
 	if err != nil {
 		return nil, err
 	}
@@ -208,7 +385,7 @@ func (h *AccountHandler) GetAccountByID(id int) (*Account, error) {
 
 func (h *AccountHandler) GetAccountByUsername(username string) (*Account, error) {
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, email, username, picture, bio, created
+		`SELECT id, email, email_verified, username, picture, bio, created
 		 FROM accounts WHERE username=$1`, username)
 	if err != nil {
 		return nil, err
@@ -219,7 +396,7 @@ func (h *AccountHandler) GetAccountByUsername(username string) (*Account, error)
 	if !rows.Next() {
 		return nil, nil
 	}
-	err = rows.Scan(&a.ID, &a.Email, &a.Username, &a.Picture, &a.Bio, &a.Created)
+	err = rows.Scan(&a.ID, &a.Email, &a.EmailVerified, &a.Username, &a.Picture, &a.Bio, &a.Created)
 	if err != nil {
 		return nil, err
 	}
@@ -231,7 +408,7 @@ func (h *AccountHandler) GetAccountByUsername(username string) (*Account, error)
 
 func (h *AccountHandler) GetAccountByEmail(email string) (*Account, error) {
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, email, username, picture, bio, created
+		`SELECT id, email, email_verified, username, picture, bio, created
 		 FROM accounts WHERE email=$1`, email)
 	if err != nil {
 		return nil, err
@@ -241,7 +418,7 @@ func (h *AccountHandler) GetAccountByEmail(email string) (*Account, error) {
 	if !rows.Next() {
 		return nil, nil
 	}
-	err = rows.Scan(&a.ID, &a.Email, &a.Username, &a.Picture, &a.Bio, &a.Created)
+	err = rows.Scan(&a.ID, &a.Email, &a.EmailVerified, &a.Username, &a.Picture, &a.Bio, &a.Created)
 	if err != nil {
 		return nil, err
 	}
@@ -254,41 +431,102 @@ func (h *AccountHandler) GetAccountByEmail(email string) (*Account, error) {
 ////////////
 // UPDATE
 
-func (h *AccountHandler) UpdateEmail(id int, email string) error {
+// Applies the fields of a PATCH /accounts/{id}. Either every field is
+// changed or none is.
+func (h *AccountHandler) UpdateAccount(id int, update AccountUpdate) error {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	if update.Timezone != nil {
+		err := updateTimezone(ctx, tx, id, *update.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+	if update.Username != nil {
+		err := updateUsername(ctx, tx, id, *update.Username)
+		if err != nil {
+			return err
+		}
+	}
+	if update.Bio != nil {
+		err := updateBio(ctx, tx, id, *update.Bio)
+		if err != nil {
+			return err
+		}
+	}
+	var confirmation *Message
+	if update.Email != nil {
+		msg, err := h.updateEmail(ctx, tx, id, *update.Email)
+		if err != nil {
+			return err
+		}
+		confirmation = &msg
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing account update: %w", err)
+	}
+	if confirmation != nil {
+		h.verifier.sendMail(id, *confirmation)
+	}
+	return nil
+}
+
+// Returns the mail confirming the new address, to send once tx commits
+func (h *AccountHandler) updateEmail(ctx context.Context, tx pgx.Tx, id int, email string) (Message, error) {
 	// Validate email
 	_, err := mail.ParseAddress(email)
 	if err != nil {
-		return fmt.Errorf("invalid email")
+		return Message{}, fmt.Errorf("invalid email")
 	}
 	// Check that user doesn't already exist with new email
-	acc, err := h.GetAccountByEmail(email)
+	var taken bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM accounts WHERE email=$1)`, email).Scan(&taken)
 	if err != nil {
-		return fmt.Errorf("error querying db for account: %w", err)
+		return Message{}, fmt.Errorf("error querying db for account: %w", err)
 	}
-	if acc != nil {
-		return fmt.Errorf("account with email already exists")
+	if taken {
+		return Message{}, fmt.Errorf("account with email already exists")
 	}
-	// Update email
-	_, err = h.db.Exec(context.Background(),
-		`UPDATE accounts
-		 SET email=$1 WHERE id=$2`, email, id)
-	if err != nil {
-		return fmt.Errorf("error updating email: %w", err)
+	// The new email replaces the old one once it is confirmed
+	return h.verifier.RequestEmailChange(ctx, tx, id, email)
+}
+
+// Checks a new username. "@" is left out so that a username can never be
+// taken for an email at login.
+func validateUsername(username string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return fmt.Errorf("username must be 1 to %d characters", maxUsernameLength)
+	}
+	if strings.ContainsRune(username, '@') || strings.IndexFunc(username, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("username cannot contain @ or whitespace")
 	}
 	return nil
 }
 
-func (h *AccountHandler) UpdateUsername(id int, username string) error {
+func updateUsername(ctx context.Context, tx pgx.Tx, id int, username string) error {
+	username = strings.TrimSpace(username)
+	err := validateUsername(username)
+	if err != nil {
+		return err
+	}
 	// Check that user doesn't already exist with new username
-	acc, err := h.GetAccountByUsername(username)
+	var taken bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM accounts WHERE username=$1 AND id<>$2)`, username, id).Scan(&taken)
 	if err != nil {
 		return fmt.Errorf("error querying db for account: %w", err)
 	}
-	if acc != nil {
+	if taken {
 		return fmt.Errorf("account with username already exists")
 	}
 	// Update username
-	_, err = h.db.Exec(context.Background(),
+	_, err = tx.Exec(ctx,
 		`UPDATE accounts
 		 SET username=$1 WHERE id=$2`, username, id)
 	if err != nil {
@@ -297,8 +535,8 @@ func (h *AccountHandler) UpdateUsername(id int, username string) error {
 	return nil
 }
 
-func (h *AccountHandler) UpdateBio(id int, bio string) error {
-	_, err := h.db.Exec(context.Background(),
+func updateBio(ctx context.Context, tx pgx.Tx, id int, bio string) error {
+	_, err := tx.Exec(ctx,
 		`UPDATE accounts
 		 SET bio=$1 WHERE id=$2`, bio, id)
 	if err != nil {
@@ -307,6 +545,74 @@ func (h *AccountHandler) UpdateBio(id int, bio string) error {
 	return nil
 }
 
+func updateTimezone(ctx context.Context, tx pgx.Tx, id int, timezone string) error {
+	// Validate IANA time zone name
+	_, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || timezone == "Local" {
+		return fmt.Errorf("invalid timezone")
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts
+		 SET timezone=$1 WHERE id=$2`, timezone, id)
+	if err != nil {
+		return fmt.Errorf("error updating timezone: %w", err)
+	}
+	return nil
+}
+
+// Sets a new password and logs the account out of every session
+func (h *AccountHandler) UpdatePassword(id int, password string) error {
+	ctx := context.Background()
+	account, err := h.GetAccountByID(id)
+	if err != nil {
+		return fmt.Errorf("error getting account: %w", err)
+	}
+	if account == nil {
+		return fmt.Errorf("account %d not found", id)
+	}
+	err = ValidatePassword(password, account.Username, account.Email)
+	if err != nil {
+		return err
+	}
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	err = setPasswordHash(ctx, tx, id, hashed)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Stores a password hash and revokes the account's refresh and access
+// tokens. Whoever knew the old password may have made either, so a password
+// change or reset leaves them nothing to keep using.
+func setPasswordHash(ctx context.Context, tx pgx.Tx, id int, hashed string) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE accounts
+		 SET password=$1 WHERE id=$2`, hashed, id)
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`DELETE FROM refreshtokens WHERE account_id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`DELETE FROM access_tokens WHERE account_id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("error revoking access tokens: %w", err)
+	}
+	return nil
+}
+
 func (h *AccountHandler) UpdatePicture(id int, picture string) error {
 	_, err := h.db.Exec(context.Background(),
 		`UPDATE accounts
@@ -339,12 +645,39 @@ func (h *AccountHandler) DeleteAccount(id int) error {
 	if acc == nil {
 		return fmt.Errorf("account does not exist")
 	}
-	// Delete account
-	_, err = h.db.Exec(context.Background(),
+	// Takeout rows go with the account, so find their archives first
+	ctx := context.Background()
+	rows, err := h.db.Query(ctx,
+		`SELECT id FROM takeouts WHERE account_id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("error querying takeouts: %w", err)
+	}
+	takeouts, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return fmt.Errorf("error querying takeouts: %w", err)
+	}
+	// Delete account along with its sessions
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`DELETE FROM refreshtokens WHERE account_id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	_, err = tx.Exec(ctx,
 		`DELETE FROM accounts
 		 WHERE id=$1`, id)
 	if err != nil {
 		return fmt.Errorf("error deleting account: %w", err)
 	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	h.pictureHandler.deleteBlobs(acc.Picture.String)
+	h.takeoutHandler.removeTakeoutFiles(takeouts)
 	return nil
 }
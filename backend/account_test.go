@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	for _, tt := range []struct {
+		username string
+		ok       bool
+	}{
+		{"alice", true},
+		{"alice_b.c-1", true},
+		{"", false},
+		{strings.Repeat("a", maxUsernameLength+1), false},
+		{"alice@example.com", false},
+		{"@alice", false},
+		{"alice b", false},
+		{"alice\tb", false},
+		{"alice\u00a0b", false},
+	} {
+		if err := validateUsername(tt.username); (err == nil) != tt.ok {
+			t.Errorf("validateUsername(%q) = %v, want ok %v", tt.username, err, tt.ok)
+		}
+	}
+}
+
+func TestAccountOwnerScopes(t *testing.T) {
+	for _, tt := range []struct {
+		userID int
+		scope  string
+		ok     bool
+	}{
+		{1, "", true},
+		{1, ScopeAdmin, true},
+		{1, ScopeWrite, false},
+		{1, ScopeRead, false},
+		{2, "", false},
+		{2, ScopeAdmin, false},
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/accounts/1", nil)
+		r = r.WithContext(context.WithValue(r.Context(), "claims", &Claims{UserID: tt.userID, Scope: tt.scope}))
+		w := httptest.NewRecorder()
+		_, ok := accountOwner(w, r, AccountREWithID)
+		if ok != tt.ok {
+			t.Errorf("account %d with scope %q: ok %v, want %v", tt.userID, tt.scope, ok, tt.ok)
+		}
+		if !ok && w.Code != http.StatusForbidden {
+			t.Errorf("account %d with scope %q: status %d, want 403", tt.userID, tt.scope, w.Code)
+		}
+	}
+}
+
+func TestUpdateAccountAllOrNothing(t *testing.T) {
+	db := newTestDB(t)
+	verifier := &EmailVerifier{db: db, mailer: &LogMailer{}}
+	h := NewAccountHandler(db, nil, nil, verifier, nil, nil)
+	accountID := createTestAccount(t, db, "alice", "")
+	createTestAccount(t, db, "bob", "")
+
+	bio := "new bio"
+	timezone := "Europe/Berlin"
+	for _, username := range []string{"bob", "alice smith", "alice@example.com"} {
+		err := h.UpdateAccount(accountID, AccountUpdate{Bio: &bio, Timezone: &timezone, Username: &username})
+		if err == nil {
+			t.Fatalf("username %q was accepted", username)
+		}
+	}
+	email := "not an email"
+	if err := h.UpdateAccount(accountID, AccountUpdate{Bio: &bio, Email: &email}); err == nil {
+		t.Fatal("invalid email was accepted")
+	}
+	var gotBio, gotTimezone string
+	err := db.QueryRow(context.Background(),
+		`SELECT COALESCE(bio, ''), timezone FROM accounts WHERE id=$1`, accountID).Scan(&gotBio, &gotTimezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotBio == bio || gotTimezone == timezone {
+		t.Errorf("failed update left bio %q and timezone %q", gotBio, gotTimezone)
+	}
+
+	email = "alice.new@example.com"
+	username := "alice2"
+	err = h.UpdateAccount(accountID, AccountUpdate{Bio: &bio, Username: &username, Email: &email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending int
+	err = db.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM email_verifications WHERE account_id=$1 AND email=$2`, accountID, email).Scan(&pending)
+	if err != nil || pending != 1 {
+		t.Errorf("%d pending email changes, %v", pending, err)
+	}
+}
+
+func TestDeleteAccountRemovesTakeouts(t *testing.T) {
+	db := newTestDB(t)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeouts := NewTakeoutHandler(db, t.TempDir(), store)
+	h := NewAccountHandler(db, nil, takeouts, nil, nil, NewPictureHandler(db, store))
+	accountID := createTestAccount(t, db, "alice", "")
+
+	takeout, _, err := takeouts.CreateTakeout(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeouts.BuildTakeout(takeout.ID, accountID)
+	if _, err := os.Stat(takeouts.takeoutPath(takeout.ID)); err != nil {
+		t.Fatalf("archive missing after build: %v", err)
+	}
+
+	err = h.DeleteAccount(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(takeouts.takeoutPath(takeout.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("archive left behind after deleting the account: %v", err)
+	}
+
+	// A build that finishes after the account is gone removes its archive
+	accountID = createTestAccount(t, db, "bob", "")
+	takeout, _, err = takeouts.CreateTakeout(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(context.Background(), `DELETE FROM accounts WHERE id=$1`, accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeouts.BuildTakeout(takeout.ID, accountID)
+	if _, err := os.Stat(takeouts.takeoutPath(takeout.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("archive left behind by a build for a deleted account: %v", err)
+	}
+}
+
+func TestCreateAccountChecksUsername(t *testing.T) {
+	db := newTestDB(t)
+	h := NewAccountHandler(db, nil, nil, nil, nil, nil)
+	createTestAccount(t, db, "alice", "")
+
+	password := "correct horse battery"
+	for _, username := range []string{"alice", "bob smith", "bob@example.com", strings.Repeat("b", maxUsernameLength+1)} {
+		if _, err := h.CreateAccount("bob@example.com", username, password); err == nil {
+			t.Errorf("username %q was accepted", username)
+		}
+	}
+	if _, err := h.CreateAccount("bob@example.com", " bob ", password); err != nil {
+		t.Fatal(err)
+	}
+	var username string
+	err := db.QueryRow(context.Background(),
+		`SELECT username FROM accounts WHERE email=$1`, "bob@example.com").Scan(&username)
+	if err != nil || username != "bob" {
+		t.Errorf("stored username %q, %v", username, err)
+	}
+}
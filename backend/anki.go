@@ -0,0 +1,770 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Anki packages (.apkg) are zip files holding a SQLite collection in the
+// legacy schema 11 layout and a "media" JSON map. Only that layout is
+// read; packages exported with "Support older Anki versions" unticked
+// only contain the newer collection.anki21b and are rejected.
+
+///////////
+// TYPES
+
+type AnkiHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewAnkiHandler(db *pgxpool.Pool) *AnkiHandler {
+	return &AnkiHandler{db: db}
+}
+
+type AnkiImportedSet struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Cards int    `json:"cards"`
+}
+
+type AnkiImportResult struct {
+	Sets    []AnkiImportedSet `json:"sets"`
+	Reviews int               `json:"reviews"`
+	// Media files are not supported and are left out of the import
+	MediaSkipped int `json:"media_skipped"`
+}
+
+// A note read from an Anki collection, with the scheduling of its first card
+type ankiNote struct {
+	CardID int64
+	DeckID int64
+	Fields []string
+	Type   int
+	Queue  int
+	Due    int64
+	Ivl    int
+	Factor int
+	Reps   int
+	Lapses int
+}
+
+type ankiRevlog struct {
+	ID      int64
+	CardID  int64
+	Ease    int
+	Ivl     int
+	LastIvl int
+	Time    int
+}
+
+// Keep in step with client_max_body_size for /import/anki in nginx.conf
+const maxAnkiBytes = 200 << 20
+
+// Largest collection extracted from a package, so a small zip cannot
+// expand to fill the disk
+const maxAnkiCollectionBytes = 1 << 30
+
+var errFileTooLarge = errors.New("file is too large")
+
+const ankiSecondsPerDay = 86400
+
+// Anki card types
+const (
+	ankiTypeNew = iota
+	ankiTypeLearning
+	ankiTypeReview
+	ankiTypeRelearning
+)
+
+var (
+	ankiBreakRE = regexp.MustCompile(`(?i)<br\s*/?>|</div>|</p>`)
+	ankiTagRE   = regexp.MustCompile(`<[^>]*>`)
+	ankiSoundRE = regexp.MustCompile(`\[sound:[^\]]*\]`)
+)
+
+////////////
+// ROUTES
+
+var (
+	AnkiImportRE = regexp.MustCompile(`^\/import\/anki\/?$`)
+)
+
+func (h *AnkiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// ANKI IMPORT ROUTE
+	case AnkiImportRE.MatchString(url) && r.Method == http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxAnkiBytes)
+		file, _, err := r.FormFile("file")
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, "package is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "missing file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		result, err := h.ImportPackage(claims.UserID, file)
+		if err != nil {
+			log.Printf("error importing anki package for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error importing package: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Turns the HTML of an Anki field into plain text
+func ankiFieldToText(s string) string {
+	s = ankiBreakRE.ReplaceAllString(s, "\n")
+	s = ankiTagRE.ReplaceAllString(s, "")
+	s = ankiSoundRE.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// Turns plain card text into the HTML Anki expects in a field
+func textToAnkiField(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
+
+// Checksum of a note's sort field, used by Anki to find duplicates
+func ankiChecksum(s string) int64 {
+	sum := sha1.Sum([]byte(s))
+	return int64(binary.BigEndian.Uint32(sum[:4]))
+}
+
+// Converts an Anki answer button (1-4) to a grade, or -1 for entries that
+// are not answers, like manual reschedules
+func ankiEaseToGrade(ease int) int {
+	switch ease {
+	case 1:
+		return 1
+	case 2:
+		return 3
+	case 3:
+		return 4
+	case 4:
+		return 5
+	}
+	return -1
+}
+
+func gradeToAnkiEase(grade int) int {
+	switch {
+	case grade <= 2:
+		return 1
+	case grade == 3:
+		return 2
+	case grade == 4:
+		return 3
+	}
+	return 4
+}
+
+// Anki stores learning intervals as negative seconds
+func ankiIntervalDays(ivl int) int {
+	return max(ivl, 0)
+}
+
+// Copies at most limit bytes of a reader into a temporary file that the
+// caller must remove. Returns errFileTooLarge if the reader holds more.
+func writeTempFile(r io.Reader, pattern string, limit int64) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = errFileTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Maps the scheduling of an Anki card onto a card state. Returns nil for
+// cards that were never studied.
+func ankiCardState(n ankiNote, accountID int, cardID int, crt int64, logs []ankiRevlog, now time.Time) *CardState {
+	if n.Type == ankiTypeNew {
+		return nil
+	}
+	state := NewCardState(accountID, cardID, now)
+	switch n.Type {
+	case ankiTypeLearning:
+		state.State = CardStateLearning
+	case ankiTypeReview:
+		state.State = CardStateReview
+	case ankiTypeRelearning:
+		state.State = CardStateRelearning
+	default:
+		return nil
+	}
+	if n.Factor > 0 {
+		state.Ease = float64(n.Factor) / 1000
+	}
+	state.Interval = ankiIntervalDays(n.Ivl)
+	state.Repetitions = n.Reps
+	state.Lapses = n.Lapses
+	// Cards in the intraday learning queue are due at a timestamp, all
+	// others on a day counted from the collection's creation
+	if n.Due > 1_000_000_000 {
+		state.Due = time.Unix(n.Due, 0)
+	} else {
+		state.Due = time.Unix(crt+n.Due*ankiSecondsPerDay, 0)
+	}
+	if len(logs) > 0 {
+		state.Introduced = time.UnixMilli(logs[0].ID)
+		last := time.UnixMilli(logs[len(logs)-1].ID)
+		state.LastReviewed = pgtype.Timestamptz{Time: last, Valid: true}
+	}
+	return &state
+}
+
+////////////
+// CREATE
+
+// Creates one set per deck in an Anki package, with a card per note. The
+// first field of a note becomes the front and the remaining fields the
+// back. Scheduling and the review log are imported for the account.
+func (h *AnkiHandler) ImportPackage(accountID int, pkg io.Reader) (*AnkiImportResult, error) {
+	pkgPath, err := writeTempFile(pkg, "apkg-*.zip", maxAnkiBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error saving package: %w", err)
+	}
+	defer os.Remove(pkgPath)
+	archive, err := zip.OpenReader(pkgPath)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid .apkg file")
+	}
+	defer archive.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	collection := files["collection.anki21"]
+	if collection == nil {
+		collection = files["collection.anki2"]
+	}
+	if collection == nil {
+		if files["collection.anki21b"] != nil {
+			return nil, fmt.Errorf("package uses the new Anki format, export it with \"Support older Anki versions\" ticked")
+		}
+		return nil, fmt.Errorf("package has no collection")
+	}
+
+	result := AnkiImportResult{Sets: []AnkiImportedSet{}}
+	if f := files["media"]; f != nil {
+		rc, err := f.Open()
+		if err == nil {
+			var media map[string]string
+			if json.NewDecoder(rc).Decode(&media) == nil {
+				result.MediaSkipped = len(media)
+			}
+			rc.Close()
+		}
+	}
+
+	// The header can lie, so the copy is limited as well
+	if collection.UncompressedSize64 > maxAnkiCollectionBytes {
+		return nil, fmt.Errorf("collection is too large")
+	}
+	rc, err := collection.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading collection: %w", err)
+	}
+	collectionPath, err := writeTempFile(rc, "collection-*.anki2", maxAnkiCollectionBytes)
+	rc.Close()
+	if errors.Is(err, errFileTooLarge) {
+		return nil, fmt.Errorf("collection is too large")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error saving collection: %w", err)
+	}
+	defer os.Remove(collectionPath)
+	lite, err := sql.Open("sqlite3", "file:"+collectionPath+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("error opening collection: %w", err)
+	}
+	defer lite.Close()
+
+	var crt int64
+	var decksJSON string
+	err = lite.QueryRow(`SELECT crt, decks FROM col`).Scan(&crt, &decksJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error reading collection: %w", err)
+	}
+	var decks map[string]struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+		Desc string `json:"desc"`
+	}
+	err = json.Unmarshal([]byte(decksJSON), &decks)
+	if err != nil {
+		return nil, fmt.Errorf("error reading decks: %w", err)
+	}
+
+	// Every note brings at least one card, so a package with too many notes
+	// is turned away before its cards are read
+	errTooManyCards := fmt.Errorf("too many cards, the limit is %d", maxImportCards)
+	var noteCount int
+	err = lite.QueryRow(`SELECT COUNT(*) FROM notes`).Scan(&noteCount)
+	if err != nil {
+		return nil, fmt.Errorf("error reading notes: %w", err)
+	}
+	if noteCount > maxImportCards {
+		return nil, errTooManyCards
+	}
+
+	// One card per note and deck: the one with the lowest template ordinal.
+	// Grouped once rather than looked up per card, which SQLite answers
+	// through the deck index and so in time quadratic in the deck's size.
+	rows, err := lite.Query(
+		`SELECT c.id, c.did, n.flds, c.type, c.queue, c.due, c.ivl, c.factor, c.reps, c.lapses
+		 FROM cards c JOIN notes n ON n.id = c.nid
+		 JOIN (SELECT nid, did, MIN(ord) AS ord FROM cards GROUP BY nid, did) f
+		   ON f.nid = c.nid AND f.did = c.did AND f.ord = c.ord
+		 ORDER BY c.did, n.id`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading notes: %w", err)
+	}
+	notesByDeck := map[int64][]ankiNote{}
+	var deckIDs []int64
+	imported := map[int64]bool{}
+	for rows.Next() {
+		// A note can have cards in several decks
+		if len(imported) == maxImportCards {
+			rows.Close()
+			return nil, errTooManyCards
+		}
+		var n ankiNote
+		var flds string
+		err := rows.Scan(&n.CardID, &n.DeckID, &flds, &n.Type, &n.Queue, &n.Due,
+			&n.Ivl, &n.Factor, &n.Reps, &n.Lapses)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning note: %w", err)
+		}
+		n.Fields = strings.Split(flds, "\x1f")
+		if _, ok := notesByDeck[n.DeckID]; !ok {
+			deckIDs = append(deckIDs, n.DeckID)
+		}
+		notesByDeck[n.DeckID] = append(notesByDeck[n.DeckID], n)
+		imported[n.CardID] = true
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading notes: %w", rows.Err())
+	}
+	if len(deckIDs) == 0 {
+		return nil, fmt.Errorf("package has no cards")
+	}
+
+	revlogs := map[int64][]ankiRevlog{}
+	rows, err = lite.Query(
+		`SELECT id, cid, ease, ivl, lastIvl, time FROM revlog ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading review log: %w", err)
+	}
+	for rows.Next() {
+		var l ankiRevlog
+		err := rows.Scan(&l.ID, &l.CardID, &l.Ease, &l.Ivl, &l.LastIvl, &l.Time)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning review log: %w", err)
+		}
+		// Reviews of cards left out above are not kept
+		if !imported[l.CardID] {
+			continue
+		}
+		revlogs[l.CardID] = append(revlogs[l.CardID], l)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading review log: %w", rows.Err())
+	}
+
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	now := time.Now()
+	var reviewRows [][]any
+	for _, deckID := range deckIDs {
+		deck := decks[fmt.Sprint(deckID)]
+		name := deck.Name
+		if name == "" {
+			name = "Anki deck"
+		}
+		var setID int
+		err := tx.QueryRow(ctx,
+			`INSERT INTO sets (account_id, name, description)
+			 VALUES($1, $2, $3) RETURNING id`,
+			accountID, name, ankiFieldToText(deck.Desc)).Scan(&setID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating set: %w", err)
+		}
+		notes := notesByDeck[deckID]
+		batch := &pgx.Batch{}
+		for _, n := range notes {
+			front := ankiFieldToText(n.Fields[0])
+			var back []string
+			for _, f := range n.Fields[1:] {
+				if text := ankiFieldToText(f); text != "" {
+					back = append(back, text)
+				}
+			}
+			batch.Queue(`INSERT INTO cards (set_id, front, back) VALUES($1, $2, $3) RETURNING id`,
+				setID, front, strings.Join(back, "\n"))
+		}
+		results := tx.SendBatch(ctx, batch)
+		cardIDs := make([]int, len(notes))
+		for i := range notes {
+			err := results.QueryRow().Scan(&cardIDs[i])
+			if err != nil {
+				results.Close()
+				return nil, fmt.Errorf("error creating card: %w", err)
+			}
+		}
+		err = results.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error creating cards: %w", err)
+		}
+
+		for i, n := range notes {
+			logs := revlogs[n.CardID]
+			state := ankiCardState(n, accountID, cardIDs[i], crt, logs, now)
+			if state == nil {
+				continue
+			}
+			err := saveCardState(ctx, tx, *state)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range logs {
+				grade := ankiEaseToGrade(l.Ease)
+				if grade < 0 {
+					continue
+				}
+				reviewRows = append(reviewRows, []any{accountID, cardIDs[i], grade,
+					max(l.Time, 0), ankiIntervalDays(l.LastIvl), ankiIntervalDays(l.Ivl),
+					time.UnixMilli(l.ID)})
+			}
+		}
+		result.Sets = append(result.Sets, AnkiImportedSet{ID: setID, Name: name, Cards: len(notes)})
+	}
+
+	if len(reviewRows) > 0 {
+		n, err := tx.CopyFrom(ctx,
+			pgx.Identifier{"reviews"},
+			[]string{"account_id", "card_id", "grade", "duration_ms", "prev_interval", "new_interval", "reviewed"},
+			pgx.CopyFromRows(reviewRows))
+		if err != nil {
+			return nil, fmt.Errorf("error copying reviews: %w", err)
+		}
+		result.Reviews = int(n)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return &result, nil
+}
+
+//////////
+// READ
+
+// Schema 11 of an Anki collection
+const ankiSchema = `
+CREATE TABLE col (id integer PRIMARY KEY, crt integer NOT NULL, mod integer NOT NULL,
+  scm integer NOT NULL, ver integer NOT NULL, dty integer NOT NULL, usn integer NOT NULL,
+  ls integer NOT NULL, conf text NOT NULL, models text NOT NULL, decks text NOT NULL,
+  dconf text NOT NULL, tags text NOT NULL);
+CREATE TABLE notes (id integer PRIMARY KEY, guid text NOT NULL, mid integer NOT NULL,
+  mod integer NOT NULL, usn integer NOT NULL, tags text NOT NULL, flds text NOT NULL,
+  sfld integer NOT NULL, csum integer NOT NULL, flags integer NOT NULL, data text NOT NULL);
+CREATE TABLE cards (id integer PRIMARY KEY, nid integer NOT NULL, did integer NOT NULL,
+  ord integer NOT NULL, mod integer NOT NULL, usn integer NOT NULL, type integer NOT NULL,
+  queue integer NOT NULL, due integer NOT NULL, ivl integer NOT NULL, factor integer NOT NULL,
+  reps integer NOT NULL, lapses integer NOT NULL, left integer NOT NULL, odue integer NOT NULL,
+  odid integer NOT NULL, flags integer NOT NULL, data text NOT NULL);
+CREATE TABLE revlog (id integer PRIMARY KEY, cid integer NOT NULL, usn integer NOT NULL,
+  ease integer NOT NULL, ivl integer NOT NULL, lastIvl integer NOT NULL, factor integer NOT NULL,
+  time integer NOT NULL, type integer NOT NULL);
+CREATE TABLE graves (usn integer NOT NULL, oid integer NOT NULL, type integer NOT NULL);
+CREATE INDEX ix_notes_usn ON notes (usn);
+CREATE INDEX ix_cards_usn ON cards (usn);
+CREATE INDEX ix_revlog_usn ON revlog (usn);
+CREATE INDEX ix_cards_nid ON cards (nid);
+CREATE INDEX ix_cards_sched ON cards (did, queue, due);
+CREATE INDEX ix_revlog_cid ON revlog (cid);
+CREATE INDEX ix_notes_csum ON notes (csum);
+`
+
+// Deck options written into exported collections
+const ankiDeckConf = `{"1": {"id": 1, "name": "Default", "mod": 0, "usn": -1, "maxTaken": 60,
+  "autoplay": true, "timer": 0, "replayq": true, "dyn": false,
+  "new": {"bury": true, "delays": [1, 10], "initialFactor": 2500, "ints": [1, 4, 7],
+    "order": 1, "perDay": 20, "separate": true},
+  "rev": {"bury": true, "ease4": 1.3, "fuzz": 0.05, "ivlFct": 1, "maxIvl": 36500,
+    "minSpace": 1, "perDay": 200, "hardFactor": 1.2},
+  "lapse": {"delays": [10], "leechAction": 1, "leechFails": 8, "minInt": 1, "mult": 0}}}`
+
+// Writes a set as an Anki package with a deck of Basic notes. Cards keep
+// the scheduling and review log of accountID; anonymous exports (-1) have
+// every card new.
+func (h *AnkiHandler) ExportPackage(w io.Writer, set *Set, accountID int) error {
+	ctx := context.Background()
+	dir, err := os.MkdirTemp("", "apkg-*")
+	if err != nil {
+		return fmt.Errorf("error creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	collectionPath := filepath.Join(dir, "collection.anki2")
+	lite, err := sql.Open("sqlite3", "file:"+collectionPath)
+	if err != nil {
+		return fmt.Errorf("error creating collection: %w", err)
+	}
+	defer lite.Close()
+	_, err = lite.Exec(ankiSchema)
+	if err != nil {
+		return fmt.Errorf("error creating collection: %w", err)
+	}
+
+	now := time.Now()
+	// Review due days are counted from the collection's creation
+	crt := time.Date(set.Created.Year(), set.Created.Month(), set.Created.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	nowMS := now.UnixMilli()
+	modelID := nowMS
+	deckID := nowMS + 1
+	name := "disco set"
+	if set.Name.Valid && set.Name.String != "" {
+		name = set.Name.String
+	}
+
+	field := func(name string, ord int) map[string]any {
+		return map[string]any{"name": name, "ord": ord, "sticky": false, "rtl": false,
+			"font": "Arial", "size": 20, "media": []any{}}
+	}
+	models := map[string]any{fmt.Sprint(modelID): map[string]any{
+		"id": modelID, "name": "Basic (disco)", "type": 0, "mod": now.Unix(), "usn": -1,
+		"sortf": 0, "did": deckID, "tags": []any{}, "vers": []any{},
+		"flds": []any{field("Front", 0), field("Back", 1)},
+		"tmpls": []any{map[string]any{"name": "Card 1", "ord": 0, "qfmt": "{{Front}}",
+			"afmt": "{{FrontSide}}\n\n<hr id=answer>\n\n{{Back}}", "did": nil, "bqfmt": "", "bafmt": ""}},
+		"css":       ".card {\n font-family: arial;\n font-size: 20px;\n text-align: center;\n}\n",
+		"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+		"latexPost": "\\end{document}",
+		"req":       []any{[]any{0, "any", []any{0}}},
+	}}
+	deck := func(id int64, name string, desc string) map[string]any {
+		return map[string]any{"id": id, "name": name, "desc": desc, "mod": now.Unix(), "usn": -1,
+			"dyn": 0, "conf": 1, "collapsed": false, "extendNew": 10, "extendRev": 50,
+			"newToday": []int{0, 0}, "revToday": []int{0, 0}, "lrnToday": []int{0, 0}, "timeToday": []int{0, 0}}
+	}
+	decks := map[string]any{
+		"1":                deck(1, "Default", ""),
+		fmt.Sprint(deckID): deck(deckID, name, textToAnkiField(set.Description.String)),
+	}
+	conf := map[string]any{"nextPos": 1, "estTimes": true, "activeDecks": []int64{deckID},
+		"sortType": "noteFld", "timeLim": 0, "sortBackwards": false, "addToCur": true,
+		"curDeck": deckID, "newSpread": 0, "dueCounts": true, "curModel": modelID, "collapseTime": 1200}
+
+	rows, err := h.db.Query(ctx,
+		`SELECT c.id, c.front, c.back, cs.state, cs.due, cs.interval, cs.ease,
+		        cs.repetitions, cs.lapses
+		 FROM cards c
+		 LEFT JOIN card_states cs ON cs.card_id = c.id AND cs.account_id = $2
+		 WHERE c.set_id=$1
+		 ORDER BY c.id ASC`, set.ID, accountID)
+	if err != nil {
+		return fmt.Errorf("error querying cards: %w", err)
+	}
+	defer rows.Close()
+	liteTx, err := lite.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning collection transaction: %w", err)
+	}
+	defer liteTx.Rollback()
+	ankiIDs := map[int]int64{}
+	position := 0
+	for rows.Next() {
+		var c Card
+		var state pgtype.Text
+		var due pgtype.Timestamptz
+		var interval, reps, lapses pgtype.Int4
+		var ease pgtype.Float8
+		err := rows.Scan(&c.ID, &c.Front, &c.Back, &state, &due, &interval, &ease, &reps, &lapses)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		position++
+		id := nowMS + 2 + int64(position)
+		ankiIDs[c.ID] = id
+		front := textToAnkiField(c.Front)
+		_, err = liteTx.Exec(
+			`INSERT INTO notes VALUES(?, ?, ?, ?, -1, '', ?, ?, ?, 0, '')`,
+			id, fmt.Sprintf("disco-%d", c.ID), modelID, now.Unix(),
+			front+"\x1f"+textToAnkiField(c.Back), c.Front, ankiChecksum(c.Front))
+		if err != nil {
+			return fmt.Errorf("error writing note: %w", err)
+		}
+		cardType, queue, cardDue := ankiTypeNew, 0, int64(position)
+		ivl, factor := 0, 0
+		if state.Valid && state.String != CardStateNew {
+			switch state.String {
+			case CardStateLearning:
+				cardType, queue, cardDue = ankiTypeLearning, 1, due.Time.Unix()
+			case CardStateRelearning:
+				cardType, queue, cardDue = ankiTypeRelearning, 1, due.Time.Unix()
+			default:
+				cardType, queue = ankiTypeReview, 2
+				cardDue = (due.Time.Unix() - crt) / ankiSecondsPerDay
+			}
+			ivl, factor = int(interval.Int32), int(ease.Float64*1000)
+		}
+		_, err = liteTx.Exec(
+			`INSERT INTO cards VALUES(?, ?, ?, 0, ?, -1, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0, 0, '')`,
+			id, id, deckID, now.Unix(), cardType, queue, cardDue, ivl, factor,
+			reps.Int32, lapses.Int32)
+		if err != nil {
+			return fmt.Errorf("error writing card: %w", err)
+		}
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("error querying cards: %w", rows.Err())
+	}
+	rows.Close()
+	conf["nextPos"] = position + 1
+
+	if accountID >= 0 {
+		rows, err := h.db.Query(ctx,
+			`SELECT r.card_id, r.grade, r.duration_ms, r.prev_interval, r.new_interval, r.reviewed
+			 FROM reviews r JOIN cards c ON c.id = r.card_id
+			 WHERE c.set_id=$1 AND r.account_id=$2
+			 ORDER BY r.reviewed ASC, r.id ASC`, set.ID, accountID)
+		if err != nil {
+			return fmt.Errorf("error querying reviews: %w", err)
+		}
+		defer rows.Close()
+		var lastID int64
+		for rows.Next() {
+			var cardID, grade, prevInterval, newInterval int
+			var duration pgtype.Int4
+			var reviewed time.Time
+			err := rows.Scan(&cardID, &grade, &duration, &prevInterval, &newInterval, &reviewed)
+			if err != nil {
+				return fmt.Errorf("error scanning row: %w", err)
+			}
+			// Review log ids are millisecond timestamps and must be unique
+			id := max(reviewed.UnixMilli(), lastID+1)
+			lastID = id
+			reviewType := 1
+			if prevInterval == 0 {
+				reviewType = 0
+			}
+			_, err = liteTx.Exec(
+				`INSERT INTO revlog VALUES(?, ?, -1, ?, ?, ?, 0, ?, ?)`,
+				id, ankiIDs[cardID], gradeToAnkiEase(grade), newInterval, prevInterval,
+				duration.Int32, reviewType)
+			if err != nil {
+				return fmt.Errorf("error writing review: %w", err)
+			}
+		}
+		if rows.Err() != nil {
+			return fmt.Errorf("error querying reviews: %w", rows.Err())
+		}
+	}
+
+	jsonValues := []any{conf, models, decks}
+	jsonText := make([]any, len(jsonValues))
+	for i, v := range jsonValues {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error marshalling json: %w", err)
+		}
+		jsonText[i] = string(data)
+	}
+	_, err = liteTx.Exec(
+		`INSERT INTO col VALUES(1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')`,
+		crt, nowMS, nowMS, jsonText[0], jsonText[1], jsonText[2], ankiDeckConf)
+	if err != nil {
+		return fmt.Errorf("error writing collection: %w", err)
+	}
+	err = liteTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing collection: %w", err)
+	}
+	err = lite.Close()
+	if err != nil {
+		return fmt.Errorf("error closing collection: %w", err)
+	}
+
+	out := zip.NewWriter(w)
+	zw, err := out.Create("collection.anki2")
+	if err != nil {
+		return fmt.Errorf("error writing package: %w", err)
+	}
+	f, err := os.Open(collectionPath)
+	if err != nil {
+		return fmt.Errorf("error reading collection: %w", err)
+	}
+	defer f.Close()
+	_, err = io.Copy(zw, f)
+	if err != nil {
+		return fmt.Errorf("error writing package: %w", err)
+	}
+	zw, err = out.Create("media")
+	if err != nil {
+		return fmt.Errorf("error writing package: %w", err)
+	}
+	io.WriteString(zw, "{}")
+	return out.Close()
+}
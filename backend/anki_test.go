@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Builds a package of Basic notes, each with a card in each of the first
+// decks deck IDs
+func ankiTestPackage(t *testing.T, notes int, decks int) []byte {
+	t.Helper()
+	collectionPath := filepath.Join(t.TempDir(), "collection.anki2")
+	lite, err := sql.Open("sqlite3", "file:"+collectionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lite.Close()
+	if _, err := lite.Exec(ankiSchema); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := lite.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec(`INSERT INTO col VALUES (1, 0, 0, 0, 11, 0, 0, 0, '{}', '{}', '{}', '{}', '{}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardID := 0
+	for noteID := 1; noteID <= notes; noteID++ {
+		_, err := tx.Exec(`INSERT INTO notes VALUES (?, ?, 1, 0, 0, '', ?, 0, 0, 0, '')`,
+			noteID, fmt.Sprint("guid", noteID), "front\x1fback")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for deckID := 1; deckID <= decks; deckID++ {
+			cardID++
+			_, err = tx.Exec(`INSERT INTO cards VALUES (?, ?, ?, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, '')`,
+				cardID, noteID, deckID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	lite.Close()
+
+	collection, err := os.ReadFile(collectionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	f, _ := archive.Create("collection.anki2")
+	f.Write(collection)
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestImportPackageCardLimit(t *testing.T) {
+	// Turned away before anything is written, so no database is needed
+	h := &AnkiHandler{}
+	for _, tt := range []struct {
+		name  string
+		notes int
+		decks int
+	}{
+		{"too many notes", maxImportCards + 1, 1},
+		{"notes in several decks", maxImportCards/2 + 1, 2},
+	} {
+		_, err := h.ImportPackage(1, bytes.NewReader(ankiTestPackage(t, tt.notes, tt.decks)))
+		if err == nil || !strings.Contains(err.Error(), "too many cards") {
+			t.Errorf("%s: %v, want too many cards", tt.name, err)
+		}
+	}
+}
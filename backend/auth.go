@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,7 +17,6 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var accessTokenExpiration = (time.Second * 10)
@@ -26,14 +27,23 @@ type AuthMiddleware struct {
 	next           http.Handler
 	db             *pgxpool.Pool
 	accountHandler *AccountHandler
-	accessSecret   string
-	refreshSecret  string
+	mailer         Mailer
+	verifier       *EmailVerifier
+	twoFactor      *TwoFactorHandler
+	oidc           *OIDCHandler
+	limiter        *LoginLimiter
+	accessKeys     *Keyring
+	refreshKeys    *Keyring
 }
 
 // Claims to be included in restricted route context
 type Claims struct {
 	UserID   int    `json:"userid"`
 	Username string `json:"username"`
+	Verified bool   `json:"verified"`
+	// Scope of the personal access token the request was made with, empty
+	// for cookies
+	Scope string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -46,14 +56,19 @@ type AuthDetails struct {
 
 // Creates a new Auth Middleware
 func NewAuthMiddleware(handlerToWrap http.Handler,
-	db *pgxpool.Pool, accountHandler *AccountHandler,
-	accessSecret string, refreshSecret string) *AuthMiddleware {
+	db *pgxpool.Pool, accountHandler *AccountHandler, mailer Mailer, verifier *EmailVerifier,
+	twoFactor *TwoFactorHandler, oidc *OIDCHandler, limiter *LoginLimiter, accessKeys *Keyring, refreshKeys *Keyring) *AuthMiddleware {
 	return &AuthMiddleware{
 		next:           handlerToWrap,
 		db:             db,
 		accountHandler: accountHandler,
-		accessSecret:   accessSecret,
-		refreshSecret:  refreshSecret,
+		mailer:         mailer,
+		verifier:       verifier,
+		twoFactor:      twoFactor,
+		oidc:           oidc,
+		limiter:        limiter,
+		accessKeys:     accessKeys,
+		refreshKeys:    refreshKeys,
 	}
 }
 
@@ -61,12 +76,36 @@ func NewAuthMiddleware(handlerToWrap http.Handler,
 // ROUTES
 
 var (
-	LoginPathRE     = regexp.MustCompile(`^\/login\/?$`)
-	LogoutPathRE    = regexp.MustCompile(`\/logout\/?$`)
-	RegisterPathRE  = regexp.MustCompile(`^\/register\/?$`)
-	IdentityRouteRE = regexp.MustCompile(`^\/me\/?$`)
+	LoginPathRE      = regexp.MustCompile(`^\/login\/?$`)
+	LogoutPathRE     = regexp.MustCompile(`\/logout\/?$`)
+	RegisterPathRE   = regexp.MustCompile(`^\/register\/?$`)
+	IdentityRouteRE  = regexp.MustCompile(`^\/me\/?$`)
+	ForgotPasswordRE = regexp.MustCompile(`^\/password\/forgot\/?$`)
+	ResetPasswordRE  = regexp.MustCompile(`^\/password\/reset\/?$`)
 )
 
+// GET routes that anonymous callers may use. Logged in callers still
+// have their claims attached.
+var OptionalAuthRoutes = []*regexp.Regexp{
+	SetREWithID,
+	SetExportRE,
+	ExploreRE,
+	SearchRE,
+	PictureRE,
+}
+
+func isOptionalAuthRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, re := range OptionalAuthRoutes {
+		if re.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
 // HTTP Routes
 func (h *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path
@@ -129,10 +168,19 @@ func (h *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		// Create account
 		userID, err := h.accountHandler.CreateAccount(email, username, password)
+		var policyErr *passwordPolicyError
+		if errors.As(err, &policyErr) {
+			http.Error(w, policyErr.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil || userID < 0 {
 			http.Error(w, fmt.Sprintf("error creating account: %v", err), http.StatusInternalServerError)
 			return
 		}
+		err = h.verifier.SendVerification(userID, email)
+		if err != nil {
+			log.Printf("error sending verification email for %s: %v\n", clientIP, err)
+		}
 		// Login
 		h.SetAuthCookies(w, r, userID, username)
 		w.WriteHeader(http.StatusOK)
@@ -149,24 +197,120 @@ func (h *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		emailOrUsername := r.FormValue("emailorusername")
 		password := r.FormValue("password")
 
+		// Turn away limited logins before paying for password hashing
+		ctx := r.Context()
+		attempt, ok := h.checkLoginLimit(w, r, emailOrUsername)
+		if !ok {
+			return
+		}
 		userID, username, err := h.Authenticate(emailOrUsername, password)
 		if err != nil {
+			h.limiter.Release(ctx, attempt)
 			http.Error(w, fmt.Sprintf("error authenticating: %v", err), http.StatusInternalServerError)
 			return
 		}
 		if userID < 0 {
+			err = h.limiter.Fail(ctx, attempt)
+			if err != nil {
+				log.Printf("error recording failed login for %s: %v\n", clientIP, err)
+			}
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		// Accounts with 2FA only get their cookies from /login/2fa, and
+		// their failures are only forgotten once the code is right too
+		challenge, err := h.twoFactor.StartLogin(userID)
+		if err != nil {
+			h.limiter.Release(ctx, attempt)
+			log.Printf("error starting 2fa login for %s: %v\n", clientIP, err)
+			http.Error(w, "error authenticating", http.StatusInternalServerError)
+			return
+		}
+		if challenge != "" {
+			h.limiter.Release(ctx, attempt)
+			writeJSON(w, LoginChallenge{TwoFactorRequired: true, Challenge: challenge}, http.StatusOK)
+			return
+		}
+		err = h.limiter.Succeed(ctx, attempt)
+		if err != nil {
+			log.Printf("error recording login for %s: %v\n", clientIP, err)
+		}
 		h.SetAuthCookies(w, r, userID, username)
 		return
 
+	// TWO-FACTOR LOGIN ROUTE
+	case LoginTwoFactorRE.MatchString(url) && r.Method == http.MethodPost:
+		log.Printf("Handled two-factor login route for %s\n", clientIP)
+		h.serveLoginTwoFactor(w, r)
+		return
+
 	// LOGOUT ROUTE
 	case LogoutPathRE.MatchString(url) && r.Method == http.MethodPost:
 		log.Printf("Handled logout route for %s\n", clientIP)
 		h.DeleteAuthCookies(w, r)
 		return
 
+	// FORGOT PASSWORD ROUTE
+	case ForgotPasswordRE.MatchString(url) && r.Method == http.MethodPost:
+		log.Printf("Handled forgot password route for %s\n", clientIP)
+		h.serveForgotPassword(w, r)
+		return
+
+	// RESET PASSWORD ROUTE
+	case ResetPasswordRE.MatchString(url) && r.Method == http.MethodPost:
+		log.Printf("Handled reset password route for %s\n", clientIP)
+		h.serveResetPassword(w, r)
+		return
+
+	// VERIFY EMAIL ROUTE
+	case VerifyEmailRE.MatchString(url) && r.Method == http.MethodPost:
+		log.Printf("Handled verify email route for %s\n", clientIP)
+		h.verifier.serveVerify(w, r)
+		return
+
+	// RESEND VERIFICATION ROUTE
+	case ResendEmailRE.MatchString(url) && r.Method == http.MethodPost:
+		log.Printf("Handled resend verification route for %s\n", clientIP)
+		claims := h.RefreshAccess(w, r)
+		if claims == nil {
+			return
+		}
+		h.verifier.serveResend(w, r, claims)
+		return
+
+	// JWKS ROUTE
+	case JWKSRE.MatchString(url) && r.Method == http.MethodGet:
+		log.Printf("Handled jwks route for %s\n", clientIP)
+		h.accessKeys.serveJWKS(w, r)
+		return
+
+	// OIDC PROVIDERS ROUTE
+	case OIDCProvidersRE.MatchString(url) && r.Method == http.MethodGet:
+		log.Printf("Handled oidc providers route for %s\n", clientIP)
+		h.oidc.serveProviders(w, r)
+		return
+
+	// OIDC LOGIN ROUTE
+	case OIDCLoginRE.MatchString(url) && r.Method == http.MethodGet:
+		log.Printf("Handled oidc login route for %s\n", clientIP)
+		h.oidc.serveStart(w, r, OIDCLoginRE.FindStringSubmatch(url)[1], -1, false)
+		return
+
+	// OIDC CALLBACK ROUTE
+	case OIDCCallbackRE.MatchString(url) && r.Method == http.MethodGet:
+		log.Printf("Handled oidc callback route for %s\n", clientIP)
+		h.serveOIDCCallback(w, r)
+		return
+
+	// OPTIONAL AUTH ROUTE
+	case isOptionalAuthRoute(r):
+		log.Printf("Handled optional auth route for %s\n", clientIP)
+		claims := h.OptionalAccess(w, r)
+		ctx := context.WithValue(r.Context(), "claims", claims)
+		r = r.WithContext(ctx)
+		h.next.ServeHTTP(w, r)
+		return
+
 	// RESTRICTED ROUTE
 	default:
 		log.Printf("Handled restricted route for %s\n", clientIP)
@@ -174,6 +318,10 @@ func (h *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if claims == nil {
 			return
 		}
+		if !h.verifier.Allows(claims, r) {
+			writeJSONError(w, "email not verified", http.StatusForbidden)
+			return
+		}
 		ctx := context.WithValue(r.Context(), "claims", claims)
 		r = r.WithContext(ctx)
 		h.next.ServeHTTP(w, r)
@@ -184,8 +332,8 @@ func (h *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Sets both refresh and access cookies
 func (h *AuthMiddleware) SetAuthCookies(w http.ResponseWriter, r *http.Request, userID int, username string) {
-	accessCookie, errGenAccess := h.GenerateAccessCookie(userID, username)
-	refreshCookie, errGenRefresh := h.GenerateRefreshCookie(userID, username)
+	accessCookie, errGenAccess := h.GenerateAccessCookie(userID)
+	refreshCookie, errGenRefresh := h.GenerateRefreshCookie(r, userID, username)
 	if errGenAccess != nil || errGenRefresh != nil {
 		http.Error(w, "error generating tokens", http.StatusInternalServerError)
 		return
@@ -195,6 +343,27 @@ func (h *AuthMiddleware) SetAuthCookies(w http.ResponseWriter, r *http.Request,
 	http.SetCookie(w, refreshCookie)
 }
 
+// Turns away logins over the limits of the login limiter. Writes the
+// response and returns false if the request should not continue; otherwise
+// the attempt has to be passed back to the limiter once its outcome is
+// known.
+func (h *AuthMiddleware) checkLoginLimit(w http.ResponseWriter, r *http.Request, emailOrUsername string) (*loginAttempt, bool) {
+	clientIP := r.Context().Value("clientip").(string)
+	attempt, err := h.limiter.Check(r.Context(), clientIP, emailOrUsername)
+	var limited *loginLimitError
+	if errors.As(err, &limited) {
+		retryAfterHeader(w, limited.RetryAfter)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("error checking login limits for %s: %v\n", clientIP, err)
+		http.Error(w, "error authenticating", http.StatusInternalServerError)
+		return nil, false
+	}
+	return attempt, true
+}
+
 // Validates login credentials.
 func (h *AuthMiddleware) Authenticate(emailOrUsername string, password string) (userID int, username string, err error) {
 	if strings.TrimSpace(emailOrUsername) == "" || strings.TrimSpace(password) == "" {
@@ -216,15 +385,37 @@ func (h *AuthMiddleware) Authenticate(emailOrUsername string, password string) (
 		return -1, "", fmt.Errorf("error getting account: %w", errGetAccount)
 	}
 	if authDetails == nil {
-		return -1, "", fmt.Errorf("error getting auth details")
+		// No such account, which is a failed login like a wrong password
+		return -1, "", nil
 	}
 	// Authenticate
 	if !VerifyPassword(password, authDetails.Password) {
 		return -1, "", nil
 	}
+	if passwordHasher.NeedsRehash(authDetails.Password) {
+		h.rehashPassword(authDetails, password)
+	}
 	return authDetails.UserID, authDetails.Username, nil
 }
 
+// Replaces a hash made with an outdated algorithm or parameters after a
+// successful login, while the password is at hand. Failures are only
+// logged; the old hash keeps working.
+func (h *AuthMiddleware) rehashPassword(authDetails *AuthDetails, password string) {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		log.Printf("error rehashing password of account %d: %v\n", authDetails.UserID, err)
+		return
+	}
+	// Skipped if the password changed since it was checked
+	_, err = h.db.Exec(context.Background(),
+		`UPDATE accounts SET password=$1 WHERE id=$2 AND password=$3`,
+		hashed, authDetails.UserID, authDetails.Password)
+	if err != nil {
+		log.Printf("error storing rehashed password of account %d: %v\n", authDetails.UserID, err)
+	}
+}
+
 // Given username, returns auth details (userID and password)
 func (h *AuthMiddleware) GetAuthDetailsByUsername(username string) (*AuthDetails, error) {
 	rows, err := h.db.Query(context.Background(),
@@ -266,16 +457,25 @@ func (h *AuthMiddleware) GetAuthDetailsByEmail(email string) (*AuthDetails, erro
 }
 
 // Generates access token in the form of a cookie
-func (h *AuthMiddleware) GenerateAccessCookie(userid int, username string) (*http.Cookie, error) {
+func (h *AuthMiddleware) GenerateAccessCookie(userid int) (*http.Cookie, error) {
+	// Looked up on every refresh so that a confirmed email or a new
+	// username takes effect within one access token lifetime
+	var username string
+	var verified bool
+	err := h.db.QueryRow(context.Background(),
+		`SELECT username, email_verified FROM accounts WHERE id=$1`, userid).Scan(&username, &verified)
+	if err != nil {
+		return nil, err
+	}
 	accessClaims := &Claims{
 		UserID:   userid,
 		Username: username,
+		Verified: verified,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenExpiration)),
 		},
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString([]byte(h.accessSecret))
+	accessTokenString, err := h.accessKeys.Sign(accessClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -291,40 +491,6 @@ func (h *AuthMiddleware) GenerateAccessCookie(userid int, username string) (*htt
 	return &accessCookie, nil
 }
 
-// Generates refresh token in the form of a cookie and stores the token in the database
-func (h *AuthMiddleware) GenerateRefreshCookie(userid int, username string) (*http.Cookie, error) {
-	refreshClaims := &Claims{
-		UserID:   userid,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshTokenExpiration)),
-		},
-	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(h.refreshSecret))
-	if err != nil {
-		return nil, err
-	}
-	refreshCookie := http.Cookie{
-		Name:     "refresh",
-		Value:    refreshTokenString,
-		Path:     "/",
-		Expires:  refreshClaims.ExpiresAt.Time,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode,
-		Secure:   true,
-	}
-	// Add refresh token to database
-	_, err = h.db.Exec(context.Background(),
-		`INSERT INTO refreshtokens (account_id, token, expires)
-		 VALUES($1, $2, $3)`, refreshClaims.UserID, refreshTokenString, refreshClaims.ExpiresAt.Time)
-	if err != nil {
-		log.Printf("error inserting refresh into table: %v", err)
-		return nil, err
-	}
-	return &refreshCookie, nil
-}
-
 // Checks if an access or refresh token is still valid
 func isTokenValid(token *jwt.Token) error {
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
@@ -338,24 +504,7 @@ func isTokenValid(token *jwt.Token) error {
 }
 
 func (h *AuthMiddleware) VerifyAccessToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.accessSecret), nil
-	})
-	if err != nil {
-		return err
-	}
-	err = isTokenValid(token)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (h *AuthMiddleware) VerifyRefreshToken(tokenString string) error {
-	var claims Claims
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.refreshSecret), nil
-	})
+	token, err := h.accessKeys.Parse(tokenString, &Claims{})
 	if err != nil {
 		return err
 	}
@@ -363,37 +512,12 @@ func (h *AuthMiddleware) VerifyRefreshToken(tokenString string) error {
 	if err != nil {
 		return err
 	}
-	// Check that refresh token exists in database
-	rows, err := h.db.Query(context.Background(),
-		`SELECT token FROM refreshtokens
-		 WHERE account_id=$1`, claims.UserID)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	found := false
-	for rows.Next() {
-		var t string
-		err := rows.Scan(&t)
-		if err != nil {
-			return err
-		}
-		if t == tokenString {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return fmt.Errorf("token has been invalidated")
-	}
 	return nil
 }
 
 func (h *AuthMiddleware) GetClaimsFromRefresh(tokenString string) (*Claims, error) {
 	var claims Claims
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(h.refreshSecret), nil
-	})
+	token, err := h.refreshKeys.Parse(tokenString, &claims)
 	if err != nil {
 		return nil, err
 	}
@@ -406,9 +530,7 @@ func (h *AuthMiddleware) GetClaimsFromRefresh(tokenString string) (*Claims, erro
 
 func (h *AuthMiddleware) GetClaimsFromAccess(tokenString string) (*Claims, error) {
 	var claims Claims
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(h.accessSecret), nil
-	})
+	token, err := h.accessKeys.Parse(tokenString, &claims)
 	if err != nil {
 		return nil, err
 	}
@@ -419,27 +541,65 @@ func (h *AuthMiddleware) GetClaimsFromAccess(tokenString string) (*Claims, error
 	return &claims, nil
 }
 
+// Returns the claims of the caller, refreshing the access token if needed.
+// Writes an error status and returns nil if the caller is not logged in.
 func (h *AuthMiddleware) RefreshAccess(w http.ResponseWriter, r *http.Request) (claims *Claims) {
+	claims, status := h.resolveAccess(w, r)
+	if claims == nil {
+		w.WriteHeader(status)
+	}
+	return claims
+}
+
+// Like RefreshAccess, but never rejects the request: callers without valid
+// tokens continue anonymously and nil is returned
+func (h *AuthMiddleware) OptionalAccess(w http.ResponseWriter, r *http.Request) *Claims {
+	accessCookie, _ := r.Cookie("access")
+	refreshCookie, _ := r.Cookie("refresh")
+	_, hasBearer := bearerToken(r)
+	if accessCookie == nil && refreshCookie == nil && !hasBearer {
+		return nil
+	}
+	claims, _ := h.resolveAccess(w, r)
+	return claims
+}
+
+// Validates the access token, or issues a new one from the refresh token if
+// it has expired. On failure returns nil and the status to reject with.
+func (h *AuthMiddleware) resolveAccess(w http.ResponseWriter, r *http.Request) (*Claims, int) {
 	clientIP := r.Context().Value("clientip").(string)
+	// Personal access tokens take the place of cookies
+	if token, ok := bearerToken(r); ok {
+		claims, err := h.AuthenticateAccessToken(token)
+		if errors.Is(err, errInvalidAccessToken) {
+			log.Printf("%s provided invalid access token\n", clientIP)
+			return nil, http.StatusUnauthorized
+		}
+		if err != nil {
+			log.Printf("error authenticating access token for %s: %v\n", clientIP, err)
+			return nil, http.StatusInternalServerError
+		}
+		if !scopeAllows(claims.Scope, r) {
+			return nil, http.StatusForbidden
+		}
+		return claims, http.StatusOK
+	}
 	// Check if access token is still valid
 	currentAccessCookie, _ := r.Cookie("access")
 	if currentAccessCookie != nil {
 		access := currentAccessCookie.Value
 		var accessClaims Claims
-		currentAccess, err := jwt.ParseWithClaims(access, &accessClaims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(h.accessSecret), nil
-		})
+		currentAccess, err := h.accessKeys.Parse(access, &accessClaims)
 		switch {
 		case currentAccess.Valid:
 			// Valid token >> continue request returning userID
-			return &accessClaims
-		case errors.Is(err, jwt.ErrTokenExpired):
-			// Token expired >> continue to refresh
+			return &accessClaims, http.StatusOK
+		case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenUnverifiable):
+			// Token expired or its key was rotated out >> continue to refresh
 		default:
 			// Error other than token expired >> unauthorized
 			log.Printf("error parsing access claims for %s: %v\n", clientIP, err)
-			http.Error(w, "invalid token", http.StatusUnauthorized)
-			return nil
+			return nil, http.StatusUnauthorized
 		}
 	}
 
@@ -448,54 +608,72 @@ func (h *AuthMiddleware) RefreshAccess(w http.ResponseWriter, r *http.Request) (
 		// Remove cookies, unauthorized
 		log.Printf("%s did not provide refresh token\n", clientIP)
 		h.DeleteAuthCookies(w, r)
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil
+		return nil, http.StatusUnauthorized
 	}
 
 	var refreshClaims Claims
-	_, err := jwt.ParseWithClaims(refreshCookie.Value, &refreshClaims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.refreshSecret), nil
-	})
+	_, err := h.refreshKeys.Parse(refreshCookie.Value, &refreshClaims)
 	switch {
 	case err == nil:
 		break
 	case errors.Is(err, jwt.ErrTokenExpired):
 		log.Printf("%s provided an expired refresh token\n", clientIP)
 		h.DeleteAuthCookies(w, r)
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil
+		return nil, http.StatusUnauthorized
 	default:
 		log.Printf("error parsing refresh token for %s: %v\n", clientIP, err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil
+		return nil, http.StatusUnauthorized
 	}
 
-	err = h.VerifyRefreshToken(refreshCookie.Value)
-	if err != nil {
+	newRefreshCookie, err := h.RotateRefreshToken(r, refreshCookie.Value, &refreshClaims)
+	switch {
+	case errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused):
 		log.Printf("%s provided invalid refresh token: %v\n", clientIP, err)
 		h.DeleteAuthCookies(w, r)
-		return nil
+		return nil, http.StatusUnauthorized
+	case err != nil:
+		log.Printf("error rotating refresh token for %s: %v\n", clientIP, err)
+		return nil, http.StatusInternalServerError
 	}
-	newAccessCookie, err := h.GenerateAccessCookie(refreshClaims.UserID, refreshClaims.Username)
+	newAccessCookie, err := h.GenerateAccessCookie(refreshClaims.UserID)
 	if err != nil {
 		log.Printf("error generating new access cookie for %s: %v\n", clientIP, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return nil
+		return nil, http.StatusInternalServerError
 	}
 	newAccessClaims, err := h.GetClaimsFromAccess(newAccessCookie.Value)
 	if err != nil {
 		log.Printf("error getting claims from newly generated access token for %s: %v\n", clientIP, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return nil
+		return nil, http.StatusInternalServerError
 	}
 	log.Printf("refreshed access for %s\n", clientIP)
 	http.SetCookie(w, newAccessCookie)
-	return newAccessClaims
+	if newRefreshCookie != nil {
+		http.SetCookie(w, newRefreshCookie)
+	}
+	return newAccessClaims, http.StatusOK
 }
 
 func (h *AuthMiddleware) DeleteAuthCookies(w http.ResponseWriter, r *http.Request) {
 	clientIP := r.Context().Value("clientip").(string)
 	log.Printf("sending auth cookie delete request to %s\n", clientIP)
+	clearAuthCookies(w)
+
+	// Remove refresh token from db
+	refreshCookie, err := r.Cookie("refresh")
+	if err != nil {
+		log.Printf("%s did not send refresh cookie\n", clientIP)
+	} else {
+		err = h.RevokeRefreshToken(refreshCookie.Value)
+		if err != nil {
+			log.Printf("error deleting token from db for %s: %v\n", clientIP, err)
+			return
+		}
+		log.Printf("successfully deleted refresh token from db for %s\n", clientIP)
+	}
+}
+
+// Sets expired auth cookies, which makes the browser delete them
+func clearAuthCookies(w http.ResponseWriter) {
 	access := http.Cookie{
 		Name:     "access",
 		Value:    "",
@@ -516,39 +694,16 @@ func (h *AuthMiddleware) DeleteAuthCookies(w http.ResponseWriter, r *http.Reques
 		Secure:   true,
 	}
 
-	// Set new cookies, trigger browser delete
 	http.SetCookie(w, &access)
 	http.SetCookie(w, &refresh)
+}
 
-	// Remove refresh token from db
-	refreshCookie, err := r.Cookie("refresh")
+// Returns a random URL-safe token with n bytes of entropy
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
 	if err != nil {
-		log.Printf("%s did not send refresh cookie\n", clientIP)
-	} else {
-		token := refreshCookie.Value
-		claims, err := h.GetClaimsFromRefresh(token)
-		if err != nil {
-			log.Printf("error getting claims from token: %v\n", err)
-			return
-		}
-		_, err = h.db.Exec(context.Background(),
-			`DELETE FROM refreshtokens WHERE account_id=$1 AND token=$2`, claims.UserID, token)
-		if err != nil {
-			log.Printf("error deleting token from db for %s: %v\n", clientIP, err)
-			return
-		}
-		log.Printf("successfully deleted refresh token from db for USERID: %d, IP: %s\n", claims.UserID, clientIP)
+		return "", err
 	}
-}
-
-// HashPassword generates a bcrypt hash for the given password.
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
-
-// VerifyPassword verifies if the given password matches the stored hash.
-func VerifyPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
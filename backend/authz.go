@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Level of access an account has to a set and its cards. Each level
+// includes the ones below it.
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionRead
+	PermissionWrite
+	PermissionAdmin
+)
+
+// Roles that can be given to collaborators on a set
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+)
+
+// Who can read a set besides its owner and collaborators
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted" // anyone with the share link
+	VisibilityPublic   = "public"
+)
+
+// Decides what the caller of a request may do with sets and cards
+type Authorizer struct {
+	db *pgxpool.Pool
+}
+
+func NewAuthorizer(db *pgxpool.Pool) *Authorizer {
+	return &Authorizer{db: db}
+}
+
+var errNotFound = errors.New("not found")
+
+// Details of a set needed to resolve permissions
+type setAccess struct {
+	OwnerID    int
+	Role       pgtype.Text
+	Visibility string
+	ShareToken pgtype.Text
+}
+
+/////////////
+// HELPERS
+
+// Returns the claims of the caller, or nil for anonymous requests
+func claimsFromRequest(r *http.Request) *Claims {
+	claims, _ := r.Context().Value("claims").(*Claims)
+	return claims
+}
+
+// Returns the share token sent with a request for an unlisted set
+func shareTokenFromRequest(r *http.Request) string {
+	return r.URL.Query().Get("share")
+}
+
+// Works out the permission granted by a set's owner, collaborator list
+// and visibility
+func resolvePermission(claims *Claims, access setAccess, shareToken string) Permission {
+	if claims != nil {
+		if access.OwnerID == claims.UserID {
+			return PermissionAdmin
+		}
+		if access.Role.Valid {
+			switch access.Role.String {
+			case RoleEditor:
+				return PermissionWrite
+			case RoleViewer:
+				return PermissionRead
+			}
+		}
+	}
+	switch access.Visibility {
+	case VisibilityPublic:
+		return PermissionRead
+	case VisibilityUnlisted:
+		if shareToken != "" && access.ShareToken.Valid &&
+			subtle.ConstantTimeCompare([]byte(shareToken), []byte(access.ShareToken.String)) == 1 {
+			return PermissionRead
+		}
+	}
+	return PermissionNone
+}
+
+//////////
+// READ
+
+// Returns the caller's permission on a set, or errNotFound if it does not exist
+func (a *Authorizer) SetPermission(claims *Claims, setID int, shareToken string) (Permission, error) {
+	accountID := -1
+	if claims != nil {
+		accountID = claims.UserID
+	}
+	var access setAccess
+	err := a.db.QueryRow(context.Background(),
+		`SELECT s.account_id, sc.role, s.visibility, s.share_token
+		 FROM sets s
+		 LEFT JOIN set_collaborators sc ON sc.set_id = s.id AND sc.account_id = $2
+		 WHERE s.id=$1`, setID, accountID).Scan(
+		&access.OwnerID, &access.Role, &access.Visibility, &access.ShareToken)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return PermissionNone, errNotFound
+	}
+	if err != nil {
+		return PermissionNone, fmt.Errorf("error querying set access: %w", err)
+	}
+	return resolvePermission(claims, access, shareToken), nil
+}
+
+// Returns the caller's permission on a card, which is inherited from its
+// set, or errNotFound if it does not exist
+func (a *Authorizer) CardPermission(claims *Claims, cardID int, shareToken string) (Permission, error) {
+	accountID := -1
+	if claims != nil {
+		accountID = claims.UserID
+	}
+	var access setAccess
+	err := a.db.QueryRow(context.Background(),
+		`SELECT s.account_id, sc.role, s.visibility, s.share_token
+		 FROM cards c
+		 JOIN sets s ON s.id = c.set_id
+		 LEFT JOIN set_collaborators sc ON sc.set_id = s.id AND sc.account_id = $2
+		 WHERE c.id=$1`, cardID, accountID).Scan(
+		&access.OwnerID, &access.Role, &access.Visibility, &access.ShareToken)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return PermissionNone, errNotFound
+	}
+	if err != nil {
+		return PermissionNone, fmt.Errorf("error querying card access: %w", err)
+	}
+	return resolvePermission(claims, access, shareToken), nil
+}
+
+////////////
+// CHECKS
+
+// Checks that the caller has at least the required permission on a set.
+// Callers who cannot read the set get a 404 so that its existence is not
+// revealed; callers who can read it but need more get a 403. Writes the
+// error response and returns false if the request should not continue.
+func (a *Authorizer) RequireSet(w http.ResponseWriter, r *http.Request, setID int, required Permission) bool {
+	perm, err := a.SetPermission(claimsFromRequest(r), setID, shareTokenFromRequest(r))
+	return a.check(w, perm, err, required, "set")
+}
+
+// Same as RequireSet, for a card
+func (a *Authorizer) RequireCard(w http.ResponseWriter, r *http.Request, cardID int, required Permission) bool {
+	perm, err := a.CardPermission(claimsFromRequest(r), cardID, shareTokenFromRequest(r))
+	return a.check(w, perm, err, required, "card")
+}
+
+func (a *Authorizer) check(w http.ResponseWriter, perm Permission, err error, required Permission, resource string) bool {
+	switch {
+	case errors.Is(err, errNotFound):
+		writeJSONError(w, resource+" not found", http.StatusNotFound)
+		return false
+	case err != nil:
+		log.Printf("error checking %s permission: %v\n", resource, err)
+		writeJSONError(w, "error checking permission", http.StatusInternalServerError)
+		return false
+	case perm < PermissionRead:
+		writeJSONError(w, resource+" not found", http.StatusNotFound)
+		return false
+	case perm < required:
+		writeJSONError(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
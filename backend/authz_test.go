@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestResolvePermission(t *testing.T) {
+	owner := &Claims{UserID: 1}
+	collaborator := &Claims{UserID: 2}
+	stranger := &Claims{UserID: 3}
+	role := func(r string) pgtype.Text { return pgtype.Text{String: r, Valid: true} }
+	token := pgtype.Text{String: "s3cret", Valid: true}
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		access setAccess
+		share  string
+		want   Permission
+	}{
+		{"owner of a private set", owner, setAccess{OwnerID: 1, Visibility: VisibilityPrivate}, "", PermissionAdmin},
+		{"editor", collaborator, setAccess{OwnerID: 1, Role: role(RoleEditor), Visibility: VisibilityPrivate}, "", PermissionWrite},
+		{"viewer", collaborator, setAccess{OwnerID: 1, Role: role(RoleViewer), Visibility: VisibilityPrivate}, "", PermissionRead},
+		{"viewer of a public set", collaborator, setAccess{OwnerID: 1, Role: role(RoleViewer), Visibility: VisibilityPublic}, "", PermissionRead},
+		{"stranger on a private set", stranger, setAccess{OwnerID: 1, Visibility: VisibilityPrivate}, "", PermissionNone},
+		{"stranger on a public set", stranger, setAccess{OwnerID: 1, Visibility: VisibilityPublic}, "", PermissionRead},
+		{"anonymous on a public set", nil, setAccess{OwnerID: 1, Visibility: VisibilityPublic}, "", PermissionRead},
+		{"anonymous on a private set", nil, setAccess{OwnerID: 1, Visibility: VisibilityPrivate}, "", PermissionNone},
+		{"unlisted with the share link", stranger, setAccess{OwnerID: 1, Visibility: VisibilityUnlisted, ShareToken: token}, "s3cret", PermissionRead},
+		{"unlisted anonymous with the share link", nil, setAccess{OwnerID: 1, Visibility: VisibilityUnlisted, ShareToken: token}, "s3cret", PermissionRead},
+		{"unlisted without the share link", stranger, setAccess{OwnerID: 1, Visibility: VisibilityUnlisted, ShareToken: token}, "", PermissionNone},
+		{"unlisted with a wrong share link", stranger, setAccess{OwnerID: 1, Visibility: VisibilityUnlisted, ShareToken: token}, "guess", PermissionNone},
+		{"unlisted without a token set", stranger, setAccess{OwnerID: 1, Visibility: VisibilityUnlisted}, "", PermissionNone},
+		{"private set ignores the share link", stranger, setAccess{OwnerID: 1, Visibility: VisibilityPrivate, ShareToken: token}, "s3cret", PermissionNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePermission(tt.claims, tt.access, tt.share); got != tt.want {
+				t.Errorf("permission = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizerCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		perm     Permission
+		err      error
+		required Permission
+		status   int
+	}{
+		{"missing", PermissionNone, errNotFound, PermissionRead, http.StatusNotFound},
+		{"query error", PermissionNone, errors.New("connection reset"), PermissionRead, http.StatusInternalServerError},
+		{"no access is hidden", PermissionNone, nil, PermissionRead, http.StatusNotFound},
+		{"read but write needed", PermissionRead, nil, PermissionWrite, http.StatusForbidden},
+		{"write but admin needed", PermissionWrite, nil, PermissionAdmin, http.StatusForbidden},
+		{"enough", PermissionWrite, nil, PermissionWrite, http.StatusOK},
+	}
+	a := &Authorizer{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := a.check(w, tt.perm, tt.err, tt.required, "set")
+			if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+				t.Errorf("check = %v with status %d, want status %d", ok, w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireSetAndCard(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	owner := createTestAccount(t, db, "owner", "")
+	editor := createTestAccount(t, db, "editor", "")
+	viewer := createTestAccount(t, db, "viewer", "")
+	stranger := createTestAccount(t, db, "stranger", "")
+
+	sets := map[string]int{}
+	cards := map[string]int{}
+	for _, visibility := range []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic} {
+		var setID, cardID int
+		err := db.QueryRow(ctx,
+			`INSERT INTO sets (account_id, name, visibility, share_token)
+			 VALUES($1, $2, $2, CASE WHEN $2 = 'unlisted' THEN 'link' END) RETURNING id`,
+			owner, visibility).Scan(&setID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow(ctx, `INSERT INTO cards (set_id, front, back) VALUES($1, 'f', 'b') RETURNING id`,
+			setID).Scan(&cardID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(ctx, `INSERT INTO set_collaborators (set_id, account_id, role) VALUES($1, $2, 'editor'), ($1, $3, 'viewer')`,
+			setID, editor, viewer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets[visibility] = setID
+		cards[visibility] = cardID
+	}
+
+	tests := []struct {
+		name       string
+		account    int // 0 for anonymous
+		visibility string
+		share      string
+		required   Permission
+		status     int
+	}{
+		{"owner administers", owner, VisibilityPrivate, "", PermissionAdmin, http.StatusOK},
+		{"editor writes", editor, VisibilityPrivate, "", PermissionWrite, http.StatusOK},
+		{"editor cannot administer", editor, VisibilityPrivate, "", PermissionAdmin, http.StatusForbidden},
+		{"viewer reads", viewer, VisibilityPrivate, "", PermissionRead, http.StatusOK},
+		{"viewer cannot write", viewer, VisibilityPrivate, "", PermissionWrite, http.StatusForbidden},
+		{"stranger cannot see private", stranger, VisibilityPrivate, "", PermissionRead, http.StatusNotFound},
+		{"stranger reads public", stranger, VisibilityPublic, "", PermissionRead, http.StatusOK},
+		{"stranger cannot write public", stranger, VisibilityPublic, "", PermissionWrite, http.StatusForbidden},
+		{"anonymous reads public", 0, VisibilityPublic, "", PermissionRead, http.StatusOK},
+		{"unlisted with share link", stranger, VisibilityUnlisted, "link", PermissionRead, http.StatusOK},
+		{"unlisted anonymous with share link", 0, VisibilityUnlisted, "link", PermissionRead, http.StatusOK},
+		{"unlisted without share link", stranger, VisibilityUnlisted, "", PermissionRead, http.StatusNotFound},
+		{"unlisted share link is read only", stranger, VisibilityUnlisted, "link", PermissionWrite, http.StatusForbidden},
+	}
+	a := NewAuthorizer(db)
+	for _, tt := range tests {
+		request := func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/?share="+tt.share, nil)
+			if tt.account != 0 {
+				r = r.WithContext(context.WithValue(r.Context(), "claims", &Claims{UserID: tt.account}))
+			}
+			return r
+		}
+		t.Run("set/"+tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := a.RequireSet(w, request(), sets[tt.visibility], tt.required)
+			if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+				t.Errorf("RequireSet = %v with status %d, want status %d", ok, w.Code, tt.status)
+			}
+		})
+		t.Run("card/"+tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := a.RequireCard(w, request(), cards[tt.visibility], tt.required)
+			if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+				t.Errorf("RequireCard = %v with status %d, want status %d", ok, w.Code, tt.status)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	if a.RequireSet(w, httptest.NewRequest(http.MethodGet, "/", nil), -1, PermissionRead) || w.Code != http.StatusNotFound {
+		t.Errorf("missing set gave status %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	if a.RequireCard(w, httptest.NewRequest(http.MethodGet, "/", nil), -1, PermissionRead) || w.Code != http.StatusNotFound {
+		t.Errorf("missing card gave status %d, want 404", w.Code)
+	}
+}
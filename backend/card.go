@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -25,12 +29,20 @@ type CardUpdate struct {
 	Type  string  `json:"type"`
 }
 
+type CardCreate struct {
+	SetID *int   `json:"set_id"`
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
 type CardHandler struct {
-	db *pgxpool.Pool
+	db            *pgxpool.Pool
+	authorizer    *Authorizer
+	reviewHandler *ReviewHandler
 }
 
-func NewCardHandler(db *pgxpool.Pool) *CardHandler {
-	return &CardHandler{db: db}
+func NewCardHandler(db *pgxpool.Pool, authorizer *Authorizer, reviewHandler *ReviewHandler) *CardHandler {
+	return &CardHandler{db: db, authorizer: authorizer, reviewHandler: reviewHandler}
 }
 
 ////////////
@@ -42,7 +54,169 @@ var (
 )
 
 func (h *CardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// REVIEW AND HISTORY ROUTES
+	case CardReviewRE.MatchString(url), CardHistoryRE.MatchString(url):
+		h.reviewHandler.ServeHTTP(w, r)
+		return
+
+	// CREATE CARD ROUTE
+	case CardRE.MatchString(url) && r.Method == http.MethodPost:
+		var data CardCreate
+		defer r.Body.Close()
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error reading body for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(bytes, &data)
+		if err != nil {
+			log.Printf("error unmarshalling json for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error unmarshalling json", http.StatusBadRequest)
+			return
+		}
+		if data.SetID == nil {
+			writeJSONError(w, "missing set_id", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, *data.SetID, PermissionWrite) {
+			return
+		}
+		card, err := h.CreateCard(*data.SetID, data.Front, data.Back)
+		if err != nil {
+			log.Printf("error creating card for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error creating card", http.StatusInternalServerError)
+			return
+		}
+		responseBytes, err := json.Marshal(card)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(responseBytes)
+		return
+
+	// GET CARD ROUTE
+	case CardREWithID.MatchString(url) && r.Method == http.MethodGet:
+		cardID, ok := h.authorizeCard(w, r, PermissionRead)
+		if !ok {
+			return
+		}
+		card, err := h.GetCardByID(cardID)
+		if err != nil || card == nil {
+			log.Printf("error getting card for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting card", http.StatusInternalServerError)
+			return
+		}
+		responseBytes, err := json.Marshal(card)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseBytes)
+		return
+
+	// UPDATE CARD ROUTE
+	case CardREWithID.MatchString(url) && r.Method == http.MethodPatch:
+		cardID, ok := h.authorizeCard(w, r, PermissionWrite)
+		if !ok {
+			return
+		}
+		var update CardUpdate
+		defer r.Body.Close()
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error reading body for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(bytes, &update)
+		if err != nil {
+			log.Printf("error unmarshalling json for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error unmarshalling json", http.StatusBadRequest)
+			return
+		}
+		update.ID = &cardID
+		err = h.UpdateCard(update)
+		if err != nil {
+			log.Printf("error updating card for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error updating card", http.StatusInternalServerError)
+			return
+		}
+		card, err := h.GetCardByID(cardID)
+		if err != nil || card == nil {
+			log.Printf("error getting card for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting card", http.StatusInternalServerError)
+			return
+		}
+		responseBytes, err := json.Marshal(card)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseBytes)
+		return
 
+	// DELETE CARD ROUTE
+	case CardREWithID.MatchString(url) && r.Method == http.MethodDelete:
+		cardID, ok := h.authorizeCard(w, r, PermissionWrite)
+		if !ok {
+			return
+		}
+		err := h.DeleteCard(cardID)
+		if err != nil {
+			log.Printf("error deleting card for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error deleting card", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Writes an error response of the form {"error": message}
+func writeJSONError(w http.ResponseWriter, message string, status int) {
+	data, _ := json.Marshal(map[string]string{
+		"error": message,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Parses the card id from the URL and checks the caller's permission on
+// it. Writes an error response and returns false if the request should
+// not continue.
+func (h *CardHandler) authorizeCard(w http.ResponseWriter, r *http.Request, required Permission) (int, bool) {
+	groups := CardREWithID.FindStringSubmatch(r.URL.Path)
+	if len(groups) != 2 {
+		writeJSONError(w, "invalid URL", http.StatusBadRequest)
+		return -1, false
+	}
+	cardID, err := strconv.Atoi(groups[1])
+	if err != nil {
+		writeJSONError(w, "invalid ID", http.StatusBadRequest)
+		return -1, false
+	}
+	if !h.authorizer.RequireCard(w, r, cardID, required) {
+		return -1, false
+	}
+	return cardID, true
 }
 
 ////////////
@@ -70,6 +244,25 @@ func (h *CardHandler) CreateCard(set_id int, front string, back string) (*Card,
 //////////
 // READ
 
+func (h *CardHandler) GetCardByID(card_id int) (*Card, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT id, set_id, front, back, created
+		 FROM cards WHERE id=$1`, card_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	var c Card
+	err = rows.Scan(&c.ID, &c.SetID, &c.Front, &c.Back, &c.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func (h *CardHandler) GetCardsBySetID(set_id int) (*[]Card, error) {
 	rows, err := h.db.Query(context.Background(),
 		`SELECT id, set_id, front, back, created
@@ -94,10 +287,14 @@ func (h *CardHandler) GetCardsBySetID(set_id int) (*[]Card, error) {
 ////////////
 // UPDATE
 
+// Updates the front and/or back of a card. Nil fields are left unchanged.
 func (h *CardHandler) UpdateCard(u CardUpdate) error {
+	if u.ID == nil {
+		return fmt.Errorf("missing card id")
+	}
 	_, err := h.db.Exec(context.Background(),
-		`UPDATE cards SET front=$1, back=$2
-		 WHERE id=$3`, u.Front, u.Back, u.ID)
+		`UPDATE cards SET front=COALESCE($1, front), back=COALESCE($2, back)
+		 WHERE id=$3`, u.Front, u.Back, *u.ID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// A public set as listed in the explore feed
+type ExploreSet struct {
+	ID          int         `json:"id"`
+	AccountID   int         `json:"account_id"`
+	Username    string      `json:"username"`
+	Name        pgtype.Text `json:"name"`
+	Description pgtype.Text `json:"description"`
+	CardCount   int         `json:"card_count"`
+	Learners    int         `json:"learners"`
+	Created     time.Time   `json:"created"`
+}
+
+type ExplorePage struct {
+	Sets    []ExploreSet `json:"sets"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+	HasMore bool         `json:"has_more"`
+}
+
+type ExploreHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewExploreHandler(db *pgxpool.Pool) *ExploreHandler {
+	return &ExploreHandler{db: db}
+}
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Orderings of the explore feed
+const (
+	ExploreSortRecent  = "recent"
+	ExploreSortPopular = "popular"
+)
+
+////////////
+// ROUTES
+
+var (
+	ExploreRE = regexp.MustCompile(`^\/explore\/?$`)
+)
+
+func (h *ExploreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// EXPLORE ROUTE
+	case ExploreRE.MatchString(url) && r.Method == http.MethodGet:
+		page, perPage, err := getPagination(r)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sort := r.URL.Query().Get("sort")
+		if sort == "" {
+			sort = ExploreSortRecent
+		}
+		if sort != ExploreSortRecent && sort != ExploreSortPopular {
+			writeJSONError(w, "sort must be recent or popular", http.StatusBadRequest)
+			return
+		}
+		result, err := h.GetPublicSets(sort, page, perPage)
+		if err != nil {
+			log.Printf("error getting public sets for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting sets", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Reads the page (starting at 1) and per_page query parameters
+func getPagination(r *http.Request) (page int, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+	query := r.URL.Query()
+	if raw := query.Get("page"); raw != "" {
+		page, err = strconv.Atoi(raw)
+		if err != nil || page < 1 {
+			return -1, -1, fmt.Errorf("invalid page")
+		}
+	}
+	if raw := query.Get("per_page"); raw != "" {
+		perPage, err = strconv.Atoi(raw)
+		if err != nil || perPage < 1 {
+			return -1, -1, fmt.Errorf("invalid per_page")
+		}
+	}
+	return page, min(perPage, maxPerPage), nil
+}
+
+//////////
+// READ
+
+// Returns a page of public sets, newest first or by number of learners.
+// Popular sets are ranked by how many accounts studied them in the last
+// 30 days.
+func (h *ExploreHandler) GetPublicSets(sort string, page int, perPage int) (*ExplorePage, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT id, account_id, username, name, description, created, card_count, learners
+		 FROM (
+		   SELECT s.id, s.account_id, a.username, s.name, s.description, s.created,
+		          (SELECT COUNT(*) FROM cards c WHERE c.set_id = s.id) AS card_count,
+		          (SELECT COUNT(DISTINCT r.account_id)
+		           FROM reviews r JOIN cards c ON c.id = r.card_id
+		           WHERE c.set_id = s.id AND r.reviewed >= NOW() - INTERVAL '30 days') AS learners
+		   FROM sets s
+		   JOIN accounts a ON a.id = s.account_id
+		   WHERE s.visibility = 'public'
+		 ) p
+		 ORDER BY CASE WHEN $1::text = 'popular' THEN learners END DESC NULLS LAST,
+		          created DESC, id DESC
+		 LIMIT $2 OFFSET $3`, sort, perPage+1, (page-1)*perPage)
+	if err != nil {
+		return nil, fmt.Errorf("error querying public sets: %w", err)
+	}
+	defer rows.Close()
+	result := ExplorePage{
+		Sets:    []ExploreSet{},
+		Page:    page,
+		PerPage: perPage,
+	}
+	for rows.Next() {
+		var s ExploreSet
+		err := rows.Scan(&s.ID, &s.AccountID, &s.Username, &s.Name, &s.Description,
+			&s.Created, &s.CardCount, &s.Learners)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		result.Sets = append(result.Sets, s)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error querying public sets: %w", rows.Err())
+	}
+	// One extra row was requested to know whether there is another page
+	if len(result.Sets) > perPage {
+		result.Sets = result.Sets[:perPage]
+		result.HasMore = true
+	}
+	return &result, nil
+}
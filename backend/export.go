@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+///////////
+// TYPES
+
+// Version of the JSON export format. Bump it whenever SetExport changes in
+// a way older imports cannot read, and keep accepting older versions in
+// parseJSONImport.
+const SetExportVersion = 1
+
+// JSON representation of a set used for backups and for moving sets
+// between accounts. It can be imported back with format=json.
+type SetExport struct {
+	Version     int          `json:"version"`
+	Name        *string      `json:"name"`
+	Description *string      `json:"description"`
+	Algorithm   string       `json:"algorithm,omitempty"`
+	Cards       []ExportCard `json:"cards"`
+}
+
+type ExportCard struct {
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
+// Content types and file extensions of the export formats
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":  {"text/csv; charset=utf-8", "csv"},
+	"tsv":  {"text/tab-separated-values; charset=utf-8", "tsv"},
+	"json": {"application/json", "json"},
+	"md":   {"text/markdown; charset=utf-8", "md"},
+	"apkg": {"application/zip", "apkg"},
+}
+
+////////////
+// ROUTES
+
+var (
+	SetExportRE = regexp.MustCompile(`^\/sets\/(\d+)\/export\/?$`)
+)
+
+// Handles GET /sets/{id}/export. Cards are written to the response as they
+// are read from the database, so large sets are never held in memory.
+func (h *SetHandler) serveExport(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	groups := SetExportRE.FindStringSubmatch(r.URL.Path)
+	if len(groups) != 2 {
+		writeJSONError(w, "invalid URL", http.StatusBadRequest)
+		return
+	}
+	set_id, err := strconv.Atoi(groups[1])
+	if err != nil {
+		writeJSONError(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	f, ok := exportFormats[format]
+	if !ok {
+		writeJSONError(w, "format must be csv, tsv, json, md or apkg", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizer.RequireSet(w, r, set_id, PermissionRead) {
+		return
+	}
+	set, err := h.GetSetByID(set_id)
+	if err != nil || set == nil {
+		log.Printf("error getting set for export for %s: %v\n", clientIP, err)
+		writeJSONError(w, "error getting set", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="set-%d.%s"`, set_id, f.extension))
+	if format == "apkg" {
+		// Scheduling is exported for the caller, if logged in
+		accountID := -1
+		if claims := claimsFromRequest(r); claims != nil {
+			accountID = claims.UserID
+		}
+		err = h.ankiHandler.ExportPackage(w, set, accountID)
+	} else {
+		err = h.ExportSet(w, set, format)
+	}
+	if err != nil {
+		// Headers are already sent, so the client sees a truncated file
+		log.Printf("error exporting set %d for %s: %v\n", set_id, clientIP, err)
+	}
+}
+
+/////////////
+// HELPERS
+
+// Escapes text for a cell of a Markdown table
+func escapeMarkdownCell(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "|", `\|`)
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
+
+//////////
+// READ
+
+// Writes a set and its cards in the given format
+func (h *SetHandler) ExportSet(w http.ResponseWriter, set *Set, format string) error {
+	out := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	first := true
+
+	switch format {
+	case "csv", "tsv":
+		csvWriter = csv.NewWriter(out)
+		if format == "tsv" {
+			csvWriter.Comma = '\t'
+		}
+	case "json":
+		export := SetExport{Version: SetExportVersion, Algorithm: set.Algorithm}
+		if set.Name.Valid {
+			export.Name = &set.Name.String
+		}
+		if set.Description.Valid {
+			export.Description = &set.Description.String
+		}
+		header, err := json.Marshal(export)
+		if err != nil {
+			return fmt.Errorf("error marshalling json: %w", err)
+		}
+		// Open the cards array so each card can be appended as it is read
+		header = []byte(strings.TrimSuffix(string(header), `null}`))
+		out.Write(header)
+		out.WriteString("[")
+	case "md":
+		name := "Untitled set"
+		if set.Name.Valid && set.Name.String != "" {
+			name = set.Name.String
+		}
+		fmt.Fprintf(out, "# %s\n\n", strings.ReplaceAll(name, "\n", " "))
+		if set.Description.Valid && set.Description.String != "" {
+			fmt.Fprintf(out, "%s\n\n", set.Description.String)
+		}
+		out.WriteString("| Term | Definition |\n| --- | --- |\n")
+	}
+
+	rows, err := h.db.Query(context.Background(),
+		`SELECT front, back FROM cards WHERE set_id=$1 ORDER BY id ASC`, set.ID)
+	if err != nil {
+		return fmt.Errorf("error querying cards: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c ExportCard
+		err := rows.Scan(&c.Front, &c.Back)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		switch format {
+		case "csv", "tsv":
+			err = csvWriter.Write([]string{c.Front, c.Back})
+		case "json":
+			if !first {
+				out.WriteString(",")
+			}
+			var data []byte
+			data, err = json.Marshal(c)
+			out.Write(data)
+		case "md":
+			_, err = fmt.Fprintf(out, "| %s | %s |\n", escapeMarkdownCell(c.Front), escapeMarkdownCell(c.Back))
+		}
+		if err != nil {
+			return fmt.Errorf("error writing card: %w", err)
+		}
+		first = false
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("error querying cards: %w", rows.Err())
+	}
+
+	switch format {
+	case "csv", "tsv":
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %w", err)
+		}
+	case "json":
+		out.WriteString("]}\n")
+	}
+	return out.Flush()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Default FSRS-4.5 model weights
+var DefaultFSRSWeights = [17]float64{
+	0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+}
+
+const (
+	fsrsDecay       = -0.5
+	fsrsFactor      = 19.0 / 81.0
+	fsrsMaxInterval = 36500
+)
+
+// FSRS ratings
+const (
+	fsrsAgain = 1
+	fsrsHard  = 2
+	fsrsGood  = 3
+	fsrsEasy  = 4
+)
+
+// Free Spaced Repetition Scheduler (FSRS-4.5). Cards are described by
+// their stability (days until recall probability falls to 90%) and
+// difficulty (1-10); the next interval is chosen so that predicted recall
+// equals the requested retention.
+type FSRSScheduler struct {
+	w         [17]float64
+	retention float64
+}
+
+func NewFSRSScheduler(weights [17]float64, retention float64) FSRSScheduler {
+	return FSRSScheduler{w: weights, retention: retention}
+}
+
+func (FSRSScheduler) Name() string { return "fsrs" }
+
+// Maps a 0-5 grade onto the four FSRS ratings
+func fsrsRating(grade int) int {
+	switch {
+	case grade <= 2:
+		return fsrsAgain
+	case grade == 3:
+		return fsrsHard
+	case grade == 4:
+		return fsrsGood
+	default:
+		return fsrsEasy
+	}
+}
+
+func (s FSRSScheduler) Schedule(state CardState, grade int, now time.Time) CardState {
+	rating := fsrsRating(grade)
+	if state.State == CardStateNew || state.Stability <= 0 {
+		state.Stability = s.initStability(rating)
+		state.Difficulty = s.initDifficulty(rating)
+	} else {
+		elapsed := 0.0
+		if state.LastReviewed.Valid {
+			elapsed = math.Floor(now.Sub(state.LastReviewed.Time).Hours() / 24)
+		}
+		r := s.Retrievability(elapsed, state.Stability)
+		if rating == fsrsAgain {
+			state.Stability = s.forgetStability(state.Difficulty, state.Stability, r)
+		} else {
+			state.Stability = s.recallStability(state.Difficulty, state.Stability, r, rating)
+		}
+		state.Difficulty = s.nextDifficulty(state.Difficulty, rating)
+	}
+	passed := rating != fsrsAgain
+	if passed {
+		state.Repetitions++
+	} else {
+		state.Repetitions = 0
+	}
+	state.Interval = s.NextInterval(state.Stability)
+	state.Due = now.AddDate(0, 0, state.Interval)
+	return advanceState(state, passed, now)
+}
+
+// Probability of recalling a card with stability S after t days
+func (s FSRSScheduler) Retrievability(t float64, stability float64) float64 {
+	return math.Pow(1+fsrsFactor*t/stability, fsrsDecay)
+}
+
+// Number of days until recall probability drops to the requested retention
+func (s FSRSScheduler) NextInterval(stability float64) int {
+	interval := stability / fsrsFactor * (math.Pow(s.retention, 1/fsrsDecay) - 1)
+	return min(max(int(math.Round(interval)), 1), fsrsMaxInterval)
+}
+
+func (s FSRSScheduler) initStability(rating int) float64 {
+	return max(s.w[rating-1], 0.1)
+}
+
+func (s FSRSScheduler) initDifficulty(rating int) float64 {
+	return clampDifficulty(s.w[4] - float64(rating-3)*s.w[5])
+}
+
+func (s FSRSScheduler) nextDifficulty(d float64, rating int) float64 {
+	next := d - s.w[6]*float64(rating-3)
+	// Mean reversion towards the initial difficulty of a "good" answer
+	return clampDifficulty(s.w[7]*s.w[4] + (1-s.w[7])*next)
+}
+
+func (s FSRSScheduler) recallStability(d float64, stability float64, r float64, rating int) float64 {
+	hardPenalty, easyBonus := 1.0, 1.0
+	if rating == fsrsHard {
+		hardPenalty = s.w[15]
+	}
+	if rating == fsrsEasy {
+		easyBonus = s.w[16]
+	}
+	return stability * (1 + math.Exp(s.w[8])*
+		(11-d)*
+		math.Pow(stability, -s.w[9])*
+		(math.Exp((1-r)*s.w[10])-1)*
+		hardPenalty*
+		easyBonus)
+}
+
+func (s FSRSScheduler) forgetStability(d float64, stability float64, r float64) float64 {
+	return s.w[11] *
+		math.Pow(d, -s.w[12]) *
+		(math.Pow(stability+1, s.w[13]) - 1) *
+		math.Exp((1-r)*s.w[14])
+}
+
+func clampDifficulty(d float64) float64 {
+	return min(max(d, 1), 10)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+///////////
+// TYPES
+
+// Hashes passwords with the configured algorithm and verifies hashes of
+// every supported one. Hashes record their algorithm and parameters, so
+// hashes made with older settings keep working and can be upgraded when
+// their owner next logs in.
+type PasswordHasher struct {
+	// "argon2id" or "bcrypt"
+	Algorithm string
+	Argon2    Argon2Params
+	// Cost of new bcrypt hashes
+	BcryptCost int
+}
+
+type Argon2Params struct {
+	// Memory in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+// Returned for passwords that break the password policy
+type passwordPolicyError struct {
+	reason string
+}
+
+func (e *passwordPolicyError) Error() string {
+	return "password " + e.reason
+}
+
+// Parameters from RFC 9106's second recommended option
+var defaultArgon2Params = Argon2Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+const (
+	legacyBcryptCost      = 14
+	minPasswordLength     = 10
+	maxPasswordLength     = 256
+	maxBcryptPasswordSize = 72
+)
+
+// Used by HashPassword and VerifyPassword, replaced in main by
+// NewPasswordHasherFromEnv
+var passwordHasher = &PasswordHasher{
+	Algorithm:  "argon2id",
+	Argon2:     defaultArgon2Params,
+	BcryptCost: legacyBcryptCost,
+}
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+// Argon2 takes 64 MiB a hash with the default parameters, so only a few
+// hashes run at once and the rest wait their turn
+const maxConcurrentHashes = 4
+
+var hashSlots = make(chan struct{}, maxConcurrentHashes)
+
+// Creates the hasher configured by the environment:
+//
+//	PASSWORD_HASH    argon2id (default) or bcrypt
+//	ARGON2_MEMORY    memory in KiB, default 65536
+//	ARGON2_TIME      iterations, default 3
+//	ARGON2_THREADS   parallelism, default 4
+//	BCRYPT_COST      default 14
+func NewPasswordHasherFromEnv() (*PasswordHasher, error) {
+	h := &PasswordHasher{
+		Algorithm:  os.Getenv("PASSWORD_HASH"),
+		Argon2:     defaultArgon2Params,
+		BcryptCost: legacyBcryptCost,
+	}
+	if h.Algorithm == "" {
+		h.Algorithm = "argon2id"
+	}
+	if h.Algorithm != "argon2id" && h.Algorithm != "bcrypt" {
+		return nil, fmt.Errorf("unknown PASSWORD_HASH %q", h.Algorithm)
+	}
+	for _, param := range []struct {
+		env  string
+		set  func(uint64)
+		min  uint64
+		bits int
+	}{
+		{"ARGON2_MEMORY", func(v uint64) { h.Argon2.Memory = uint32(v) }, 8 * 1024, 32},
+		{"ARGON2_TIME", func(v uint64) { h.Argon2.Time = uint32(v) }, 1, 32},
+		{"ARGON2_THREADS", func(v uint64) { h.Argon2.Threads = uint8(v) }, 1, 8},
+		{"BCRYPT_COST", func(v uint64) { h.BcryptCost = int(v) }, 10, 8},
+	} {
+		value := os.Getenv(param.env)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 10, param.bits)
+		if err != nil || v < param.min {
+			return nil, fmt.Errorf("%s must be a number of at least %d", param.env, param.min)
+		}
+		param.set(v)
+	}
+	if h.BcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("BCRYPT_COST must be at most %d", bcrypt.MaxCost)
+	}
+	return h, nil
+}
+
+/////////////
+// HELPERS
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = func() map[string]bool {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsFile))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			passwords[line] = true
+		}
+	}
+	return passwords
+}()
+
+// Checks a new password against the password policy: at least 10
+// characters, not a common password even with digits or symbols added to
+// the end, and not made from the username or email.
+func ValidatePassword(password string, username string, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		return &passwordPolicyError{fmt.Sprintf("must be at least %d characters", minPasswordLength)}
+	}
+	if length > maxPasswordLength {
+		return &passwordPolicyError{fmt.Sprintf("must be at most %d characters", maxPasswordLength)}
+	}
+	if passwordHasher.Algorithm == "bcrypt" && len(password) > maxBcryptPasswordSize {
+		return &passwordPolicyError{fmt.Sprintf("must be at most %d bytes", maxBcryptPasswordSize)}
+	}
+	lower := strings.ToLower(password)
+	base := strings.TrimRightFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) })
+	if commonPasswords[lower] || commonPasswords[base] {
+		return &passwordPolicyError{"is too common"}
+	}
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, personal := range []string{strings.ToLower(username), strings.ToLower(email), localPart} {
+		if len(personal) >= 3 && strings.Contains(lower, personal) {
+			return &passwordPolicyError{"must not contain your username or email"}
+		}
+	}
+	return nil
+}
+
+func (h *PasswordHasher) hashArgon2(password string) (string, error) {
+	p := h.Argon2
+	salt := make([]byte, p.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Parses a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func parseArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("invalid argon2 key")
+	}
+	p.SaltLen = len(salt)
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// Hashes a password with the configured algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	if h.Algorithm == "bcrypt" {
+		bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(bytes), err
+	}
+	return h.hashArgon2(password)
+}
+
+// Reports whether a password matches a hash of any supported algorithm
+func (h *PasswordHasher) Verify(password string, hash string) bool {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		computed := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return subtle.ConstantTimeCompare(computed, key) == 1
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+// Reports whether a hash was made with another algorithm or other
+// parameters than the configured ones
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if h.Algorithm == "bcrypt" {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	}
+	p, _, _, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	return p.Memory != h.Argon2.Memory || p.Time != h.Argon2.Time ||
+		p.Threads != h.Argon2.Threads || p.KeyLen != h.Argon2.KeyLen || p.SaltLen != h.Argon2.SaltLen
+}
+
+// HashPassword hashes a password with the configured hasher.
+func HashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// VerifyPassword verifies if the given password matches the stored hash.
+func VerifyPassword(password, hash string) bool {
+	return passwordHasher.Verify(password, hash)
+}
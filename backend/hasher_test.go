@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Short entries without a letter at the end, or with capitals, could never
+// match
+func TestCommonPasswordsCanMatch(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Shorter entries only match with a suffix, which is cut off
+		// after the last letter
+		last, _ := utf8.DecodeLastRuneInString(line)
+		if utf8.RuneCountInString(line) < minPasswordLength && !unicode.IsLetter(last) {
+			t.Errorf("%q is shorter than %d characters and does not end in a letter", line, minPasswordLength)
+		}
+		if line != strings.ToLower(line) {
+			t.Errorf("%q is not lower case", line)
+		}
+	}
+	if len(commonPasswords) < 1000 {
+		t.Errorf("only %d common passwords", len(commonPasswords))
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"short", false},
+		{"Password123", false},
+		{"QWERTYUIOP", false},
+		{"sunshine2024", false},
+		{"monkey!!1234", false},
+		{"1234567890", false},
+		{"monkeybusiness", true},
+		{"alice-is-great", false},
+		{"correct horse battery", true},
+		{strings.Repeat("x", maxPasswordLength+1), false},
+	}
+	for _, tt := range tests {
+		err := ValidatePassword(tt.password, "alice", "alice@example.com")
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidatePassword(%q) = %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+}
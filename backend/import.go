@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+///////////
+// TYPES
+
+// How pasted or uploaded text is split into cards
+type ImportOptions struct {
+	// csv, tsv, json or text. Text splits rows and terms on plain
+	// delimiters, like Quizlet's import box; csv and tsv follow RFC 4180
+	// quoting; json reads the SetExport format.
+	Format        string
+	TermDelimiter string
+	RowDelimiter  string
+	// Skip the first row
+	Header bool
+}
+
+type ParsedCard struct {
+	Line  int    `json:"line"`
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	DryRun   bool          `json:"dry_run"`
+	Cards    []ParsedCard  `json:"cards"`
+	Errors   []ImportError `json:"errors"`
+	Imported int           `json:"imported"`
+}
+
+const (
+	maxImportBytes = 5 << 20
+	maxImportCards = 10000
+)
+
+// Names that can be used instead of literal delimiters in query parameters
+var delimiterNames = map[string]string{
+	"tab":       "\t",
+	"comma":     ",",
+	"semicolon": ";",
+	"newline":   "\n",
+}
+
+////////////
+// ROUTES
+
+var (
+	SetImportRE = regexp.MustCompile(`^\/sets\/(\d+)\/import\/?$`)
+)
+
+// Handles POST /sets/{id}/import. The text is sent either as the request
+// body or, for multipart requests, as a "file" upload or "text" field.
+func (h *SetHandler) serveImport(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	groups := SetImportRE.FindStringSubmatch(r.URL.Path)
+	if len(groups) != 2 {
+		writeJSONError(w, "invalid URL", http.StatusBadRequest)
+		return
+	}
+	set_id, err := strconv.Atoi(groups[1])
+	if err != nil {
+		writeJSONError(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizer.RequireSet(w, r, set_id, PermissionWrite) {
+		return
+	}
+	opts, err := getImportOptions(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	text, err := readImportText(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJSONError(w, "import is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("error reading import for %s: %v\n", clientIP, err)
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var details *SetExport
+	var cards []ParsedCard
+	var parseErrors []ImportError
+	if opts.Format == "json" {
+		details, cards, parseErrors = parseJSONImport(text)
+	} else {
+		cards, parseErrors = ParseImport(text, opts)
+	}
+	result := ImportResult{
+		DryRun: dryRun,
+		Cards:  cards,
+		Errors: parseErrors,
+	}
+	status := http.StatusOK
+	switch {
+	case dryRun:
+	case len(parseErrors) > 0:
+		// Nothing is imported until every line parses
+		status = http.StatusUnprocessableEntity
+	case len(cards) == 0:
+		writeJSONError(w, "no cards to import", http.StatusBadRequest)
+		return
+	default:
+		result.Imported, err = h.ImportCards(set_id, cards, details)
+		if err != nil {
+			log.Printf("error importing cards for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error importing cards", http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+/////////////
+// HELPERS
+
+// Reads the format, term_delimiter, row_delimiter and header query parameters
+func getImportOptions(r *http.Request) (ImportOptions, error) {
+	query := r.URL.Query()
+	opts := ImportOptions{
+		Format:        query.Get("format"),
+		TermDelimiter: query.Get("term_delimiter"),
+		RowDelimiter:  query.Get("row_delimiter"),
+		Header:        query.Get("header") == "true",
+	}
+	if d, ok := delimiterNames[opts.TermDelimiter]; ok {
+		opts.TermDelimiter = d
+	}
+	if d, ok := delimiterNames[opts.RowDelimiter]; ok {
+		opts.RowDelimiter = d
+	}
+	switch opts.Format {
+	case "", "text":
+		opts.Format = "text"
+		if opts.TermDelimiter == "" {
+			opts.TermDelimiter = "\t"
+		}
+		if opts.RowDelimiter == "" {
+			opts.RowDelimiter = "\n"
+		}
+		if opts.TermDelimiter == opts.RowDelimiter {
+			return opts, fmt.Errorf("term and row delimiters must differ")
+		}
+	case "csv", "tsv", "json":
+		if opts.TermDelimiter != "" || opts.RowDelimiter != "" {
+			return opts, fmt.Errorf("delimiters can only be set for the text format")
+		}
+	default:
+		return opts, fmt.Errorf("format must be csv, tsv, json or text")
+	}
+	return opts, nil
+}
+
+func readImportText(r *http.Request) (string, error) {
+	defer r.Body.Close()
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	}
+	err := r.ParseMultipartForm(maxImportBytes)
+	if err != nil {
+		return "", err
+	}
+	file, _, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return r.FormValue("text"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	bytes, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// Splits text into cards. Lines that cannot be turned into a card are
+// reported with their 1-based line (or row) number instead of stopping
+// the import.
+func ParseImport(text string, opts ImportOptions) ([]ParsedCard, []ImportError) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	var cards []ParsedCard
+	var errs []ImportError
+	add := func(line int, fields []string) {
+		cards, errs = addParsedCard(cards, errs, line, fields)
+	}
+
+	if opts.Format == "text" {
+		rows := strings.Split(text, opts.RowDelimiter)
+		for i, row := range rows {
+			row = strings.TrimSuffix(row, "\r")
+			if strings.TrimSpace(row) == "" || (opts.Header && i == 0) {
+				continue
+			}
+			// Only the first delimiter separates the term from the definition
+			add(i+1, strings.SplitN(row, opts.TermDelimiter, 2))
+		}
+		return cards, errs
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	if opts.Format == "tsv" {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				errs = append(errs, ImportError{parseErr.StartLine, parseErr.Err.Error()})
+				continue
+			}
+			errs = append(errs, ImportError{0, err.Error()})
+			break
+		}
+		if first && opts.Header {
+			first = false
+			continue
+		}
+		first = false
+		line, _ := reader.FieldPos(0)
+		add(line, record)
+	}
+	return cards, errs
+}
+
+// Validates the fields of one row and appends either a card or an error
+func addParsedCard(cards []ParsedCard, errs []ImportError, line int, fields []string) ([]ParsedCard, []ImportError) {
+	switch {
+	case len(cards) >= maxImportCards:
+		if len(cards) == maxImportCards {
+			errs = append(errs, ImportError{line, fmt.Sprintf("too many cards, the limit is %d", maxImportCards)})
+		}
+		return cards, errs
+	case len(fields) < 2:
+		errs = append(errs, ImportError{line, "missing definition"})
+	case len(fields) > 2:
+		errs = append(errs, ImportError{line, fmt.Sprintf("expected 2 columns, found %d", len(fields))})
+	case strings.TrimSpace(fields[0]) == "":
+		errs = append(errs, ImportError{line, "empty term"})
+	case strings.TrimSpace(fields[1]) == "":
+		errs = append(errs, ImportError{line, "empty definition"})
+	default:
+		cards = append(cards, ParsedCard{line, strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])})
+	}
+	return cards, errs
+}
+
+// Reads a SetExport document. Cards are numbered from 1 in place of lines.
+func parseJSONImport(text string) (*SetExport, []ParsedCard, []ImportError) {
+	var export SetExport
+	err := json.Unmarshal([]byte(strings.TrimPrefix(text, "\ufeff")), &export)
+	if err != nil {
+		return nil, nil, []ImportError{{0, "invalid json: " + err.Error()}}
+	}
+	if export.Version < 1 || export.Version > SetExportVersion {
+		return nil, nil, []ImportError{{0, fmt.Sprintf("unsupported export version %d", export.Version)}}
+	}
+	var cards []ParsedCard
+	var errs []ImportError
+	for i, c := range export.Cards {
+		cards, errs = addParsedCard(cards, errs, i+1, []string{c.Front, c.Back})
+	}
+	return &export, cards, errs
+}
+
+////////////
+// CREATE
+
+// Inserts cards into a set in a single transaction and returns how many
+// were added. When importing an export, its name and description fill in
+// those of the set if they are empty.
+func (h *SetHandler) ImportCards(set_id int, cards []ParsedCard, details *SetExport) (int, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	if details != nil {
+		_, err = tx.Exec(ctx,
+			`UPDATE sets
+			 SET name = COALESCE(NULLIF(name, ''), $2),
+			     description = COALESCE(NULLIF(description, ''), $3)
+			 WHERE id=$1`, set_id, details.Name, details.Description)
+		if err != nil {
+			return 0, fmt.Errorf("error updating set details: %w", err)
+		}
+	}
+	rows := make([][]any, len(cards))
+	for i, c := range cards {
+		rows[i] = []any{set_id, c.Front, c.Back}
+	}
+	n, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"cards"},
+		[]string{"set_id", "front", "back"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, fmt.Errorf("error copying cards: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+///////////
+// TYPES
+
+// Keys that sign and verify one kind of token. Tokens carry the ID of the
+// key that signed them in their kid header. New tokens are signed with the
+// current key; retired keys still verify tokens until every token they
+// signed has expired, so rotating a key does not log anyone out.
+type Keyring struct {
+	name    string
+	current *SigningKey
+	keys    map[string]*SigningKey
+	// Lifetime of the tokens the keyring signs, which is how long retired
+	// keys are kept
+	lifetime time.Duration
+}
+
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	signKey any
+	// []byte, ed25519.PublicKey or *rsa.PublicKey
+	verifyKey any
+	// Zero for the current key
+	Retired time.Time
+}
+
+// A key in the KEYRING_FILE, see LoadKeyringsFromEnv
+type keyConfig struct {
+	ID  string `json:"kid"`
+	Alg string `json:"alg"`
+	// PEM file with a PKCS #8 (or PKCS #1 for RSA) private key, or the raw
+	// secret for HS256
+	File string `json:"file"`
+	// Environment variable holding the secret, for HS256
+	SecretEnv string     `json:"secret_env"`
+	Retired   *time.Time `json:"retired"`
+}
+
+type keyringConfig struct {
+	Access  []keyConfig `json:"access"`
+	Refresh []keyConfig `json:"refresh"`
+}
+
+// A public key in JSON Web Key form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Kid of the keys built from ACCESS_SECRET and REFRESH_SECRET
+const legacyKeyID = "env"
+
+const minRSAKeyBits = 2048
+
+// Loads the access and refresh keyrings. KEYRING_FILE names a JSON file:
+//
+//	{
+//	    "access": [
+//	        {"kid": "2025-06", "alg": "EdDSA", "file": "/keys/access-2025-06.pem"},
+//	        {"kid": "2025-01", "alg": "RS256", "file": "/keys/access-2025-01.pem",
+//	         "retired": "2025-06-01T00:00:00Z"}
+//	    ],
+//	    "refresh": [
+//	        {"kid": "r1", "alg": "HS256", "secret_env": "REFRESH_SECRET"}
+//	    ]
+//	}
+//
+// Each keyring needs exactly one key without "retired", which signs new
+// tokens. Supported algorithms are HS256, RS256 and EdDSA (Ed25519).
+// Without KEYRING_FILE, the HS256 secrets ACCESS_SECRET and REFRESH_SECRET
+// are used.
+func LoadKeyringsFromEnv() (*Keyring, *Keyring, error) {
+	path := os.Getenv("KEYRING_FILE")
+	if path == "" {
+		access, err := newLegacyKeyring("access", os.Getenv("ACCESS_SECRET"), accessTokenExpiration)
+		if err != nil {
+			return nil, nil, err
+		}
+		refresh, err := newLegacyKeyring("refresh", os.Getenv("REFRESH_SECRET"), refreshTokenExpiration)
+		if err != nil {
+			return nil, nil, err
+		}
+		return access, refresh, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading keyring file: %w", err)
+	}
+	var config keyringConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing keyring file: %w", err)
+	}
+	access, err := newKeyring("access", config.Access, accessTokenExpiration)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := newKeyring("refresh", config.Refresh, refreshTokenExpiration)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+func newLegacyKeyring(name string, secret string, lifetime time.Duration) (*Keyring, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("%s_SECRET is required without KEYRING_FILE", name)
+	}
+	key := &SigningKey{
+		ID:        legacyKeyID,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+	return &Keyring{
+		name:     name,
+		current:  key,
+		keys:     map[string]*SigningKey{key.ID: key},
+		lifetime: lifetime,
+	}, nil
+}
+
+func newKeyring(name string, configs []keyConfig, lifetime time.Duration) (*Keyring, error) {
+	k := &Keyring{name: name, keys: map[string]*SigningKey{}, lifetime: lifetime}
+	for _, config := range configs {
+		if !keyIDRE.MatchString(config.ID) {
+			return nil, fmt.Errorf("%s key has invalid kid %q", name, config.ID)
+		}
+		if k.keys[config.ID] != nil {
+			return nil, fmt.Errorf("%s key %q is listed twice", name, config.ID)
+		}
+		key, err := loadSigningKey(config)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s key %q: %w", name, config.ID, err)
+		}
+		if key.Retired.IsZero() {
+			if k.current != nil {
+				return nil, fmt.Errorf("%s keys %q and %q are both current", name, k.current.ID, key.ID)
+			}
+			k.current = key
+		}
+		k.keys[key.ID] = key
+	}
+	if k.current == nil {
+		return nil, fmt.Errorf("no current %s key", name)
+	}
+	return k, nil
+}
+
+func loadSigningKey(config keyConfig) (*SigningKey, error) {
+	key := &SigningKey{ID: config.ID}
+	if config.Retired != nil {
+		key.Retired = *config.Retired
+	}
+	if config.Alg == "HS256" {
+		var secret []byte
+		switch {
+		case config.SecretEnv != "":
+			secret = []byte(os.Getenv(config.SecretEnv))
+		case config.File != "":
+			data, err := os.ReadFile(config.File)
+			if err != nil {
+				return nil, err
+			}
+			secret = data
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HS256 secret must be at least 32 bytes")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+		return key, nil
+	}
+	data, err := os.ReadFile(config.File)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", config.File)
+	}
+	var private any
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %w", err)
+	}
+	switch config.Alg {
+	case "EdDSA":
+		edKey, ok := private.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("EdDSA needs an Ed25519 key")
+		}
+		key.Method = jwt.SigningMethodEdDSA
+		key.signKey = edKey
+		key.verifyKey = edKey.Public()
+	case "RS256":
+		rsaKey, ok := private.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("RS256 needs an RSA key")
+		}
+		if rsaKey.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key must be at least %d bits", minRSAKeyBits)
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.signKey = rsaKey
+		key.verifyKey = &rsaKey.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", config.Alg)
+	}
+	return key, nil
+}
+
+////////////
+// ROUTES
+
+var (
+	JWKSRE  = regexp.MustCompile(`^\/\.well-known\/jwks\.json$`)
+	keyIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// Handles GET /.well-known/jwks.json, publishing the public access token
+// keys so that other services can verify access tokens. Secret HS256 keys
+// are never published.
+func (k *Keyring) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(k.JWKS())
+	if err != nil {
+		writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(data)
+}
+
+/////////////
+// HELPERS
+
+// Reports whether a key may still verify tokens
+func (k *Keyring) usable(key *SigningKey, now time.Time) bool {
+	return key.Retired.IsZero() || now.Before(key.Retired.Add(k.lifetime))
+}
+
+// Signs claims with the current key
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	return token.SignedString(k.current.signKey)
+}
+
+// Returns the key that verifies a token, for jwt.Parse. Tokens signed
+// before keys had IDs verify with the legacy key.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = legacyKeyID
+	}
+	key := k.keys[kid]
+	if key == nil || !k.usable(key, time.Now()) {
+		return nil, fmt.Errorf("unknown %s key %q", k.name, kid)
+	}
+	// The algorithm must be the key's, so that a public key can never be
+	// used as an HMAC secret
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("%s key %q does not use %s", k.name, kid, token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// Parses and verifies a token signed by the keyring
+func (k *Keyring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, k.Keyfunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
+}
+
+// Returns the public keys that may verify tokens
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range k.keys {
+		if !k.usable(key, now) {
+			continue
+		}
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+	return set
+}
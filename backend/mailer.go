@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+///////////
+// TYPES
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends email. Which implementation is used is chosen by the MAILER
+// environment variable, see NewMailerFromEnv.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Sends mail through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// Header form, e.g. "disco <no-reply@example.com>"
+	From string
+	// Envelope sender, the bare address of From
+	Sender string
+}
+
+// Writes mail to the server log, for development
+type LogMailer struct{}
+
+// Writes each message to a .eml file in Dir, for development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Creates the mailer configured by the environment:
+//
+//	MAILER=smtp  SMTP_HOST, SMTP_PORT (default 587), SMTP_USERNAME, SMTP_PASSWORD, MAIL_FROM
+//	MAILER=file  MAIL_DIR (default ./mail), MAIL_FROM
+//	MAILER=log   (default)
+func NewMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "disco <no-reply@localhost>"
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+	}
+	from = sender.String()
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+			Sender:   sender.Address,
+		}
+		if m.Host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mailer")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		return m, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &FileMailer{Dir: dir, From: from}, nil
+	case "", "log":
+		return &LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+/////////////
+// HELPERS
+
+// Formats a plain text message with the headers mail servers expect
+func formatMessage(from string, msg Message, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Rejects header values that could inject extra headers
+func validateMessage(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid message header")
+	}
+	return nil
+}
+
+//////////
+// SEND
+
+func (m *SMTPMailer) Send(msg Message) error {
+	err := validateMessage(msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	err = smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.Sender,
+		[]string{msg.To}, formatMessage(m.From, msg, time.Now()))
+	if err != nil {
+		return fmt.Errorf("error sending mail: %w", err)
+	}
+	return nil
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	log.Printf("mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	err := validateMessage(msg)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.Dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating mail dir: %w", err)
+	}
+	now := time.Now()
+	name := filepath.Join(m.Dir, fmt.Sprintf("%d.eml", now.UnixNano()))
+	err = os.WriteFile(name, formatMessage(m.From, msg, now), 0o600)
+	if err != nil {
+		return fmt.Errorf("error writing mail: %w", err)
+	}
+	return nil
+}
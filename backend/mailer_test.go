@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Accepts a single message and returns the commands and data it was sent with
+func fakeSMTPServer(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	lines := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var got []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			got = append(got, line)
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 OK")
+			case data:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case line == "DATA":
+				data = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				lines <- got
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+		lines <- got
+	}()
+	return ln.Addr().String(), lines
+}
+
+func TestSMTPMailerEnvelopeSender(t *testing.T) {
+	addr, lines := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	t.Setenv("MAILER", "smtp")
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("MAIL_FROM", "disco <no-reply@example.com>")
+	mailer, err := NewMailerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mailer.Send(Message{To: "alice@example.com", Subject: "Hi", Body: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := <-lines
+	var mailFrom, header bool
+	for _, line := range got {
+		switch line {
+		case "MAIL FROM:<no-reply@example.com>", "MAIL FROM:<no-reply@example.com> BODY=8BITMIME":
+			mailFrom = true
+		case `From: "disco" <no-reply@example.com>`:
+			header = true
+		}
+	}
+	if !mailFrom || !header {
+		t.Errorf("envelope sender or From header missing from session:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestNewMailerFromEnvRejectsBadSender(t *testing.T) {
+	t.Setenv("MAILER", "log")
+	t.Setenv("MAIL_FROM", "disco no-reply")
+	if _, err := NewMailerFromEnv(); err == nil {
+		t.Error("NewMailerFromEnv accepted an invalid MAIL_FROM")
+	}
+}
@@ -6,11 +6,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 func main() {
-	ACCESS_SECRET := os.Getenv("ACCESS_SECRET")
-	REFRESH_SECRET := os.Getenv("REFRESH_SECRET")
+	accessKeys, refreshKeys, err := LoadKeyringsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordHasher, err = NewPasswordHasherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Init db connection
 	db, err := InitDBPool(context.Background())
@@ -18,18 +25,77 @@ func main() {
 		log.Fatal("Error initializing DB connection: %w", err)
 	}
 
+	mailer, err := NewMailerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	verifier, err := NewEmailVerifier(db, mailer, os.Getenv("UNVERIFIED_POLICY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Init handlers
-	accountHandler := NewAccountHandler(db)
-	cardHandler := NewCardHandler(db)
-	setHandler := NewSetHandler(db, accountHandler, cardHandler)
+	authorizer := NewAuthorizer(db)
+	statsHandler := NewStatsHandler(db, authorizer)
+	takeoutDir := os.Getenv("TAKEOUT_DIR")
+	if takeoutDir == "" {
+		takeoutDir = filepath.Join(os.TempDir(), "disco-takeout")
+	}
+	blobStore, err := NewBlobStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	takeoutHandler := NewTakeoutHandler(db, takeoutDir, blobStore)
+	takeoutHandler.StartTakeoutPurge(context.Background(), takeoutPurgeInterval)
+	pictureHandler := NewPictureHandler(db, blobStore)
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "disco"
+	}
+	twoFactorHandler := NewTwoFactorHandler(db, issuer)
+	oidcHandler, err := NewOIDCHandlerFromEnv(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	accountHandler := NewAccountHandler(db, statsHandler, takeoutHandler, verifier, twoFactorHandler,
+		pictureHandler)
+	reviewHandler := NewReviewHandler(db, authorizer)
+	cardHandler := NewCardHandler(db, authorizer, reviewHandler)
+	studyHandler := NewStudyHandler(db, authorizer)
+	exploreHandler := NewExploreHandler(db)
+	searchHandler := NewSearchHandler(db)
+	ankiHandler := NewAnkiHandler(db)
+	sessionHandler := NewSessionHandler(db)
+	tokenHandler := NewTokenHandler(db)
+	setHandler := NewSetHandler(db, authorizer, accountHandler, cardHandler, studyHandler, statsHandler, ankiHandler)
 
 	mux := http.NewServeMux()
 
 	mux.Handle("/accounts/", accountHandler)
 	mux.Handle("/sets/", setHandler)
 	mux.Handle("/cards/", cardHandler)
+	mux.Handle("/study/", studyHandler)
+	mux.Handle("/explore", exploreHandler)
+	mux.Handle("/explore/", exploreHandler)
+	mux.Handle("/search", searchHandler)
+	mux.Handle("/search/", searchHandler)
+	mux.Handle("/import/", ankiHandler)
+	mux.Handle("/2fa/", twoFactorHandler)
+	mux.Handle("/sessions", sessionHandler)
+	mux.Handle("/sessions/", sessionHandler)
+	mux.Handle("/tokens", tokenHandler)
+	mux.Handle("/tokens/", tokenHandler)
+	mux.Handle("/oidc/", oidcHandler)
+	mux.Handle("/pictures/", pictureHandler)
+
+	limiter, err := NewLoginLimiterFromEnv(db, mailer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter.StartPurge(context.Background(), loginLimitPurge)
 
-	authMux := NewAuthMiddleware(mux, db, accountHandler, ACCESS_SECRET, REFRESH_SECRET)
+	authMux := NewAuthMiddleware(mux, db, accountHandler, mailer, verifier, twoFactorHandler, oidcHandler, limiter, accessKeys, refreshKeys)
+	authMux.StartRefreshTokenPurge(context.Background(), refreshPurgeInterval)
 
 	fmt.Println("Starting server on port 8080")
 	err = http.ListenAndServe(":8080", authMux)
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"math/rand/v2"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Logs in through external OpenID Connect providers using the
+// authorization code flow with PKCE. Provider identities are linked to
+// accounts in the identities table; logging in with an identity that is
+// not linked yet creates a new account.
+type OIDCHandler struct {
+	db        *pgxpool.Pool
+	providers map[string]*OIDCProvider
+	// Public URL of this server, which callbacks are sent to
+	publicURL string
+	client    *http.Client
+}
+
+// A provider configured by the environment, see NewOIDCHandlerFromEnv
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Fetched from the issuer when first needed
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// The parts of the issuer's /.well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Claims read from ID tokens
+type oidcClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// A provider identity linked to an account
+type Identity struct {
+	ID       int       `json:"id"`
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email"`
+	Created  time.Time `json:"created"`
+}
+
+// Outcome of a completed authorization
+type OIDCResult struct {
+	AccountID int
+	// The identity was linked to an account that was already logged in
+	Linked bool
+	// A logged in account signed in again with one of its identities
+	Reauthenticated bool
+}
+
+// Creates the handler for the providers named in OIDC_PROVIDERS, a comma
+// separated list. For a provider named google:
+//
+//	OIDC_GOOGLE_ISSUER         issuer URL, e.g. https://accounts.google.com
+//	OIDC_GOOGLE_CLIENT_ID
+//	OIDC_GOOGLE_CLIENT_SECRET
+//	OIDC_GOOGLE_SCOPES         space separated, default "openid email profile"
+//
+// PUBLIC_URL is the URL this server is reached at. Callbacks go to
+// {PUBLIC_URL}/oidc/{provider}/callback.
+func NewOIDCHandlerFromEnv(db *pgxpool.Pool) (*OIDCHandler, error) {
+	h := &OIDCHandler{
+		db:        db,
+		providers: map[string]*OIDCProvider{},
+		publicURL: strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !oidcProviderNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid OIDC provider name %q", name)
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+		if !slices.Contains(p.Scopes, "openid") {
+			p.Scopes = append([]string{"openid"}, p.Scopes...)
+		}
+		h.providers[name] = p
+	}
+	if len(h.providers) > 0 && h.publicURL == "" {
+		return nil, fmt.Errorf("PUBLIC_URL is required for OIDC login")
+	}
+	return h, nil
+}
+
+const (
+	oidcLoginExpiration = 10 * time.Minute
+	// Minimum time between fetches of a provider's keys when a token is
+	// signed with an unknown key
+	oidcKeysRefetchInterval = time.Minute
+	oidcStateCookie         = "oidc_state"
+	maxUsernameLength       = 20
+	// How long signing in again with a provider stands in for the password
+	// of an account that has none
+	oidcReauthExpiration = 5 * time.Minute
+)
+
+// Stored in place of a password hash for accounts without a password. It
+// is not a valid hash, so no password matches it.
+const noPassword = "!"
+
+var (
+	errUnknownProvider    = errors.New("unknown provider")
+	errInvalidOIDCState   = errors.New("invalid or expired login state")
+	errOIDCNoEmail        = errors.New("provider did not share an email address")
+	errOIDCEmailTaken     = errors.New("account with email already exists")
+	errIdentityLinked     = errors.New("identity is linked to another account")
+	errIdentityNotLinked  = errors.New("identity is not linked to this account")
+	errLastLoginMethod    = errors.New("verify your email before unlinking your last provider")
+	errOIDCProviderFailed = errors.New("provider error")
+)
+
+////////////
+// ROUTES
+
+var (
+	oidcProviderNameRE   = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	OIDCProvidersRE      = regexp.MustCompile(`^\/oidc\/providers\/?$`)
+	OIDCLoginRE          = regexp.MustCompile(`^\/oidc\/([a-z0-9_-]+)\/login\/?$`)
+	OIDCCallbackRE       = regexp.MustCompile(`^\/oidc\/([a-z0-9_-]+)\/callback\/?$`)
+	OIDCLinkRE           = regexp.MustCompile(`^\/oidc\/([a-z0-9_-]+)\/link\/?$`)
+	OIDCReauthRE         = regexp.MustCompile(`^\/oidc\/([a-z0-9_-]+)\/reauth\/?$`)
+	OIDCIdentitiesRE     = regexp.MustCompile(`^\/oidc\/identities\/?$`)
+	OIDCIdentityREWithID = regexp.MustCompile(`^\/oidc\/identities\/(\d+)\/?$`)
+)
+
+// Routes for logged in accounts. Logging in goes through AuthMiddleware.
+func (h *OIDCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// LINK PROVIDER ROUTE
+	case OIDCLinkRE.MatchString(url) && r.Method == http.MethodGet:
+		provider := OIDCLinkRE.FindStringSubmatch(url)[1]
+		h.serveStart(w, r, provider, claims.UserID, false)
+		return
+
+	// REAUTHENTICATE ROUTE
+	case OIDCReauthRE.MatchString(url) && r.Method == http.MethodGet:
+		provider := OIDCReauthRE.FindStringSubmatch(url)[1]
+		h.serveStart(w, r, provider, claims.UserID, true)
+		return
+
+	// LIST IDENTITIES ROUTE
+	case OIDCIdentitiesRE.MatchString(url) && r.Method == http.MethodGet:
+		identities, err := h.GetIdentities(claims.UserID)
+		if err != nil {
+			log.Printf("error getting identities for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting identities", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(identities)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	// UNLINK IDENTITY ROUTE
+	case OIDCIdentityREWithID.MatchString(url) && r.Method == http.MethodDelete:
+		id, err := strconv.Atoi(OIDCIdentityREWithID.FindStringSubmatch(url)[1])
+		if err != nil {
+			writeJSONError(w, "invalid identity id", http.StatusBadRequest)
+			return
+		}
+		found, err := h.UnlinkIdentity(claims.UserID, id)
+		if errors.Is(err, errLastLoginMethod) {
+			writeJSONError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("error unlinking identity for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error unlinking identity", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			writeJSONError(w, "identity not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+// Handles GET /oidc/providers
+func (h *OIDCHandler) serveProviders(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range h.providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	data, err := json.Marshal(names)
+	if err != nil {
+		writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Redirects to the provider to log in, or to link the provider to
+// accountID if it is not -1, or to reauthenticate accountID if reauth is
+// set. The state is also kept in a cookie so that the callback only
+// completes in the browser that started it.
+func (h *OIDCHandler) serveStart(w http.ResponseWriter, r *http.Request, provider string, accountID int, reauth bool) {
+	clientIP := r.Context().Value("clientip").(string)
+	authURL, state, err := h.StartAuth(provider, accountID, reauth)
+	if errors.Is(err, errUnknownProvider) {
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error starting oidc login for %s: %v\n", clientIP, err)
+		writeJSONError(w, "error starting login", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/",
+		MaxAge:   int(oidcLoginExpiration.Seconds()),
+		HttpOnly: true,
+		// Lax, since the callback is a top level navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Handles GET /oidc/{provider}/callback. Sets the auth cookies and
+// redirects to the frontend, or to its 2FA page for accounts with 2FA.
+func (h *AuthMiddleware) serveOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	origin := os.Getenv("ORIGIN")
+	provider := OIDCCallbackRE.FindStringSubmatch(r.URL.Path)[1]
+	fail := func(code string) {
+		http.Redirect(w, r, origin+"/login?oidc_error="+code, http.StatusFound)
+	}
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, _ := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie, Path: "/oidc/", MaxAge: -1,
+		HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: true,
+	})
+	if state == "" || cookie == nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		fail("invalid_state")
+		return
+	}
+	if query.Get("error") != "" {
+		// The user declined or the provider refused
+		log.Printf("oidc provider %s returned %q for %s\n", provider, query.Get("error"), clientIP)
+		fail("provider_error")
+		return
+	}
+	result, err := h.oidc.FinishAuth(provider, state, query.Get("code"))
+	switch {
+	case errors.Is(err, errInvalidOIDCState), errors.Is(err, errUnknownProvider):
+		fail("invalid_state")
+		return
+	case errors.Is(err, errOIDCNoEmail):
+		fail("no_email")
+		return
+	case errors.Is(err, errOIDCEmailTaken):
+		fail("email_taken")
+		return
+	case errors.Is(err, errIdentityLinked):
+		fail("already_linked")
+		return
+	case errors.Is(err, errIdentityNotLinked):
+		fail("not_linked")
+		return
+	case errors.Is(err, errOIDCProviderFailed):
+		log.Printf("error finishing oidc login for %s: %v\n", clientIP, err)
+		fail("provider_error")
+		return
+	case err != nil:
+		log.Printf("error finishing oidc login for %s: %v\n", clientIP, err)
+		fail("server_error")
+		return
+	}
+	if result.Linked {
+		http.Redirect(w, r, origin+"/settings?linked="+url.QueryEscape(provider), http.StatusFound)
+		return
+	}
+	if result.Reauthenticated {
+		http.Redirect(w, r, origin+"/settings?reauthenticated="+url.QueryEscape(provider), http.StatusFound)
+		return
+	}
+	challenge, err := h.twoFactor.StartLogin(result.AccountID)
+	if err != nil {
+		log.Printf("error starting 2fa login for %s: %v\n", clientIP, err)
+		fail("server_error")
+		return
+	}
+	if challenge != "" {
+		http.Redirect(w, r, origin+"/login/2fa?challenge="+url.QueryEscape(challenge), http.StatusFound)
+		return
+	}
+	account, err := h.accountHandler.GetAccountByID(result.AccountID)
+	if err != nil || account == nil {
+		log.Printf("error getting account for %s: %v\n", clientIP, err)
+		fail("server_error")
+		return
+	}
+	h.SetAuthCookies(w, r, account.ID, account.Username)
+	http.Redirect(w, r, origin+"/", http.StatusFound)
+}
+
+/////////////
+// HELPERS
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (h *OIDCHandler) redirectURI(p *OIDCProvider) string {
+	return h.publicURL + "/oidc/" + p.Name + "/callback"
+}
+
+func (h *OIDCHandler) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// Returns the provider's discovery document, fetching it the first time
+func (h *OIDCHandler) discover(ctx context.Context, p *OIDCProvider) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	err := h.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error fetching discovery document: %v", errOIDCProviderFailed, err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", errOIDCProviderFailed, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", errOIDCProviderFailed)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// Returns the provider's signing key with the given id. Keys are fetched
+// again when an unknown one is asked for, since providers rotate them.
+func (h *OIDCHandler) signingKey(ctx context.Context, p *OIDCProvider, d *oidcDiscovery, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	find := func() any {
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key
+			}
+		}
+		return p.keys[kid]
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	err := h.getJSON(ctx, d.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching signing keys: %w", err)
+	}
+	p.keys = map[string]any{}
+	p.keysFetched = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			log.Printf("skipping key %q of oidc provider %s: %v\n", jwk.Kid, p.Name, err)
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Parses an RSA or EC public key in JWK form
+func parseJWK(jwk oidcJWK) (any, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// Exchanges an authorization code for the provider's ID token
+func (h *OIDCHandler) exchangeCode(ctx context.Context, p *OIDCProvider, d *oidcDiscovery, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", h.redirectURI(p))
+	form.Set("code_verifier", verifier)
+	// client_secret_basic is the default when the provider lists no methods
+	basic := len(d.TokenAuthMethods) == 0 || slices.Contains(d.TokenAuthMethods, "client_secret_basic")
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: error requesting token: %v", errOIDCProviderFailed, err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("%w: error decoding token response: %v", errOIDCProviderFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("%w: token endpoint returned %s %q", errOIDCProviderFailed, resp.Status, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+// Verifies an ID token's signature, issuer, audience, expiry and nonce
+func (h *OIDCHandler) verifyIDToken(ctx context.Context, p *OIDCProvider, d *oidcDiscovery, idToken string, nonce string) (*oidcClaims, error) {
+	var claims oidcClaims
+	_, err := jwt.ParseWithClaims(idToken, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return h.signingKey(ctx, p, d, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid id token: %v", errOIDCProviderFailed, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: id token nonce does not match", errOIDCProviderFailed)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: id token has no subject", errOIDCProviderFailed)
+	}
+	return &claims, nil
+}
+
+// Turns a provider username or email into a username, which may be taken
+func baseUsername(claims *oidcClaims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if candidate == "" {
+		candidate = claims.Name
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(candidate) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '.' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	username := b.String()
+	// Leave room for a suffix
+	if len(username) > maxUsernameLength-5 {
+		username = username[:maxUsernameLength-5]
+	}
+	if len(username) < 3 {
+		username = "user"
+	}
+	return username
+}
+
+// Returns a username not used by any account, based on the provider's
+func (h *OIDCHandler) uniqueUsername(ctx context.Context, tx pgx.Tx, claims *oidcClaims) (string, error) {
+	base := baseUsername(claims)
+	username := base
+	for range 10 {
+		var taken bool
+		err := tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM accounts WHERE username=$1)`, username).Scan(&taken)
+		if err != nil {
+			return "", fmt.Errorf("error checking username: %w", err)
+		}
+		if !taken {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%04d", base, rand.IntN(10000))
+	}
+	return "", fmt.Errorf("could not find a free username for %q", base)
+}
+
+////////////
+// CREATE
+
+// Starts an authorization with the provider. accountID is -1 to log in,
+// or the logged in account to link the provider to or, with reauth, to
+// reauthenticate. Returns the URL to send the browser to and the state
+// that has to come back with the callback.
+func (h *OIDCHandler) StartAuth(provider string, accountID int, reauth bool) (string, string, error) {
+	p, ok := h.providers[provider]
+	if !ok {
+		return "", "", errUnknownProvider
+	}
+	ctx := context.Background()
+	d, err := h.discover(ctx, p)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := GenerateToken(32)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating state: %w", err)
+	}
+	nonce, err := GenerateToken(32)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	verifier, err := GenerateToken(32)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating verifier: %w", err)
+	}
+	_, err = h.db.Exec(ctx, `DELETE FROM oidc_logins WHERE expires < NOW()`)
+	if err != nil {
+		return "", "", fmt.Errorf("error deleting expired logins: %w", err)
+	}
+	var linkTo *int
+	if accountID >= 0 {
+		linkTo = &accountID
+	}
+	_, err = h.db.Exec(ctx,
+		`INSERT INTO oidc_logins (provider, state_hash, nonce, verifier, account_id, reauth, expires)
+		 VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		p.Name, hashToken(state), nonce, verifier, linkTo, reauth && linkTo != nil, time.Now().Add(oidcLoginExpiration))
+	if err != nil {
+		return "", "", fmt.Errorf("error inserting login: %w", err)
+	}
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", h.redirectURI(p))
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL := d.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+	return authURL, state, nil
+}
+
+// Completes an authorization started by StartAuth. Links the identity when
+// the authorization was started by a logged in account, or records that
+// the account signed in again if it was a reauthentication. Otherwise
+// returns the account the identity is linked to, creating one if there is
+// none.
+func (h *OIDCHandler) FinishAuth(provider string, state string, code string) (*OIDCResult, error) {
+	p, ok := h.providers[provider]
+	if !ok {
+		return nil, errUnknownProvider
+	}
+	ctx := context.Background()
+	var nonce, verifier string
+	var linkTo *int
+	var reauth bool
+	err := h.db.QueryRow(ctx,
+		`DELETE FROM oidc_logins
+		 WHERE state_hash=$1 AND provider=$2 AND expires > NOW()
+		 RETURNING nonce, verifier, account_id, reauth`, hashToken(state), p.Name).Scan(
+		&nonce, &verifier, &linkTo, &reauth)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidOIDCState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error using login state: %w", err)
+	}
+	if code == "" {
+		return nil, fmt.Errorf("%w: callback has no code", errOIDCProviderFailed)
+	}
+	d, err := h.discover(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := h.exchangeCode(ctx, p, d, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := h.verifyIDToken(ctx, p, d, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if linkTo != nil && reauth {
+		err = h.Reauthenticate(*linkTo, p.Name, claims)
+		if err != nil {
+			return nil, err
+		}
+		return &OIDCResult{AccountID: *linkTo, Reauthenticated: true}, nil
+	}
+	if linkTo != nil {
+		err = h.LinkIdentity(*linkTo, p.Name, claims)
+		if err != nil {
+			return nil, err
+		}
+		return &OIDCResult{AccountID: *linkTo, Linked: true}, nil
+	}
+	var accountID int
+	err = h.db.QueryRow(ctx,
+		`SELECT account_id FROM identities WHERE provider=$1 AND subject=$2`,
+		p.Name, claims.Subject).Scan(&accountID)
+	if err == nil {
+		return &OIDCResult{AccountID: accountID}, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("error querying identity: %w", err)
+	}
+	accountID, err = h.createAccount(ctx, p.Name, claims)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCResult{AccountID: accountID}, nil
+}
+
+// Creates an account for an identity that is not linked yet. Accounts with
+// the same email are not linked automatically, since that would hand them
+// to whoever controls the address at the provider.
+func (h *OIDCHandler) createAccount(ctx context.Context, provider string, claims *oidcClaims) (int, error) {
+	email := strings.TrimSpace(claims.Email)
+	if _, err := mail.ParseAddress(email); email == "" || err != nil {
+		return -1, errOIDCNoEmail
+	}
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	username, err := h.uniqueUsername(ctx, tx, claims)
+	if err != nil {
+		return -1, err
+	}
+	// The account has no password until one is set through a password reset
+	var accountID int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO accounts (email, username, password, email_verified)
+		 VALUES($1, $2, $3, $4)
+		 RETURNING id`, email, username, noPassword, claims.EmailVerified).Scan(&accountID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "accounts_email_key" {
+		return -1, errOIDCEmailTaken
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error inserting account: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO identities (account_id, provider, subject, email)
+		 VALUES($1, $2, $3, $4)`, accountID, provider, claims.Subject, email)
+	if err != nil {
+		return -1, fmt.Errorf("error inserting identity: %w", err)
+	}
+	return accountID, tx.Commit(ctx)
+}
+
+// Links an identity to an account. Linking it again is a no-op.
+func (h *OIDCHandler) LinkIdentity(accountID int, provider string, claims *oidcClaims) error {
+	ctx := context.Background()
+	var owner int
+	err := h.db.QueryRow(ctx,
+		`INSERT INTO identities (account_id, provider, subject, email)
+		 VALUES($1, $2, $3, $4)
+		 ON CONFLICT (provider, subject) DO UPDATE SET email=identities.email
+		 RETURNING account_id`, accountID, provider, claims.Subject, claims.Email).Scan(&owner)
+	if err != nil {
+		return fmt.Errorf("error inserting identity: %w", err)
+	}
+	if owner != accountID {
+		return errIdentityLinked
+	}
+	return nil
+}
+
+////////////
+// UPDATE
+
+// Records that an account signed in again with one of its identities,
+// which lets an account without a password confirm that it is present.
+// Returns errIdentityNotLinked if the identity belongs to no or another
+// account.
+func (h *OIDCHandler) Reauthenticate(accountID int, provider string, claims *oidcClaims) error {
+	tag, err := h.db.Exec(context.Background(),
+		`UPDATE accounts SET oidc_reauthenticated=$4
+		 WHERE id=$1 AND EXISTS (
+		   SELECT 1 FROM identities WHERE account_id=$1 AND provider=$2 AND subject=$3
+		 )`, accountID, provider, claims.Subject, time.Now())
+	if err != nil {
+		return fmt.Errorf("error recording reauthentication: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errIdentityNotLinked
+	}
+	return nil
+}
+
+//////////
+// READ
+
+func (h *OIDCHandler) GetIdentities(accountID int) ([]Identity, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT id, provider, subject, email, created FROM identities
+		 WHERE account_id=$1 ORDER BY created`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying identities: %w", err)
+	}
+	defer rows.Close()
+	identities := []Identity{}
+	for rows.Next() {
+		var i Identity
+		err := rows.Scan(&i.ID, &i.Provider, &i.Subject, &i.Email, &i.Created)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning identity: %w", err)
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+////////////
+// DELETE
+
+// Unlinks an identity from the account. The last identity of an account
+// without a password whose email is not verified stays, since the account
+// could not get back in without it: password resets are only sent to
+// verified emails. Returns false if there is no such identity.
+func (h *OIDCHandler) UnlinkIdentity(accountID int, id int) (bool, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var verified, hasPassword bool
+	err = tx.QueryRow(ctx,
+		`SELECT email_verified, password <> $2 FROM accounts WHERE id=$1 FOR UPDATE`,
+		accountID, noPassword).Scan(&verified, &hasPassword)
+	if err != nil {
+		return false, fmt.Errorf("error querying account: %w", err)
+	}
+	tag, err := tx.Exec(ctx,
+		`DELETE FROM identities WHERE account_id=$1 AND id=$2`, accountID, id)
+	if err != nil {
+		return false, fmt.Errorf("error deleting identity: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if !verified && !hasPassword {
+		var remaining int
+		err = tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM identities WHERE account_id=$1`, accountID).Scan(&remaining)
+		if err != nil {
+			return false, fmt.Errorf("error counting identities: %w", err)
+		}
+		if remaining == 0 {
+			return false, errLastLoginMethod
+		}
+	}
+	return true, tx.Commit(ctx)
+}
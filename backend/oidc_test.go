@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	stubClientID     = "disco"
+	stubClientSecret = "s3cret"
+	stubPublicURL    = "https://disco.example"
+)
+
+// An OpenID provider serving discovery, keys and a token endpoint that
+// hands out ID tokens for codes registered by the test
+type stubIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]stubGrant
+}
+
+// What an authorization code was issued for
+type stubGrant struct {
+	challenge string
+	idToken   string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubIssuer{key: key, grants: map[string]stubGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                s.URL,
+			AuthorizationEndpoint: s.URL + "/authorize",
+			TokenEndpoint:         s.URL + "/token",
+			JWKSURI:               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		coord := func(n interface{ FillBytes([]byte) []byte }) string {
+			return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []oidcJWK{{
+			Kty: "EC", Kid: "k1", Use: "sig", Crv: "P-256", X: coord(key.X), Y: coord(key.Y),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		deny := func(reason string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": reason})
+		}
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != stubClientID || secret != stubClientSecret {
+			deny("invalid_client")
+			return
+		}
+		r.ParseForm()
+		s.mu.Lock()
+		grant, ok := s.grants[r.PostForm.Get("code")]
+		delete(s.grants, r.PostForm.Get("code"))
+		s.mu.Unlock()
+		switch {
+		case r.PostForm.Get("grant_type") != "authorization_code" || !ok:
+			deny("invalid_grant")
+		case r.PostForm.Get("redirect_uri") != stubPublicURL+"/oidc/stub/callback":
+			deny("invalid_grant")
+		case pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge:
+			deny("invalid_grant")
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"id_token": grant.idToken, "token_type": "Bearer"})
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Registers an authorization code for the PKCE challenge and ID token
+func (s *stubIssuer) grant(code string, challenge string, idToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[code] = stubGrant{challenge: challenge, idToken: idToken}
+}
+
+// Claims of a valid ID token for the nonce
+func (s *stubIssuer) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            s.URL,
+		"aud":            stubClientID,
+		"sub":            "user-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func (s *stubIssuer) sign(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (s *stubIssuer) handler() *OIDCHandler {
+	return &OIDCHandler{
+		providers: map[string]*OIDCProvider{"stub": {
+			Name: "stub", Issuer: s.URL, ClientID: stubClientID, ClientSecret: stubClientSecret,
+			Scopes: []string{"openid", "email"},
+		}},
+		publicURL: stubPublicURL,
+		client:    s.Client(),
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	s := newStubIssuer(t)
+	h := s.handler()
+	p := h.providers["stub"]
+	ctx := context.Background()
+	d, err := h.discover(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		change func(jwt.MapClaims)
+		ok     bool
+	}{
+		{"valid", s.key, func(c jwt.MapClaims) {}, true},
+		{"audience is a list", s.key, func(c jwt.MapClaims) { c["aud"] = []string{"other", stubClientID} }, true},
+		{"wrong audience", s.key, func(c jwt.MapClaims) { c["aud"] = "other-client" }, false},
+		{"wrong issuer", s.key, func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, false},
+		{"expired", s.key, func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, false},
+		{"no expiry", s.key, func(c jwt.MapClaims) { delete(c, "exp") }, false},
+		{"issued in the future", s.key, func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }, false},
+		{"nonce mismatch", s.key, func(c jwt.MapClaims) { c["nonce"] = "other-nonce" }, false},
+		{"no nonce", s.key, func(c jwt.MapClaims) { delete(c, "nonce") }, false},
+		{"no subject", s.key, func(c jwt.MapClaims) { delete(c, "sub") }, false},
+		{"signed with another key", otherKey, func(c jwt.MapClaims) {}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := s.claims("the-nonce")
+			tt.change(claims)
+			got, err := h.verifyIDToken(ctx, p, d, s.sign(t, tt.key, claims), "the-nonce")
+			if tt.ok {
+				if err != nil || got.Subject != "user-1" || got.Email != "alice@example.com" {
+					t.Errorf("verifyIDToken = %+v, %v", got, err)
+				}
+				return
+			}
+			if !errors.Is(err, errOIDCProviderFailed) {
+				t.Errorf("verifyIDToken = %v, want errOIDCProviderFailed", err)
+			}
+		})
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodNone, s.claims("the-nonce"))
+		unsigned, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		if _, err := h.verifyIDToken(ctx, p, d, unsigned, "the-nonce"); err == nil {
+			t.Error("an unsigned token was accepted")
+		}
+	})
+}
+
+func TestExchangeCodePKCE(t *testing.T) {
+	s := newStubIssuer(t)
+	h := s.handler()
+	p := h.providers["stub"]
+	ctx := context.Background()
+	d, err := h.discover(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken := s.sign(t, s.key, s.claims("n"))
+
+	s.grant("code-1", pkceChallenge("right-verifier"), idToken)
+	got, err := h.exchangeCode(ctx, p, d, "code-1", "right-verifier")
+	if err != nil || got != idToken {
+		t.Fatalf("exchangeCode = %q, %v", got, err)
+	}
+	if _, err := h.exchangeCode(ctx, p, d, "code-1", "right-verifier"); !errors.Is(err, errOIDCProviderFailed) {
+		t.Errorf("reusing a code = %v, want errOIDCProviderFailed", err)
+	}
+
+	s.grant("code-2", pkceChallenge("right-verifier"), idToken)
+	if _, err := h.exchangeCode(ctx, p, d, "code-2", "wrong-verifier"); !errors.Is(err, errOIDCProviderFailed) {
+		t.Errorf("PKCE mismatch = %v, want errOIDCProviderFailed", err)
+	}
+}
+
+func TestOIDCCallbackBadState(t *testing.T) {
+	t.Setenv("ORIGIN", "https://app.example")
+	s := newStubIssuer(t)
+	auth := &AuthMiddleware{oidc: s.handler()}
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		cookie string
+	}{
+		{"no state", "code=c", "abc"},
+		{"no cookie", "state=abc&code=c", ""},
+		{"cookie from another login", "state=abc&code=c", "xyz"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/oidc/stub/callback?"+tt.query, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "clientip", "10.0.0.1"))
+			w := httptest.NewRecorder()
+			auth.serveOIDCCallback(w, r)
+			if w.Code != http.StatusFound || w.Header().Get("Location") != "https://app.example/login?oidc_error=invalid_state" {
+				t.Errorf("callback = %d to %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+// Starts an authorization and returns its state, nonce and PKCE challenge
+func startStubAuth(t *testing.T, h *OIDCHandler, accountID int, reauth bool) (state string, nonce string, challenge string) {
+	t.Helper()
+	authURL, state, err := h.StartAuth("stub", accountID, reauth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("state") != state || query.Get("code_challenge_method") != "S256" ||
+		query.Get("client_id") != stubClientID || query.Get("redirect_uri") != stubPublicURL+"/oidc/stub/callback" {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	return state, query.Get("nonce"), query.Get("code_challenge")
+}
+
+func TestFinishAuth(t *testing.T) {
+	db := newTestDB(t)
+	s := newStubIssuer(t)
+	h := s.handler()
+	h.db = db
+
+	state, nonce, challenge := startStubAuth(t, h, -1, false)
+	s.grant("code-1", challenge, s.sign(t, s.key, s.claims(nonce)))
+	result, err := h.FinishAuth("stub", state, "code-1")
+	if err != nil || result.Linked {
+		t.Fatalf("FinishAuth = %+v, %v", result, err)
+	}
+	var email string
+	var verified bool
+	err = db.QueryRow(context.Background(),
+		`SELECT email, email_verified FROM accounts WHERE id=$1`, result.AccountID).Scan(&email, &verified)
+	if err != nil || email != "alice@example.com" || !verified {
+		t.Errorf("created account has %q, %v, %v", email, verified, err)
+	}
+
+	t.Run("state is single use", func(t *testing.T) {
+		if _, err := h.FinishAuth("stub", state, "code-1"); !errors.Is(err, errInvalidOIDCState) {
+			t.Errorf("FinishAuth = %v, want errInvalidOIDCState", err)
+		}
+	})
+	t.Run("unknown state", func(t *testing.T) {
+		if _, err := h.FinishAuth("stub", "made-up", "code-1"); !errors.Is(err, errInvalidOIDCState) {
+			t.Errorf("FinishAuth = %v, want errInvalidOIDCState", err)
+		}
+	})
+	t.Run("same identity logs in to the same account", func(t *testing.T) {
+		state, nonce, challenge := startStubAuth(t, h, -1, false)
+		s.grant("code-2", challenge, s.sign(t, s.key, s.claims(nonce)))
+		again, err := h.FinishAuth("stub", state, "code-2")
+		if err != nil || again.AccountID != result.AccountID {
+			t.Errorf("FinishAuth = %+v, %v, want account %d", again, err, result.AccountID)
+		}
+	})
+	t.Run("PKCE mismatch", func(t *testing.T) {
+		state, nonce, _ := startStubAuth(t, h, -1, false)
+		s.grant("code-3", pkceChallenge("another verifier"), s.sign(t, s.key, s.claims(nonce)))
+		if _, err := h.FinishAuth("stub", state, "code-3"); !errors.Is(err, errOIDCProviderFailed) {
+			t.Errorf("FinishAuth = %v, want errOIDCProviderFailed", err)
+		}
+	})
+	t.Run("nonce mismatch", func(t *testing.T) {
+		state, _, challenge := startStubAuth(t, h, -1, false)
+		s.grant("code-4", challenge, s.sign(t, s.key, s.claims("nonce of another login")))
+		if _, err := h.FinishAuth("stub", state, "code-4"); !errors.Is(err, errOIDCProviderFailed) {
+			t.Errorf("FinishAuth = %v, want errOIDCProviderFailed", err)
+		}
+	})
+	t.Run("expired token", func(t *testing.T) {
+		state, nonce, challenge := startStubAuth(t, h, -1, false)
+		claims := s.claims(nonce)
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		s.grant("code-5", challenge, s.sign(t, s.key, claims))
+		if _, err := h.FinishAuth("stub", state, "code-5"); !errors.Is(err, errOIDCProviderFailed) {
+			t.Errorf("FinishAuth = %v, want errOIDCProviderFailed", err)
+		}
+	})
+	t.Run("state of another provider", func(t *testing.T) {
+		state, _, _ := startStubAuth(t, h, -1, false)
+		h.providers["other"] = &OIDCProvider{Name: "other", Issuer: s.URL, ClientID: stubClientID}
+		defer delete(h.providers, "other")
+		if _, err := h.FinishAuth("other", state, "code"); !errors.Is(err, errInvalidOIDCState) {
+			t.Errorf("FinishAuth = %v, want errInvalidOIDCState", err)
+		}
+	})
+	t.Run("reauthentication stands in for a missing password", func(t *testing.T) {
+		twoFactor := &TwoFactorHandler{db: db, now: time.Now}
+		err := twoFactor.reauthenticate(result.AccountID, "", "")
+		if !errors.Is(err, errReauthRequired) {
+			t.Fatalf("reauthenticate before signing in again = %v, want errReauthRequired", err)
+		}
+		state, nonce, challenge := startStubAuth(t, h, result.AccountID, true)
+		s.grant("code-6", challenge, s.sign(t, s.key, s.claims(nonce)))
+		again, err := h.FinishAuth("stub", state, "code-6")
+		if err != nil || !again.Reauthenticated || again.AccountID != result.AccountID {
+			t.Fatalf("FinishAuth = %+v, %v", again, err)
+		}
+		if err := twoFactor.reauthenticate(result.AccountID, "", ""); err != nil {
+			t.Errorf("reauthenticate after signing in again = %v", err)
+		}
+	})
+	t.Run("reauthentication needs a linked identity", func(t *testing.T) {
+		other := createTestAccount(t, db, "bob", "")
+		state, nonce, challenge := startStubAuth(t, h, other, true)
+		s.grant("code-7", challenge, s.sign(t, s.key, s.claims(nonce)))
+		if _, err := h.FinishAuth("stub", state, "code-7"); !errors.Is(err, errIdentityNotLinked) {
+			t.Errorf("FinishAuth = %v, want errIdentityNotLinked", err)
+		}
+	})
+}
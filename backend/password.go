@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+///////////
+// TYPES
+
+const (
+	passwordResetExpiration = time.Hour
+	// Minimum time between two reset emails to an account
+	passwordResetInterval = time.Minute
+	// Maximum reset emails to an account in a day
+	passwordResetDailyLimit = 5
+)
+
+var errInvalidResetToken = errors.New("invalid or expired reset token")
+
+/////////////
+// HELPERS
+
+// Checks how many reset emails an account was sent recently
+func (h *AuthMiddleware) checkResetThrottle(ctx context.Context, accountID int, now time.Time) error {
+	var last, oldest pgtype.Timestamptz
+	var count int
+	err := h.db.QueryRow(ctx,
+		`SELECT MAX(created), MIN(created), COUNT(*)
+		 FROM password_resets
+		 WHERE account_id=$1 AND created > $2`, accountID, now.Add(-24*time.Hour)).Scan(
+		&last, &oldest, &count)
+	if err != nil {
+		return fmt.Errorf("error counting reset emails: %w", err)
+	}
+	if last.Valid && now.Sub(last.Time) < passwordResetInterval {
+		return &throttleError{RetryAfter: passwordResetInterval - now.Sub(last.Time)}
+	}
+	if count >= passwordResetDailyLimit {
+		return &throttleError{RetryAfter: oldest.Time.Add(24 * time.Hour).Sub(now)}
+	}
+	return nil
+}
+
+// Tokens are stored hashed so that a leaked table cannot be used to reset
+// passwords. They carry 256 bits of entropy, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Handles POST /password/forgot. Responds the same way whether or not the
+// email belongs to an account so that accounts cannot be discovered.
+func (h *AuthMiddleware) serveForgotPassword(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	err := r.ParseMultipartForm(0)
+	if err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+	err = h.limiter.CheckPasswordReset(context.Background(), clientIP)
+	var throttled *throttleError
+	if errors.As(err, &throttled) {
+		retryAfterHeader(w, throttled.RetryAfter)
+		http.Error(w, "too many password reset requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("error checking password reset limit for %s: %v\n", clientIP, err)
+		http.Error(w, "error handling request", http.StatusInternalServerError)
+		return
+	}
+	err = h.ForgotPassword(email)
+	// Throttling by account is not reported, as that would reveal that
+	// the account exists
+	if err != nil && !errors.As(err, &throttled) {
+		log.Printf("error handling forgotten password for %s: %v\n", clientIP, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handles POST /password/reset
+func (h *AuthMiddleware) serveResetPassword(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	err := r.ParseMultipartForm(0)
+	if err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	password := r.FormValue("password")
+	if token == "" || strings.TrimSpace(password) == "" {
+		http.Error(w, "missing token or password", http.StatusBadRequest)
+		return
+	}
+	err = h.ResetPassword(token, password)
+	var policyErr *passwordPolicyError
+	if errors.Is(err, errInvalidResetToken) || errors.As(err, &policyErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error resetting password for %s: %v\n", clientIP, err)
+		http.Error(w, "error resetting password", http.StatusInternalServerError)
+		return
+	}
+	// Any cookies sent along belong to a session that no longer exists
+	h.DeleteAuthCookies(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+////////////
+// CREATE
+
+// Issues a reset token for the account with the given email and mails a
+// link to it. Does nothing if there is no such account or its email is not
+// verified: accounts created through a provider that did not verify the
+// address would otherwise go to whoever holds it. Returns a
+// *throttleError if the account was sent too many reset emails recently.
+func (h *AuthMiddleware) ForgotPassword(email string) error {
+	ctx := context.Background()
+	now := time.Now()
+	account, err := h.accountHandler.GetAccountByEmail(email)
+	if err != nil {
+		return fmt.Errorf("error getting account: %w", err)
+	}
+	if account == nil || !account.EmailVerified {
+		return nil
+	}
+	err = h.checkResetThrottle(ctx, account.ID, now)
+	if err != nil {
+		return err
+	}
+	token, err := GenerateToken(32)
+	if err != nil {
+		return fmt.Errorf("error generating token: %w", err)
+	}
+	// Tokens older than the throttle window are of no use, clear them out
+	// while we are here
+	_, err = h.db.Exec(ctx,
+		`DELETE FROM password_resets WHERE account_id=$1 AND created < $2`, account.ID, now.Add(-24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("error deleting old reset tokens: %w", err)
+	}
+	_, err = h.db.Exec(ctx,
+		`INSERT INTO password_resets (account_id, token_hash, expires)
+		 VALUES($1, $2, $3)`, account.ID, hashToken(token), now.Add(passwordResetExpiration))
+	if err != nil {
+		return fmt.Errorf("error inserting reset token: %w", err)
+	}
+	link := fmt.Sprintf("%s/reset-password?token=%s", os.Getenv("ORIGIN"), url.QueryEscape(token))
+	msg := Message{
+		To:      account.Email,
+		Subject: "Reset your disco password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your disco account. To choose a new\n"+
+			"password, open this link within the next hour:\n\n%s\n\n"+
+			"If this wasn't you, you can ignore this email.\n", account.Username, link),
+	}
+	// Sent in the background so that response times do not reveal
+	// whether the account exists
+	go func() {
+		err := h.mailer.Send(msg)
+		if err != nil {
+			log.Printf("error sending password reset mail to account %d: %v\n", account.ID, err)
+		}
+	}()
+	return nil
+}
+
+////////////
+// UPDATE
+
+// Sets a new password using a reset token. The token and every other
+// outstanding token of the account are used up, and all of the account's
+// sessions are logged out.
+func (h *AuthMiddleware) ResetPassword(token string, password string) error {
+	ctx := context.Background()
+	// The account is not known yet, so this leaves out the username and
+	// email, which are checked once the token is
+	err := ValidatePassword(password, "", "")
+	if err != nil {
+		return err
+	}
+	// Hash before taking any locks, hashing is slow on purpose
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var accountID int
+	err = tx.QueryRow(ctx,
+		`UPDATE password_resets SET used=NOW()
+		 WHERE token_hash=$1 AND used IS NULL AND expires > NOW()
+		 RETURNING account_id`, hashToken(token)).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInvalidResetToken
+	}
+	if err != nil {
+		return fmt.Errorf("error using reset token: %w", err)
+	}
+	var username, email string
+	err = tx.QueryRow(ctx,
+		`SELECT username, email FROM accounts WHERE id=$1`, accountID).Scan(&username, &email)
+	if err != nil {
+		return fmt.Errorf("error querying account: %w", err)
+	}
+	// Rolling back leaves the token unused, so the user can try again
+	err = ValidatePassword(password, username, email)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE password_resets SET used=NOW()
+		 WHERE account_id=$1 AND used IS NULL`, accountID)
+	if err != nil {
+		return fmt.Errorf("error invalidating reset tokens: %w", err)
+	}
+	err = setPasswordHash(ctx, tx, accountID, hashed)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
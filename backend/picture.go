@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Profile pictures are cropped to a square and stored in several sizes.
+// Each upload gets a new random version in its URLs, so that pictures can
+// be cached for good and a new picture shows up right away.
+type PictureHandler struct {
+	db    *pgxpool.Pool
+	store BlobStore
+}
+
+func NewPictureHandler(db *pgxpool.Pool, store BlobStore) *PictureHandler {
+	return &PictureHandler{db: db, store: store}
+}
+
+// Response of an upload
+type PictureUpload struct {
+	// URL of the largest size, stored as the account's picture
+	Picture string `json:"picture"`
+	// URL of each size, by width in pixels
+	Sizes map[string]string `json:"sizes"`
+}
+
+type thumbnail struct {
+	size int
+	data []byte
+}
+
+// Widths of the stored pictures, largest last
+var pictureSizes = []int{64, 128, 256}
+
+const (
+	maxPictureUpload = 5 << 20
+	// Bounds decoding memory, the decoded image takes 4 bytes a pixel
+	maxPicturePixels = 25_000_000
+	pictureQuality   = 85
+)
+
+var errInvalidPicture = errors.New("picture must be a JPEG, PNG or GIF image")
+
+////////////
+// ROUTES
+
+var (
+	AccountPictureRE = regexp.MustCompile(`^\/accounts\/(\d+)\/picture\/?$`)
+	PictureRE        = regexp.MustCompile(`^\/pictures\/(\d+)\/([A-Za-z0-9_-]+)\/(\d+)\.(png|jpg)$`)
+)
+
+func (h *PictureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// GET PICTURE ROUTE
+	case PictureRE.MatchString(url) && r.Method == http.MethodGet:
+		h.servePicture(w, r)
+		return
+
+	// UPLOAD PICTURE ROUTE
+	case AccountPictureRE.MatchString(url) && r.Method == http.MethodPost:
+		claims, ok := accountOwner(w, r, AccountPictureRE)
+		if !ok {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxPictureUpload+64<<10)
+		err := r.ParseMultipartForm(maxPictureUpload)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "picture is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error parsing form", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("picture")
+		if err != nil {
+			http.Error(w, "missing picture", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxPictureUpload+1))
+		if err != nil {
+			http.Error(w, "error reading picture", http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxPictureUpload {
+			http.Error(w, "picture is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		upload, err := h.UploadPicture(claims.UserID, data)
+		if errors.Is(err, errInvalidPicture) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			log.Printf("error uploading picture for %s: %v\n", clientIP, err)
+			http.Error(w, "error uploading picture", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, upload, http.StatusCreated)
+		return
+
+	// DELETE PICTURE ROUTE
+	case AccountPictureRE.MatchString(url) && r.Method == http.MethodDelete:
+		claims, ok := accountOwner(w, r, AccountPictureRE)
+		if !ok {
+			return
+		}
+		err := h.RemovePicture(claims.UserID)
+		if err != nil {
+			log.Printf("error deleting picture for %s: %v\n", clientIP, err)
+			http.Error(w, "error deleting picture", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+// Handles GET /pictures/{account}/{version}/{size}.{ext}. The URLs of a
+// picture never change content, so it may be cached for a year.
+func (h *PictureHandler) servePicture(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	groups := PictureRE.FindStringSubmatch(r.URL.Path)
+	etag := fmt.Sprintf(`"%s-%s"`, groups[2], groups[3])
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	blob, err := h.store.Get(r.Context(), strings.TrimPrefix(r.URL.Path, "/"))
+	if errors.Is(err, errBlobNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting picture for %s: %v\n", clientIP, err)
+		http.Error(w, "error getting picture", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Body.Close()
+	w.Header().Set("Content-Type", blob.ContentType)
+	if blob.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, blob.Body)
+}
+
+/////////////
+// HELPERS
+
+// Returns the blob keys of every size of a stored picture, or nil for
+// pictures that were not uploaded, such as links from before uploads
+func pictureKeys(picture string) []string {
+	groups := PictureRE.FindStringSubmatch(picture)
+	if groups == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(pictureSizes))
+	for _, size := range pictureSizes {
+		keys = append(keys, fmt.Sprintf("pictures/%s/%s/%d.%s", groups[1], groups[2], size, groups[4]))
+	}
+	return keys
+}
+
+// Deletes the stored sizes of a picture. Failures are only logged; they
+// leave unreferenced files behind but nothing broken.
+func (h *PictureHandler) deleteBlobs(picture string) {
+	for _, key := range pictureKeys(picture) {
+		err := h.store.Delete(context.Background(), key)
+		if err != nil {
+			log.Printf("error deleting picture %s: %v\n", key, err)
+		}
+	}
+}
+
+// Decodes an uploaded image and renders every size. EXIF orientation is
+// applied, and re-encoding drops all metadata. Images with transparency
+// are stored as PNG, others as JPEG.
+func processPicture(data []byte) ([]thumbnail, string, error) {
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/gif" {
+		return nil, "", errInvalidPicture
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width < 1 || config.Height < 1 {
+		return nil, "", errInvalidPicture
+	}
+	if config.Width*config.Height > maxPicturePixels {
+		return nil, "", fmt.Errorf("%w, at most %d pixels", errInvalidPicture, maxPicturePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errInvalidPicture
+	}
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	if contentType == "image/jpeg" {
+		src = orient(src, jpegOrientation(data))
+	}
+
+	ext := "jpg"
+	if !src.Opaque() {
+		ext = "png"
+	}
+	thumbnails := make([]thumbnail, 0, len(pictureSizes))
+	for _, size := range pictureSizes {
+		var buf bytes.Buffer
+		resized := squareThumbnail(src, size)
+		if ext == "png" {
+			err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, resized)
+		} else {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: pictureQuality})
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("error encoding picture: %w", err)
+		}
+		thumbnails = append(thumbnails, thumbnail{size: size, data: buf.Bytes()})
+	}
+	return thumbnails, ext, nil
+}
+
+// Crops the middle square of an image and scales it to size×size,
+// averaging the source pixels that fall on each target pixel
+func squareThumbnail(src *image.RGBA, size int) *image.RGBA {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0 := y0 + y*side/size
+		sy1 := max(y0+(y+1)*side/size, sy0+1)
+		for x := 0; x < size; x++ {
+			sx0 := x0 + x*side/size
+			sx1 := max(x0+(x+1)*side/size, sx0+1)
+			// Premultiplied channels average without darkening edges
+			var sum [4]uint64
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[src.PixOffset(sx0, sy):src.PixOffset(sx1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += uint64(row[i])
+					sum[1] += uint64(row[i+1])
+					sum[2] += uint64(row[i+2])
+					sum[3] += uint64(row[i+3])
+				}
+			}
+			n := uint64((sx1 - sx0) * (sy1 - sy0))
+			i := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// Turns an image the way an EXIF orientation value asks, so that it
+// displays upright once the EXIF data is gone
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Rotated by a quarter turn
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-dx, dy
+			case 3: // upside down
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // upside down and mirrored
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // a quarter turn clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // a quarter turn counterclockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// Returns the EXIF orientation of a JPEG, 1 (upright) if it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan or end of image: the metadata is over
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// Reads the orientation tag from the first IFD of EXIF's TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < entries; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			// A SHORT, stored at the start of the value field
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+////////////
+// UPDATE
+
+// Stores every size of an uploaded picture and makes it the account's
+// picture. The previous picture is deleted.
+func (h *PictureHandler) UploadPicture(accountID int, data []byte) (*PictureUpload, error) {
+	thumbnails, ext, err := processPicture(data)
+	if err != nil {
+		return nil, err
+	}
+	version, err := GenerateToken(12)
+	if err != nil {
+		return nil, fmt.Errorf("error generating picture version: %w", err)
+	}
+	ctx := context.Background()
+	upload := PictureUpload{Sizes: map[string]string{}}
+	contentType := "image/jpeg"
+	if ext == "png" {
+		contentType = "image/png"
+	}
+	for _, t := range thumbnails {
+		key := fmt.Sprintf("pictures/%d/%s/%d.%s", accountID, version, t.size, ext)
+		err = h.store.Put(ctx, key, contentType, t.data)
+		if err != nil {
+			return nil, err
+		}
+		upload.Sizes[strconv.Itoa(t.size)] = "/" + key
+		upload.Picture = "/" + key
+	}
+	old, err := h.setPicture(ctx, accountID, &upload.Picture)
+	if err != nil {
+		h.deleteBlobs(upload.Picture)
+		return nil, err
+	}
+	h.deleteBlobs(old)
+	return &upload, nil
+}
+
+// Sets the account's picture and returns the one it replaces
+func (h *PictureHandler) setPicture(ctx context.Context, accountID int, picture *string) (string, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var old pgtype.Text
+	err = tx.QueryRow(ctx,
+		`SELECT picture FROM accounts WHERE id=$1 FOR UPDATE`, accountID).Scan(&old)
+	if err != nil {
+		return "", fmt.Errorf("error querying picture: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts
+		 SET picture=$1 WHERE id=$2`, picture, accountID)
+	if err != nil {
+		return "", fmt.Errorf("error updating picture: %w", err)
+	}
+	return old.String, tx.Commit(ctx)
+}
+
+////////////
+// DELETE
+
+// Removes the account's picture and its stored sizes
+func (h *PictureHandler) RemovePicture(accountID int) error {
+	old, err := h.setPicture(context.Background(), accountID, nil)
+	if err != nil {
+		return err
+	}
+	h.deleteBlobs(old)
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// An image whose left half is one color and right half another
+func halvesImage(w int, h int, left color.Color, right color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := left
+			if x >= w/2 {
+				c = right
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Encodes a JPEG with an EXIF segment holding only the orientation tag
+func exifJPEG(t *testing.T, img image.Image, order binary.AppendByteOrder, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00\x2a")
+	if order == binary.LittleEndian {
+		tiff = []byte("II\x2a\x00")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	// Tag, type SHORT, count, value and padding
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	tiff = order.AppendUint32(tiff, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	data = binary.BigEndian.AppendUint16(data, uint16(2+len(segment)))
+	data = append(data, segment...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := halvesImage(8, 8, color.White, color.Black)
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"big endian", exifJPEG(t, img, binary.BigEndian, 6), 6},
+		{"little endian", exifJPEG(t, img, binary.LittleEndian, 8), 8},
+		{"out of range", exifJPEG(t, img, binary.BigEndian, 9), 1},
+		{"no exif", exifJPEG(t, img, binary.BigEndian, 3)[:2], 1},
+		{"truncated", exifJPEG(t, img, binary.BigEndian, 3)[:20], 1},
+		{"png", encodePNG(t, img), 1},
+	} {
+		if got := jpegOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: orientation %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	if got := jpegOrientation(plain.Bytes()); got != 1 {
+		t.Errorf("JPEG without EXIF: orientation %d, want 1", got)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// The pixels of
+	//   a b c
+	//   d e f
+	// are told apart by their red channel
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i, c := range "abcdef" {
+		src.SetRGBA(i%3, i/3, color.RGBA{R: uint8(c), A: 255})
+	}
+	for orientation, want := range map[int][]string{
+		1: {"abc", "def"},
+		2: {"cba", "fed"},
+		3: {"fed", "cba"},
+		4: {"def", "abc"},
+		5: {"ad", "be", "cf"},
+		6: {"da", "eb", "fc"},
+		7: {"fc", "eb", "da"},
+		8: {"cf", "be", "ad"},
+	} {
+		got := orient(src, orientation)
+		var rows []string
+		for y := 0; y < got.Bounds().Dy(); y++ {
+			var row []byte
+			for x := 0; x < got.Bounds().Dx(); x++ {
+				row = append(row, got.RGBAAt(x, y).R)
+			}
+			rows = append(rows, string(row))
+		}
+		if strings.Join(rows, "/") != strings.Join(want, "/") {
+			t.Errorf("orientation %d = %v, want %v", orientation, rows, want)
+		}
+	}
+}
+
+func TestSquareThumbnail(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+
+	// The middle of a wide image is kept
+	wide := image.NewRGBA(image.Rect(0, 0, 6, 2))
+	for x, c := range []color.RGBA{red, red, green, green, blue, blue} {
+		wide.SetRGBA(x, 0, c)
+		wide.SetRGBA(x, 1, c)
+	}
+	for _, size := range []int{1, 2, 4} {
+		got := squareThumbnail(wide, size)
+		if got.Bounds() != image.Rect(0, 0, size, size) {
+			t.Fatalf("size %d: bounds %v", size, got.Bounds())
+		}
+		for i := 0; i < len(got.Pix); i += 4 {
+			if c := got.Pix[i : i+4]; !bytes.Equal(c, []byte{0, 255, 0, 255}) {
+				t.Errorf("size %d: pixel %d is %v, want green", size, i/4, c)
+				break
+			}
+		}
+	}
+
+	// Pixels are averaged, with transparent ones weighing in premultiplied
+	for _, tt := range []struct {
+		name   string
+		pixels []color.RGBA
+		want   []byte
+	}{
+		{"checkerboard", []color.RGBA{{A: 255}, {255, 255, 255, 255}, {255, 255, 255, 255}, {A: 255}}, []byte{128, 128, 128, 255}},
+		{"half transparent", []color.RGBA{{}, {255, 255, 255, 255}, {255, 255, 255, 255}, {}}, []byte{128, 128, 128, 128}},
+	} {
+		src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		for i, c := range tt.pixels {
+			src.SetRGBA(i%2, i/2, c)
+		}
+		if got := squareThumbnail(src, 1).Pix; !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Gives a PNG other dimensions without decoding it
+func resizedPNGHeader(data []byte, w uint32, h uint32) []byte {
+	data = bytes.Clone(data)
+	// Signature, then the IHDR chunk's length and type
+	ihdr := data[16:29]
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestProcessPicture(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	decode := func(t *testing.T, data []byte) image.Image {
+		t.Helper()
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	isRed := func(c color.Color) bool {
+		r, _, b, _ := c.RGBA()
+		return r > 0xC000 && b < 0x4000
+	}
+
+	t.Run("sizes", func(t *testing.T) {
+		thumbnails, ext, err := processPicture(encodePNG(t, halvesImage(300, 200, red, blue)))
+		if err != nil || ext != "jpg" {
+			t.Fatalf("processPicture = %s, %v", ext, err)
+		}
+		if len(thumbnails) != len(pictureSizes) {
+			t.Fatalf("%d thumbnails, want %d", len(thumbnails), len(pictureSizes))
+		}
+		for i, thumb := range thumbnails {
+			img := decode(t, thumb.data)
+			if thumb.size != pictureSizes[i] || img.Bounds().Dx() != thumb.size || img.Bounds().Dy() != thumb.size {
+				t.Errorf("thumbnail %d is %v, want %d square", thumb.size, img.Bounds(), pictureSizes[i])
+			}
+			if !isRed(img.At(2, 2)) || isRed(img.At(thumb.size-3, 2)) {
+				t.Errorf("thumbnail %d is not red on the left and blue on the right", thumb.size)
+			}
+		}
+	})
+
+	t.Run("transparency", func(t *testing.T) {
+		thumbnails, ext, err := processPicture(encodePNG(t, halvesImage(10, 10, color.Transparent, red)))
+		if err != nil || ext != "png" {
+			t.Fatalf("processPicture = %s, %v, want png", ext, err)
+		}
+		if _, _, _, a := decode(t, thumbnails[0].data).At(0, 0).RGBA(); a != 0 {
+			t.Errorf("transparent corner has alpha %d", a)
+		}
+	})
+
+	t.Run("gif", func(t *testing.T) {
+		var buf bytes.Buffer
+		palette := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, blue})
+		if err := gif.Encode(&buf, palette, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ext, err := processPicture(buf.Bytes()); err != nil || ext != "jpg" {
+			t.Errorf("processPicture = %s, %v", ext, err)
+		}
+	})
+
+	t.Run("exif orientation", func(t *testing.T) {
+		// Turned a quarter clockwise, red ends up on top
+		data := exifJPEG(t, halvesImage(40, 20, red, blue), binary.BigEndian, 6)
+		thumbnails, _, err := processPicture(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumb := thumbnails[0]
+		img := decode(t, thumb.data)
+		if !isRed(img.At(thumb.size-3, 2)) || isRed(img.At(2, thumb.size-3)) {
+			t.Error("picture was not turned upright")
+		}
+		if bytes.Contains(thumb.data, []byte("Exif")) {
+			t.Error("EXIF data was kept")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		valid := encodePNG(t, halvesImage(4, 4, red, blue))
+		for name, data := range map[string][]byte{
+			"text":       []byte("hello, world"),
+			"truncated":  valid[:len(valid)/2],
+			"too large":  resizedPNGHeader(valid, 6000, 6000),
+			"empty":      nil,
+			"bmp header": []byte("BM\x00\x00\x00\x00"),
+		} {
+			if _, _, err := processPicture(data); !errors.Is(err, errInvalidPicture) {
+				t.Errorf("%s: %v, want errInvalidPicture", name, err)
+			}
+		}
+		_, _, err := processPicture(resizedPNGHeader(valid, 6000, 6000))
+		if err == nil || !strings.Contains(err.Error(), "pixels") {
+			t.Errorf("too large: %v, want the pixel limit", err)
+		}
+	})
+}
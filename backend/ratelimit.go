@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Limits failed logins per client IP and per account with sliding windows.
+// After a few failures an account has to wait between attempts, twice as
+// long each time, and too many failures lock it for a while. Requests over
+// a limit are turned away before the password is checked, so they cost no
+// password hashing. Every login that gets through counts as a failure
+// right away, until it turns out to succeed, so parallel requests cannot
+// all slip in before the first failure is recorded.
+type LoginLimiter struct {
+	store LimiterStore
+	// Finds the account a login name belongs to, nil if there is none
+	accounts func(ctx context.Context, emailOrUsername string) (*Account, error)
+	mailer   Mailer
+	now      func() time.Time
+}
+
+// Records attempts by key. The memory store suits a single instance; the
+// Postgres store shares limits between instances.
+type LimiterStore interface {
+	Add(ctx context.Context, key string, t time.Time) error
+	// Passes the attempts for key since the given time to allow and records
+	// an attempt at t if it returns nil. Reservations for a key run one at
+	// a time, so no two see the same window.
+	Reserve(ctx context.Context, key string, t time.Time, since time.Time, allow func(AttemptWindow) error) error
+	// Returns the attempts for key since the given time
+	Window(ctx context.Context, key string, since time.Time) (AttemptWindow, error)
+	// Forgets one attempt recorded at t
+	Remove(ctx context.Context, key string, t time.Time) error
+	Clear(ctx context.Context, key string) error
+	// Forgets attempts before the given time
+	Purge(ctx context.Context, before time.Time) error
+}
+
+type AttemptWindow struct {
+	Count  int
+	Oldest time.Time
+	Newest time.Time
+}
+
+type MemoryLimiterStore struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+type PostgresLimiterStore struct {
+	db *pgxpool.Pool
+}
+
+// A login let through by Check. It counts as failed until Succeed or
+// Release is called.
+type loginAttempt struct {
+	ipKey    string
+	key      string
+	account  *Account
+	clientIP string
+	at       time.Time
+}
+
+// Returned when a login is turned away
+type loginLimitError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *loginLimitError) Error() string {
+	if e.Locked {
+		return "account is temporarily locked after too many failed logins"
+	}
+	return "too many failed logins, try again later"
+}
+
+// Creates the limiter with the store chosen by LOGIN_LIMIT_STORE: memory
+// (default) or postgres
+func NewLoginLimiterFromEnv(db *pgxpool.Pool, mailer Mailer) (*LoginLimiter, error) {
+	var store LimiterStore
+	switch os.Getenv("LOGIN_LIMIT_STORE") {
+	case "", "memory":
+		store = NewMemoryLimiterStore()
+	case "postgres":
+		store = &PostgresLimiterStore{db: db}
+	default:
+		return nil, fmt.Errorf("unknown LOGIN_LIMIT_STORE %q", os.Getenv("LOGIN_LIMIT_STORE"))
+	}
+	accounts := func(ctx context.Context, emailOrUsername string) (*Account, error) {
+		return findLoginAccount(ctx, db, emailOrUsername)
+	}
+	return &LoginLimiter{store: store, accounts: accounts, mailer: mailer, now: time.Now}, nil
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{attempts: map[string][]time.Time{}}
+}
+
+const (
+	loginLimitWindow = 15 * time.Minute
+	// Failed logins from one IP within the window
+	ipLoginLimit = 30
+	// Failed logins to an account within the window before it has to wait
+	accountFreeAttempts = 3
+	maxLoginDelay       = time.Minute
+	// Failed logins to an account within the window that lock it
+	accountLockoutLimit = 10
+	lockoutDuration     = 15 * time.Minute
+	loginLimitPurge     = 5 * time.Minute
+	// Password reset emails requested from one IP within the window
+	ipResetLimit = 10
+)
+
+var errAlreadyLocked = errors.New("account is already locked")
+
+/////////////
+// HELPERS
+
+func retryAfterHeader(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// Strips the port that RemoteAddr carries, so that every connection from a
+// client counts against the same IP
+func ipKey(clientIP string) string {
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	return "ip:" + clientIP
+}
+
+func findLoginAccount(ctx context.Context, db *pgxpool.Pool, emailOrUsername string) (*Account, error) {
+	var a Account
+	err := db.QueryRow(ctx,
+		`SELECT id, email, username FROM accounts
+		 WHERE username=$1 OR email=$1 LIMIT 1`, emailOrUsername).Scan(&a.ID, &a.Email, &a.Username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying account: %w", err)
+	}
+	return &a, nil
+}
+
+// Returns the key failures against a login name count towards, and the
+// account it belongs to if there is one. Names of accounts that do not
+// exist are limited the same way, so limits do not reveal which exist.
+func (l *LoginLimiter) accountKey(ctx context.Context, emailOrUsername string) (string, *Account, error) {
+	a, err := l.accounts(ctx, emailOrUsername)
+	if err != nil {
+		return "", nil, err
+	}
+	if a == nil {
+		return "login:" + strings.ToLower(strings.TrimSpace(emailOrUsername)), nil, nil
+	}
+	return "account:" + strconv.Itoa(a.ID), a, nil
+}
+
+// Delay required after the nth failure within the window
+func loginDelay(failures int) time.Duration {
+	if failures < accountFreeAttempts {
+		return 0
+	}
+	delay := time.Second << min(failures-accountFreeAttempts, 10)
+	return min(delay, maxLoginDelay)
+}
+
+// Lets a login from clientIP to the account through, or returns a
+// *loginLimitError if it is not allowed yet. The attempt counts as failed
+// from here on; pass it to Succeed, Fail or Release once the outcome is
+// known.
+func (l *LoginLimiter) Check(ctx context.Context, clientIP string, emailOrUsername string) (*loginAttempt, error) {
+	now := l.now()
+	attempt := &loginAttempt{ipKey: ipKey(clientIP), clientIP: clientIP, at: now}
+	err := l.store.Reserve(ctx, attempt.ipKey, now, now.Add(-loginLimitWindow), func(ip AttemptWindow) error {
+		if ip.Count >= ipLoginLimit {
+			return &loginLimitError{RetryAfter: ip.Oldest.Add(loginLimitWindow).Sub(now)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	attempt.key, attempt.account, err = l.accountKey(ctx, emailOrUsername)
+	if err == nil {
+		err = l.store.Reserve(ctx, attempt.key, now, now.Add(-loginLimitWindow), func(failures AttemptWindow) error {
+			if wait := failures.Newest.Add(loginDelay(failures.Count)).Sub(now); failures.Count > 0 && wait > 0 {
+				return &loginLimitError{RetryAfter: wait}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		l.removeAttempt(ctx, attempt.ipKey, now)
+		return nil, err
+	}
+	// Checked after the reservation, so that a lockout set by a parallel
+	// failure is seen either here or by that failure's count
+	lock, err := l.store.Window(ctx, "lock:"+attempt.key, now.Add(-lockoutDuration))
+	if err == nil && lock.Count > 0 {
+		err = &loginLimitError{RetryAfter: lock.Newest.Add(lockoutDuration).Sub(now), Locked: true}
+	}
+	if err != nil {
+		l.Release(ctx, attempt)
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// Keeps an attempt as a failed login. Locks the account once it reaches
+// the lockout limit and mails its owner.
+func (l *LoginLimiter) Fail(ctx context.Context, attempt *loginAttempt) error {
+	now := l.now()
+	failures, err := l.store.Window(ctx, attempt.key, now.Add(-loginLimitWindow))
+	if err != nil {
+		return err
+	}
+	if failures.Count < accountLockoutLimit {
+		return nil
+	}
+	// Only one of several failures reaching the limit at once locks
+	err = l.store.Reserve(ctx, "lock:"+attempt.key, now, now.Add(-lockoutDuration), func(lock AttemptWindow) error {
+		if lock.Count > 0 {
+			return errAlreadyLocked
+		}
+		return nil
+	})
+	if errors.Is(err, errAlreadyLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The failures led to this lockout; the next ones start from scratch
+	err = l.store.Clear(ctx, attempt.key)
+	if err != nil {
+		return err
+	}
+	if attempt.account != nil {
+		l.notifyLockout(attempt.account, attempt.clientIP)
+	}
+	return nil
+}
+
+// Counts a password reset request from clientIP. Returns a *throttleError
+// if the IP already asked for too many within the window.
+func (l *LoginLimiter) CheckPasswordReset(ctx context.Context, clientIP string) error {
+	now := l.now()
+	key := "reset:" + ipKey(clientIP)
+	return l.store.Reserve(ctx, key, now, now.Add(-loginLimitWindow), func(requests AttemptWindow) error {
+		if requests.Count >= ipResetLimit {
+			return &throttleError{RetryAfter: requests.Oldest.Add(loginLimitWindow).Sub(now)}
+		}
+		return nil
+	})
+}
+
+// Forgets the failures against an account after a successful login, and
+// takes the attempt off the IP's count
+func (l *LoginLimiter) Succeed(ctx context.Context, attempt *loginAttempt) error {
+	l.removeAttempt(ctx, attempt.ipKey, attempt.at)
+	return l.store.Clear(ctx, attempt.key)
+}
+
+// Takes back an attempt that was neither a success nor a failure, such as
+// a right password that still needs a two-factor code
+func (l *LoginLimiter) Release(ctx context.Context, attempt *loginAttempt) {
+	l.removeAttempt(ctx, attempt.ipKey, attempt.at)
+	l.removeAttempt(ctx, attempt.key, attempt.at)
+}
+
+// Failures are only logged; the attempt then runs out with the window
+func (l *LoginLimiter) removeAttempt(ctx context.Context, key string, t time.Time) {
+	err := l.store.Remove(ctx, key, t)
+	if err != nil {
+		log.Printf("error removing login attempt: %v\n", err)
+	}
+}
+
+func (l *LoginLimiter) notifyLockout(account *Account, clientIP string) {
+	msg := Message{
+		To:      account.Email,
+		Subject: "Your disco account was locked",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"There were %d failed attempts to log in to your disco account, the last\n"+
+			"one from %s, so logging in is blocked for the next %d minutes.\n\n"+
+			"If this wasn't you, consider changing your password once the lock ends.\n",
+			account.Username, accountLockoutLimit, strings.TrimPrefix(ipKey(clientIP), "ip:"),
+			int(lockoutDuration.Minutes())),
+	}
+	go func() {
+		err := l.mailer.Send(msg)
+		if err != nil {
+			log.Printf("error sending lockout mail to account %d: %v\n", account.ID, err)
+		}
+	}()
+}
+
+// Forgets old attempts every interval until ctx is done
+func (l *LoginLimiter) StartPurge(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := l.store.Purge(ctx, l.now().Add(-max(loginLimitWindow, lockoutDuration)))
+			if err != nil {
+				log.Printf("error purging login attempts: %v\n", err)
+			}
+		}
+	}()
+}
+
+//////////////
+// MEMORY STORE
+
+func (s *MemoryLimiterStore) Add(ctx context.Context, key string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[key] = append(s.attempts[key], t)
+	return nil
+}
+
+func (s *MemoryLimiterStore) Reserve(ctx context.Context, key string, t time.Time, since time.Time,
+	allow func(AttemptWindow) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := allow(s.window(key, since))
+	if err != nil {
+		return err
+	}
+	s.attempts[key] = append(s.attempts[key], t)
+	return nil
+}
+
+func (s *MemoryLimiterStore) Window(ctx context.Context, key string, since time.Time) (AttemptWindow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.window(key, since), nil
+}
+
+// Called with s.mu held
+func (s *MemoryLimiterStore) window(key string, since time.Time) AttemptWindow {
+	var window AttemptWindow
+	for _, t := range s.attempts[key] {
+		if !t.After(since) {
+			continue
+		}
+		if window.Count == 0 || t.Before(window.Oldest) {
+			window.Oldest = t
+		}
+		if t.After(window.Newest) {
+			window.Newest = t
+		}
+		window.Count++
+	}
+	return window
+}
+
+func (s *MemoryLimiterStore) Remove(ctx context.Context, key string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	times := s.attempts[key]
+	for i, attempted := range times {
+		if attempted.Equal(t) {
+			s.attempts[key] = append(times[:i], times[i+1:]...)
+			break
+		}
+	}
+	if len(s.attempts[key]) == 0 {
+		delete(s.attempts, key)
+	}
+	return nil
+}
+
+func (s *MemoryLimiterStore) Clear(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLimiterStore) Purge(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, times := range s.attempts {
+		kept := times[:0]
+		for _, t := range times {
+			if t.After(before) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.attempts, key)
+		} else {
+			s.attempts[key] = kept
+		}
+	}
+	return nil
+}
+
+////////////////
+// POSTGRES STORE
+
+func (s *PostgresLimiterStore) Add(ctx context.Context, key string, t time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`INSERT INTO login_attempts (key, attempted) VALUES($1, $2)`, key, t)
+	if err != nil {
+		return fmt.Errorf("error inserting login attempt: %w", err)
+	}
+	return nil
+}
+
+// Holds a transaction-wide advisory lock on the key, so that
+// reservations from every instance take turns
+func (s *PostgresLimiterStore) Reserve(ctx context.Context, key string, t time.Time, since time.Time,
+	allow func(AttemptWindow) error) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+	if err != nil {
+		return fmt.Errorf("error locking login attempts: %w", err)
+	}
+	window, err := scanAttemptWindow(tx.QueryRow(ctx, attemptWindowQuery, key, since))
+	if err != nil {
+		return err
+	}
+	err = allow(window)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO login_attempts (key, attempted) VALUES($1, $2)`, key, t)
+	if err != nil {
+		return fmt.Errorf("error inserting login attempt: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+const attemptWindowQuery = `SELECT COUNT(*), MIN(attempted), MAX(attempted) FROM login_attempts
+	WHERE key=$1 AND attempted > $2`
+
+func scanAttemptWindow(row pgx.Row) (AttemptWindow, error) {
+	var window AttemptWindow
+	var oldest, newest pgtype.Timestamptz
+	err := row.Scan(&window.Count, &oldest, &newest)
+	if err != nil {
+		return window, fmt.Errorf("error counting login attempts: %w", err)
+	}
+	window.Oldest = oldest.Time
+	window.Newest = newest.Time
+	return window, nil
+}
+
+func (s *PostgresLimiterStore) Window(ctx context.Context, key string, since time.Time) (AttemptWindow, error) {
+	return scanAttemptWindow(s.db.QueryRow(ctx, attemptWindowQuery, key, since))
+}
+
+func (s *PostgresLimiterStore) Remove(ctx context.Context, key string, t time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`DELETE FROM login_attempts WHERE ctid IN (
+		   SELECT ctid FROM login_attempts WHERE key=$1 AND attempted=$2 LIMIT 1)`, key, t)
+	if err != nil {
+		return fmt.Errorf("error deleting login attempt: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresLimiterStore) Clear(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM login_attempts WHERE key=$1`, key)
+	if err != nil {
+		return fmt.Errorf("error deleting login attempts: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresLimiterStore) Purge(ctx context.Context, before time.Time) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM login_attempts WHERE attempted <= $1`, before)
+	if err != nil {
+		return fmt.Errorf("error purging login attempts: %w", err)
+	}
+	return nil
+}
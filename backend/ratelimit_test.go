@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects the messages it is asked to send
+type recordingMailer struct {
+	sent chan Message
+}
+
+func (m *recordingMailer) Send(msg Message) error {
+	m.sent <- msg
+	return nil
+}
+
+// Returns a limiter on the memory store with a clock the test moves. The
+// only account is alice.
+func newTestLimiter() (*LoginLimiter, *time.Time) {
+	now := time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+	accounts := func(ctx context.Context, name string) (*Account, error) {
+		if name == "alice" || name == "alice@example.com" {
+			return &Account{ID: 1, Username: "alice", Email: "alice@example.com"}, nil
+		}
+		return nil, nil
+	}
+	l := &LoginLimiter{store: NewMemoryLimiterStore(), accounts: accounts,
+		mailer: &recordingMailer{sent: make(chan Message, 4)}, now: func() time.Time { return now }}
+	return l, &now
+}
+
+// Checks a login and records it as failed
+func failLogin(t *testing.T, l *LoginLimiter, clientIP string, name string) {
+	t.Helper()
+	ctx := context.Background()
+	attempt, err := l.Check(ctx, clientIP, name)
+	if err != nil {
+		t.Fatalf("login was limited: %v", err)
+	}
+	if err := l.Fail(ctx, attempt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		0:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		5:  4 * time.Second,
+		8:  32 * time.Second,
+		9:  maxLoginDelay,
+		40: maxLoginDelay,
+	} {
+		if got := loginDelay(failures); got != want {
+			t.Errorf("loginDelay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestCheckDelaySchedule(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+	var limited *loginLimitError
+	for failures := 0; failures < accountLockoutLimit-1; failures++ {
+		if wait := loginDelay(failures); wait > 0 {
+			_, err := l.Check(ctx, "10.0.0.1", "alice")
+			if !errors.As(err, &limited) || limited.RetryAfter != wait || limited.Locked {
+				t.Fatalf("after %d failures: %v, want a wait of %v", failures, err, wait)
+			}
+			*now = now.Add(wait)
+		}
+		failLogin(t, l, "10.0.0.1", "alice")
+	}
+	// The delay counts from the last failure, not from the turned away
+	// attempt
+	*now = now.Add(time.Second)
+	_, err := l.Check(ctx, "10.0.0.1", "alice")
+	if want := loginDelay(accountLockoutLimit-1) - time.Second; !errors.As(err, &limited) || limited.RetryAfter != want {
+		t.Errorf("check during the delay = %v, want a wait of %v", err, want)
+	}
+	// Unknown names are limited the same way
+	for range accountFreeAttempts {
+		failLogin(t, l, "10.0.0.2", "nobody")
+	}
+	if _, err := l.Check(ctx, "10.0.0.3", "NOBODY "); !errors.As(err, &limited) {
+		t.Errorf("unknown name after %d failures = %v, want a wait", accountFreeAttempts, err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+	for range accountLockoutLimit {
+		failLogin(t, l, "10.0.0.1", "alice")
+		*now = now.Add(maxLoginDelay)
+	}
+	select {
+	case msg := <-l.mailer.(*recordingMailer).sent:
+		if msg.To != "alice@example.com" {
+			t.Errorf("lockout mail went to %s", msg.To)
+		}
+	case <-time.After(time.Second):
+		t.Error("no lockout mail was sent")
+	}
+
+	var limited *loginLimitError
+	_, err := l.Check(ctx, "10.0.0.2", "alice@example.com")
+	if want := lockoutDuration - maxLoginDelay; !errors.As(err, &limited) || !limited.Locked || limited.RetryAfter != want {
+		t.Fatalf("check on a locked account = %v, want a lock for %v", err, want)
+	}
+	// A turned away login does not extend the lock
+	*now = now.Add(lockoutDuration - maxLoginDelay)
+	attempt, err := l.Check(ctx, "10.0.0.2", "alice")
+	if err != nil {
+		t.Fatalf("check after the lock ran out = %v", err)
+	}
+	// Failures start from scratch after a lock
+	l.Fail(ctx, attempt)
+	if _, err := l.Check(ctx, "10.0.0.2", "alice"); err != nil {
+		t.Errorf("check after one failure past the lock = %v", err)
+	}
+}
+
+func TestSucceedClearsFailures(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+	for range accountFreeAttempts {
+		failLogin(t, l, "10.0.0.1", "alice")
+	}
+	*now = now.Add(loginDelay(accountFreeAttempts))
+	attempt, err := l.Check(ctx, "10.0.0.1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Succeed(ctx, attempt); err != nil {
+		t.Fatal(err)
+	}
+	for range accountFreeAttempts {
+		failLogin(t, l, "10.0.0.1", "alice")
+	}
+	ip, _ := l.store.Window(ctx, ipKey("10.0.0.1"), now.Add(-loginLimitWindow))
+	if want := 2 * accountFreeAttempts; ip.Count != want {
+		t.Errorf("IP has %d attempts, want the %d failures only", ip.Count, want)
+	}
+
+	// A released attempt counts for neither
+	attempt, err = l.Check(ctx, "10.0.0.4", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Release(ctx, attempt)
+	for _, key := range []string{ipKey("10.0.0.4"), "login:nobody"} {
+		if w, _ := l.store.Window(ctx, key, now.Add(-loginLimitWindow)); w.Count != 0 {
+			t.Errorf("%s has %d attempts after a release", key, w.Count)
+		}
+	}
+}
+
+// Parallel logins reserve their attempt before any password is hashed, so
+// they cannot all get past the limits at once
+func TestCheckConcurrent(t *testing.T) {
+	l, _ := newTestLimiter()
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var passedAccount, passedIP int
+	for i := range 3 * ipLoginLimit {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := l.Check(ctx, "10.0.0.1", "alice"); err == nil {
+				mu.Lock()
+				passedAccount++
+				mu.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := l.Check(ctx, "10.0.0.2", "user"+strconv.Itoa(i)); err == nil {
+				mu.Lock()
+				passedIP++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if passedAccount != accountFreeAttempts {
+		t.Errorf("%d parallel logins to one account got through, want %d", passedAccount, accountFreeAttempts)
+	}
+	if passedIP != ipLoginLimit {
+		t.Errorf("%d parallel logins from one IP got through, want %d", passedIP, ipLoginLimit)
+	}
+}
+
+func TestLoginLimitRetryAfter(t *testing.T) {
+	l, now := newTestLimiter()
+	h := &AuthMiddleware{limiter: l}
+	for range accountFreeAttempts + 1 {
+		failLogin(t, l, "10.0.0.1", "alice")
+		*now = now.Add(maxLoginDelay)
+	}
+	*now = now.Add(-maxLoginDelay + 500*time.Millisecond)
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "clientip", "10.0.0.1:4321"))
+	w := httptest.NewRecorder()
+	if _, ok := h.checkLoginLimit(w, r, "alice"); ok {
+		t.Fatal("limited login was let through")
+	}
+	// 2 seconds after the fourth failure, half a second of it gone
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("got %d with Retry-After %q, want 429 and 2", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestCheckPasswordReset(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+	for i := range ipResetLimit {
+		if err := l.CheckPasswordReset(ctx, "10.0.0.1:1234"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		*now = now.Add(time.Second)
+	}
+	var throttled *throttleError
+	err := l.CheckPasswordReset(ctx, "10.0.0.1:5678")
+	if !errors.As(err, &throttled) {
+		t.Fatalf("request over the limit = %v, want a throttle error", err)
+	}
+	if want := loginLimitWindow - ipResetLimit*time.Second; throttled.RetryAfter != want {
+		t.Errorf("retry after %v, want %v", throttled.RetryAfter, want)
+	}
+	if err := l.CheckPasswordReset(ctx, "10.0.0.2:1234"); err != nil {
+		t.Errorf("another IP was throttled: %v", err)
+	}
+	// Requests over the limit are not counted, so the first one to leave
+	// the window makes room again
+	*now = now.Add(throttled.RetryAfter + time.Millisecond)
+	if err := l.CheckPasswordReset(ctx, "10.0.0.1:1234"); err != nil {
+		t.Errorf("request after the window = %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+///////////
+// TYPES
+
+// Refresh tokens are single-use. Every refresh replaces the token with a
+// new one from the same family, which starts at login. Presenting a token
+// that was already replaced means it was copied, so the whole family is
+// revoked and whoever holds it has to log in again.
+
+const (
+	// A replaced token is still accepted this long after its refresh, for
+	// concurrent requests that were sent with the same cookie
+	refreshReuseGrace = 10 * time.Second
+	// How often expired refresh tokens are removed
+	refreshPurgeInterval = time.Hour
+)
+
+var (
+	errInvalidRefreshToken = errors.New("token has been invalidated")
+	errRefreshTokenReused  = errors.New("token was already used, family revoked")
+)
+
+/////////////
+// HELPERS
+
+// Longest user agent stored for a session
+const maxUserAgentLength = 512
+
+// Returns the user agent and client IP recorded for a session
+func sessionDetails(r *http.Request) (string, string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	clientIP, _ := r.Context().Value("clientip").(string)
+	return userAgent, clientIP
+}
+
+// Signs a refresh token for the account. The random ID keeps two tokens
+// issued within the same second apart.
+func (h *AuthMiddleware) newRefreshCookie(userid int, username string) (*http.Cookie, error) {
+	id, err := GenerateToken(16)
+	if err != nil {
+		return nil, err
+	}
+	refreshClaims := &Claims{
+		UserID:   userid,
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshTokenExpiration)),
+		},
+	}
+	refreshTokenString, err := h.refreshKeys.Sign(refreshClaims)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Cookie{
+		Name:     "refresh",
+		Value:    refreshTokenString,
+		Path:     "/",
+		Expires:  refreshClaims.ExpiresAt.Time,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	}, nil
+}
+
+////////////
+// CREATE
+
+// Generates refresh token in the form of a cookie and stores its hash in the
+// database as the start of a new family, which is the session of the login
+func (h *AuthMiddleware) GenerateRefreshCookie(r *http.Request, userid int, username string) (*http.Cookie, error) {
+	refreshCookie, err := h.newRefreshCookie(userid, username)
+	if err != nil {
+		return nil, err
+	}
+	userAgent, clientIP := sessionDetails(r)
+	_, err = h.db.Exec(context.Background(),
+		`INSERT INTO refreshtokens (account_id, token_hash, expires, user_agent, client_ip)
+		 VALUES($1, $2, $3, $4, $5)`,
+		userid, hashToken(refreshCookie.Value), refreshCookie.Expires, userAgent, clientIP)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting refresh token: %w", err)
+	}
+	return refreshCookie, nil
+}
+
+////////////
+// UPDATE
+
+// Uses up a refresh token and returns its replacement. Returns a nil cookie
+// without error when the token was replaced moments ago by a concurrent
+// request, in which case the caller keeps the cookie that request set.
+func (h *AuthMiddleware) RotateRefreshToken(r *http.Request, tokenString string, claims *Claims) (*http.Cookie, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var family int
+	var created time.Time
+	var used pgtype.Timestamptz
+	var username string
+	err = tx.QueryRow(ctx,
+		`SELECT t.family, t.created, t.used, a.username
+		 FROM refreshtokens t JOIN accounts a ON a.id = t.account_id
+		 WHERE t.token_hash=$1 AND t.account_id=$2
+		 FOR UPDATE OF t`, hashToken(tokenString), claims.UserID).Scan(&family, &created, &used, &username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying refresh token: %w", err)
+	}
+	if used.Valid {
+		if time.Since(used.Time) < refreshReuseGrace {
+			return nil, nil
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM refreshtokens WHERE family=$1`, family)
+		if err != nil {
+			return nil, fmt.Errorf("error revoking token family: %w", err)
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error committing transaction: %w", err)
+		}
+		return nil, errRefreshTokenReused
+	}
+	// The replacement carries the current username, which may have changed
+	claims.Username = username
+	refreshCookie, err := h.newRefreshCookie(claims.UserID, claims.Username)
+	if err != nil {
+		return nil, fmt.Errorf("error generating refresh token: %w", err)
+	}
+	// The used token is kept until it expires so that reuse can be detected
+	_, err = tx.Exec(ctx,
+		`UPDATE refreshtokens SET used=NOW() WHERE token_hash=$1`, hashToken(tokenString))
+	if err != nil {
+		return nil, fmt.Errorf("error using refresh token: %w", err)
+	}
+	// The session keeps the time of its login
+	userAgent, clientIP := sessionDetails(r)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO refreshtokens (account_id, family, token_hash, expires, user_agent, client_ip, created)
+		 VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		claims.UserID, family, hashToken(refreshCookie.Value), refreshCookie.Expires, userAgent, clientIP, created)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting refresh token: %w", err)
+	}
+	return refreshCookie, tx.Commit(ctx)
+}
+
+////////////
+// DELETE
+
+// Revokes the family of a refresh token, logging out its session
+func (h *AuthMiddleware) RevokeRefreshToken(tokenString string) error {
+	_, err := h.db.Exec(context.Background(),
+		`DELETE FROM refreshtokens WHERE family IN (
+		 SELECT family FROM refreshtokens WHERE token_hash=$1)`, hashToken(tokenString))
+	if err != nil {
+		return fmt.Errorf("error revoking refresh token: %w", err)
+	}
+	return nil
+}
+
+// Deletes refresh tokens that have expired
+func (h *AuthMiddleware) PurgeRefreshTokens() (int64, error) {
+	tag, err := h.db.Exec(context.Background(),
+		`DELETE FROM refreshtokens WHERE expires < NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("error purging refresh tokens: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Purges expired refresh tokens every interval until ctx is done
+func (h *AuthMiddleware) StartRefreshTokenPurge(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := h.PurgeRefreshTokens()
+			if err != nil {
+				log.Printf("%v\n", err)
+			} else if purged > 0 {
+				log.Printf("purged %d expired refresh tokens\n", purged)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
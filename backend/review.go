@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Per-account scheduling state of a single card
+type CardState struct {
+	AccountID    int                `json:"account_id"`
+	CardID       int                `json:"card_id"`
+	Ease         float64            `json:"ease"`
+	Interval     int                `json:"interval"`
+	Repetitions  int                `json:"repetitions"`
+	Lapses       int                `json:"lapses"`
+	Stability    float64            `json:"stability"`
+	Difficulty   float64            `json:"difficulty"`
+	State        string             `json:"state"`
+	Due          time.Time          `json:"due"`
+	Introduced   time.Time          `json:"introduced"`
+	LastReviewed pgtype.Timestamptz `json:"last_reviewed"`
+}
+
+// An entry of the review log
+type Review struct {
+	ID           int         `json:"id"`
+	AccountID    int         `json:"account_id"`
+	CardID       int         `json:"card_id"`
+	Grade        int         `json:"grade"`
+	DurationMS   pgtype.Int4 `json:"duration_ms"`
+	PrevInterval int         `json:"prev_interval"`
+	NewInterval  int         `json:"new_interval"`
+	Reviewed     time.Time   `json:"reviewed"`
+}
+
+type ReviewData struct {
+	Grade      *int `json:"grade"`
+	DurationMS *int `json:"duration_ms"`
+}
+
+type ReviewHandler struct {
+	db         *pgxpool.Pool
+	authorizer *Authorizer
+}
+
+func NewReviewHandler(db *pgxpool.Pool, authorizer *Authorizer) *ReviewHandler {
+	return &ReviewHandler{db: db, authorizer: authorizer}
+}
+
+const (
+	minGrade    = 0
+	maxGrade    = 5
+	defaultEase = 2.5
+	minEase     = 1.3
+)
+
+// Learning states of a card
+const (
+	CardStateNew        = "new"
+	CardStateLearning   = "learning"
+	CardStateReview     = "review"
+	CardStateRelearning = "relearning"
+)
+
+var errCardNotFound = errors.New("card does not exist")
+
+////////////
+// ROUTES
+
+var (
+	CardReviewRE  = regexp.MustCompile(`^\/cards\/(\d+)\/review\/?$`)
+	CardHistoryRE = regexp.MustCompile(`^\/cards\/(\d+)\/history\/?$`)
+)
+
+func (h *ReviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// REVIEW CARD ROUTE
+	case CardReviewRE.MatchString(url) && r.Method == http.MethodPost:
+		groups := CardReviewRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			http.Error(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		cardID, err := strconv.Atoi(groups[1])
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireCard(w, r, cardID, PermissionRead) {
+			return
+		}
+		var data ReviewData
+		defer r.Body.Close()
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error reading body for %s: %v\n", clientIP, err)
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(bytes, &data)
+		if err != nil {
+			log.Printf("error unmarshalling json for %s: %v\n", clientIP, err)
+			http.Error(w, "error unmarshalling json", http.StatusBadRequest)
+			return
+		}
+		if data.Grade == nil || *data.Grade < minGrade || *data.Grade > maxGrade {
+			http.Error(w, "grade must be between 0 and 5", http.StatusBadRequest)
+			return
+		}
+		if data.DurationMS != nil && *data.DurationMS < 0 {
+			http.Error(w, "duration_ms must not be negative", http.StatusBadRequest)
+			return
+		}
+		state, err := h.ReviewCard(claims.UserID, cardID, *data.Grade, data.DurationMS, time.Now())
+		if errors.Is(err, errCardNotFound) {
+			http.Error(w, "card not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error reviewing card for %s: %v\n", clientIP, err)
+			http.Error(w, "error reviewing card", http.StatusInternalServerError)
+			return
+		}
+		responseBytes, err := json.Marshal(state)
+		if err != nil {
+			http.Error(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseBytes)
+		return
+
+	// CARD HISTORY ROUTE
+	case CardHistoryRE.MatchString(url) && r.Method == http.MethodGet:
+		groups := CardHistoryRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			http.Error(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		cardID, err := strconv.Atoi(groups[1])
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireCard(w, r, cardID, PermissionRead) {
+			return
+		}
+		history, err := h.GetCardHistory(claims.UserID, cardID)
+		if errors.Is(err, errCardNotFound) {
+			http.Error(w, "card not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error getting card history for %s: %v\n", clientIP, err)
+			http.Error(w, "error getting card history", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(history)
+		if err != nil {
+			http.Error(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+///////////////
+// SCHEDULING
+
+// Returns the state of a card that has never been reviewed
+func NewCardState(accountID int, cardID int, now time.Time) CardState {
+	return CardState{
+		AccountID:  accountID,
+		CardID:     cardID,
+		Ease:       defaultEase,
+		State:      CardStateNew,
+		Due:        now,
+		Introduced: now,
+	}
+}
+
+////////////
+// UPDATE
+
+// Records a review of a card by an account and returns the updated state.
+// durationMS is the time taken to answer and may be nil.
+func (h *ReviewHandler) ReviewCard(accountID int, cardID int, grade int, durationMS *int, now time.Time) (*CardState, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Get the algorithm chosen for the card's set
+	var algorithm string
+	err = tx.QueryRow(ctx,
+		`SELECT s.algorithm FROM cards c
+		 JOIN sets s ON s.id = c.set_id
+		 WHERE c.id=$1`, cardID).Scan(&algorithm)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errCardNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying card: %w", err)
+	}
+	scheduler, err := GetScheduler(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := getCardStateForUpdate(ctx, tx, accountID, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		s := NewCardState(accountID, cardID, now)
+		state = &s
+	}
+	next := scheduler.Schedule(*state, grade, now)
+
+	// Log the answer so the state can be rebuilt with any algorithm
+	_, err = tx.Exec(ctx,
+		`INSERT INTO reviews
+		 (account_id, card_id, grade, duration_ms, prev_interval, new_interval, reviewed)
+		 VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		accountID, cardID, grade, durationMS, state.Interval, next.Interval, now)
+	if err != nil {
+		return nil, fmt.Errorf("error logging review: %w", err)
+	}
+	err = saveCardState(ctx, tx, next)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return &next, nil
+}
+
+// Inserts or replaces the state of a card for an account
+func saveCardState(ctx context.Context, tx pgx.Tx, state CardState) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO card_states
+		 (account_id, card_id, ease, interval, repetitions, lapses, stability,
+		  difficulty, state, due, introduced, last_reviewed)
+		 VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		 ON CONFLICT (account_id, card_id) DO UPDATE
+		 SET ease=EXCLUDED.ease, interval=EXCLUDED.interval,
+		     repetitions=EXCLUDED.repetitions, lapses=EXCLUDED.lapses,
+		     stability=EXCLUDED.stability, difficulty=EXCLUDED.difficulty,
+		     state=EXCLUDED.state, due=EXCLUDED.due,
+		     last_reviewed=EXCLUDED.last_reviewed`,
+		state.AccountID, state.CardID, state.Ease, state.Interval, state.Repetitions,
+		state.Lapses, state.Stability, state.Difficulty, state.State, state.Due,
+		state.Introduced, state.LastReviewed)
+	if err != nil {
+		return fmt.Errorf("error saving card state: %w", err)
+	}
+	return nil
+}
+
+//////////
+// READ
+
+// Locks and returns the state of a card for an account, or nil if the card has not been reviewed
+func getCardStateForUpdate(ctx context.Context, tx pgx.Tx, accountID int, cardID int) (*CardState, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT account_id, card_id, ease, interval, repetitions, lapses,
+		        stability, difficulty, state, due, introduced, last_reviewed
+		 FROM card_states WHERE account_id=$1 AND card_id=$2
+		 FOR UPDATE`, accountID, cardID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying card state: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var s CardState
+	err = rows.Scan(&s.AccountID, &s.CardID, &s.Ease, &s.Interval, &s.Repetitions,
+		&s.Lapses, &s.Stability, &s.Difficulty, &s.State, &s.Due, &s.Introduced, &s.LastReviewed)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning row: %w", err)
+	}
+	return &s, nil
+}
+
+// Returns every review of a card by an account, oldest first
+func (h *ReviewHandler) GetCardHistory(accountID int, cardID int) ([]Review, error) {
+	var exists bool
+	err := h.db.QueryRow(context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM cards WHERE id=$1)`, cardID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("error querying card: %w", err)
+	}
+	if !exists {
+		return nil, errCardNotFound
+	}
+	rows, err := h.db.Query(context.Background(),
+		`SELECT id, account_id, card_id, grade, duration_ms,
+		        prev_interval, new_interval, reviewed
+		 FROM reviews WHERE account_id=$1 AND card_id=$2
+		 ORDER BY reviewed ASC, id ASC`, accountID, cardID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying reviews: %w", err)
+	}
+	defer rows.Close()
+	history := []Review{}
+	for rows.Next() {
+		var r Review
+		err := rows.Scan(&r.ID, &r.AccountID, &r.CardID, &r.Grade, &r.DurationMS,
+			&r.PrevInterval, &r.NewInterval, &r.Reviewed)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		history = append(history, r)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// A spaced repetition algorithm. Schedule takes the current state of a card
+// and a 0-5 grade and returns the state after the review; it must depend only
+// on its arguments so that states can be rebuilt by replaying the review log.
+type Scheduler interface {
+	Name() string
+	Schedule(state CardState, grade int, now time.Time) CardState
+}
+
+// A single entry of the review log, independent of the algorithm in use
+type ReviewLog struct {
+	Grade    int
+	Reviewed time.Time
+}
+
+const DefaultAlgorithm = "sm2"
+
+var schedulers = map[string]Scheduler{
+	"sm2":     SM2Scheduler{},
+	"fsrs":    NewFSRSScheduler(DefaultFSRSWeights, 0.9),
+	"leitner": LeitnerScheduler{Intervals: DefaultLeitnerIntervals},
+}
+
+// Returns the scheduler registered under the given name
+func GetScheduler(name string) (Scheduler, error) {
+	s, ok := schedulers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", name)
+	}
+	return s, nil
+}
+
+// Rebuilds the state of a card by replaying its review log, oldest first.
+// The state keeps the given introduction time, or takes the first review's
+// if it is zero. Returns nil if the card has never been reviewed.
+func ReplayReviews(s Scheduler, accountID int, cardID int, introduced time.Time, logs []ReviewLog) *CardState {
+	if len(logs) == 0 {
+		return nil
+	}
+	state := NewCardState(accountID, cardID, logs[0].Reviewed)
+	if !introduced.IsZero() {
+		state.Introduced = introduced
+	}
+	for _, l := range logs {
+		state = s.Schedule(state, l.Grade, l.Reviewed)
+	}
+	return &state
+}
+
+// Moves a card between learning states after a pass or a fail and
+// stamps the review time. Shared by every scheduler.
+func advanceState(state CardState, passed bool, now time.Time) CardState {
+	if passed {
+		state.State = CardStateReview
+	} else {
+		switch state.State {
+		case CardStateReview:
+			state.Lapses++
+			state.State = CardStateRelearning
+		case CardStateRelearning:
+		default:
+			state.State = CardStateLearning
+		}
+	}
+	state.LastReviewed = pgtype.Timestamptz{Time: now, Valid: true}
+	return state
+}
+
+//////////
+// SM-2
+
+type SM2Scheduler struct{}
+
+func (SM2Scheduler) Name() string { return "sm2" }
+
+// Applies a 0-5 grade using the SuperMemo SM-2 algorithm.
+// Grades below 3 reset the repetition count; the ease factor is adjusted
+// after every review and never drops below 1.3.
+func (SM2Scheduler) Schedule(state CardState, grade int, now time.Time) CardState {
+	passed := grade >= 3
+	if passed {
+		switch state.Repetitions {
+		case 0:
+			state.Interval = 1
+		case 1:
+			state.Interval = 6
+		default:
+			state.Interval = int(math.Round(float64(state.Interval) * state.Ease))
+		}
+		state.Repetitions++
+	} else {
+		state.Repetitions = 0
+		state.Interval = 1
+	}
+	q := float64(maxGrade - grade)
+	state.Ease += 0.1 - q*(0.08+q*0.02)
+	if state.Ease < minEase {
+		state.Ease = minEase
+	}
+	state.Due = now.AddDate(0, 0, state.Interval)
+	return advanceState(state, passed, now)
+}
+
+/////////////
+// LEITNER
+
+// Interval in days for each box, starting with box 1
+var DefaultLeitnerIntervals = []int{1, 2, 4, 8, 16}
+
+// Leitner box system. The box a card is in is stored in Repetitions: a
+// passing grade moves the card up one box and a failing grade sends it
+// back to the first box.
+type LeitnerScheduler struct {
+	Intervals []int
+}
+
+func (LeitnerScheduler) Name() string { return "leitner" }
+
+func (s LeitnerScheduler) Schedule(state CardState, grade int, now time.Time) CardState {
+	passed := grade >= 3
+	if passed {
+		state.Repetitions = min(state.Repetitions+1, len(s.Intervals))
+	} else {
+		state.Repetitions = 1
+	}
+	state.Interval = s.Intervals[state.Repetitions-1]
+	state.Due = now.AddDate(0, 0, state.Interval)
+	return advanceState(state, passed, now)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+
+func days(n int) time.Time {
+	return testStart.AddDate(0, 0, n)
+}
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+// One review and the state expected after it
+type reviewStep struct {
+	grade      int
+	day        int
+	interval   int
+	ease       float64
+	reps       int
+	lapses     int
+	state      string
+	stability  float64
+	difficulty float64
+}
+
+func runSteps(t *testing.T, s Scheduler, steps []reviewStep) {
+	t.Helper()
+	state := NewCardState(1, 1, testStart)
+	for i, step := range steps {
+		now := days(step.day)
+		state = s.Schedule(state, step.grade, now)
+		if state.Interval != step.interval {
+			t.Errorf("step %d: interval = %d, want %d", i, state.Interval, step.interval)
+		}
+		if !state.Due.Equal(now.AddDate(0, 0, step.interval)) {
+			t.Errorf("step %d: due = %v, want %d days after the review", i, state.Due, step.interval)
+		}
+		if step.ease != 0 && !approx(state.Ease, step.ease) {
+			t.Errorf("step %d: ease = %v, want %v", i, state.Ease, step.ease)
+		}
+		if step.stability != 0 && !approx(state.Stability, step.stability) {
+			t.Errorf("step %d: stability = %v, want %v", i, state.Stability, step.stability)
+		}
+		if step.difficulty != 0 && !approx(state.Difficulty, step.difficulty) {
+			t.Errorf("step %d: difficulty = %v, want %v", i, state.Difficulty, step.difficulty)
+		}
+		if state.Repetitions != step.reps {
+			t.Errorf("step %d: repetitions = %d, want %d", i, state.Repetitions, step.reps)
+		}
+		if state.Lapses != step.lapses {
+			t.Errorf("step %d: lapses = %d, want %d", i, state.Lapses, step.lapses)
+		}
+		if state.State != step.state {
+			t.Errorf("step %d: state = %q, want %q", i, state.State, step.state)
+		}
+		if !state.LastReviewed.Valid || !state.LastReviewed.Time.Equal(now) {
+			t.Errorf("step %d: last reviewed = %v, want %v", i, state.LastReviewed, now)
+		}
+	}
+}
+
+func TestSM2Schedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []reviewStep
+	}{
+		{"perfect answers", []reviewStep{
+			{grade: 5, day: 0, interval: 1, ease: 2.6, reps: 1, state: CardStateReview},
+			{grade: 5, day: 1, interval: 6, ease: 2.7, reps: 2, state: CardStateReview},
+			{grade: 5, day: 7, interval: 16, ease: 2.8, reps: 3, state: CardStateReview},
+		}},
+		{"ease changes by grade", []reviewStep{
+			{grade: 4, day: 0, interval: 1, ease: 2.5, reps: 1, state: CardStateReview},
+			{grade: 4, day: 1, interval: 6, ease: 2.5, reps: 2, state: CardStateReview},
+			{grade: 3, day: 7, interval: 15, ease: 2.36, reps: 3, state: CardStateReview},
+			{grade: 2, day: 22, interval: 1, ease: 2.04, reps: 0, lapses: 1, state: CardStateRelearning},
+			{grade: 1, day: 23, interval: 1, ease: 1.5, reps: 0, lapses: 1, state: CardStateRelearning},
+			{grade: 3, day: 24, interval: 1, ease: 1.36, reps: 1, lapses: 1, state: CardStateReview},
+		}},
+		{"ease never drops below 1.3", []reviewStep{
+			{grade: 0, day: 0, interval: 1, ease: 1.7, reps: 0, state: CardStateLearning},
+			{grade: 0, day: 1, interval: 1, ease: 1.3, reps: 0, state: CardStateLearning},
+			{grade: 0, day: 2, interval: 1, ease: 1.3, reps: 0, state: CardStateLearning},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, SM2Scheduler{}, tt.steps)
+		})
+	}
+}
+
+func TestLeitnerSchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []reviewStep
+	}{
+		{"climbs the boxes and stays in the last", []reviewStep{
+			{grade: 4, day: 0, interval: 1, reps: 1, state: CardStateReview},
+			{grade: 3, day: 1, interval: 2, reps: 2, state: CardStateReview},
+			{grade: 5, day: 3, interval: 4, reps: 3, state: CardStateReview},
+			{grade: 4, day: 7, interval: 8, reps: 4, state: CardStateReview},
+			{grade: 4, day: 15, interval: 16, reps: 5, state: CardStateReview},
+			{grade: 4, day: 31, interval: 16, reps: 5, state: CardStateReview},
+		}},
+		{"a failure goes back to the first box", []reviewStep{
+			{grade: 4, day: 0, interval: 1, reps: 1, state: CardStateReview},
+			{grade: 4, day: 1, interval: 2, reps: 2, state: CardStateReview},
+			{grade: 2, day: 3, interval: 1, reps: 1, lapses: 1, state: CardStateRelearning},
+			{grade: 4, day: 4, interval: 2, reps: 2, lapses: 1, state: CardStateReview},
+		}},
+		{"a new card failed stays learning", []reviewStep{
+			{grade: 1, day: 0, interval: 1, reps: 1, state: CardStateLearning},
+		}},
+	}
+	s := LeitnerScheduler{Intervals: DefaultLeitnerIntervals}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, s, tt.steps)
+		})
+	}
+}
+
+// Reference values follow the published FSRS-4.5 formulas with the
+// default weights and 90% retention, at which the interval equals the
+// stability.
+func TestFSRSSchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []reviewStep
+	}{
+		{"first review again", []reviewStep{
+			{grade: 1, day: 0, interval: 1, stability: 0.4872, difficulty: 7.6214, state: CardStateLearning},
+		}},
+		{"first review hard", []reviewStep{
+			{grade: 3, day: 0, interval: 1, stability: 1.4003, difficulty: 6.3916, reps: 1, state: CardStateReview},
+		}},
+		{"first review good", []reviewStep{
+			{grade: 4, day: 0, interval: 4, stability: 3.7145, difficulty: 5.1618, reps: 1, state: CardStateReview},
+		}},
+		{"first review easy", []reviewStep{
+			{grade: 5, day: 0, interval: 14, stability: 13.8206, difficulty: 3.932, reps: 1, state: CardStateReview},
+		}},
+		{"good, good, then a lapse", []reviewStep{
+			{grade: 4, day: 0, interval: 4, stability: 3.7145, difficulty: 5.1618, reps: 1, state: CardStateReview},
+			{grade: 4, day: 4, interval: 15, stability: 14.8081, difficulty: 5.1618, reps: 2, state: CardStateReview},
+			{grade: 1, day: 19, interval: 3, stability: 3.1493, difficulty: 6.9012, reps: 0, lapses: 1, state: CardStateRelearning},
+		}},
+		{"good, then easy", []reviewStep{
+			{grade: 4, day: 0, interval: 4, stability: 3.7145, difficulty: 5.1618, reps: 1, state: CardStateReview},
+			{grade: 5, day: 4, interval: 36, stability: 35.6141, difficulty: 4.2921, reps: 2, state: CardStateReview},
+		}},
+		{"good, then hard", []reviewStep{
+			{grade: 4, day: 0, interval: 4, stability: 3.7145, difficulty: 5.1618, reps: 1, state: CardStateReview},
+			{grade: 3, day: 4, interval: 6, stability: 6.2350, difficulty: 6.0315, reps: 2, state: CardStateReview},
+		}},
+	}
+	s := NewFSRSScheduler(DefaultFSRSWeights, 0.9)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, s, tt.steps)
+		})
+	}
+}
+
+func TestFSRSRetrievability(t *testing.T) {
+	s := NewFSRSScheduler(DefaultFSRSWeights, 0.9)
+	if r := s.Retrievability(0, 5); r != 1 {
+		t.Errorf("retrievability right after a review = %v, want 1", r)
+	}
+	// Stability is the time until recall drops to 90%
+	if r := s.Retrievability(10, 10); !approx(r, 0.9) {
+		t.Errorf("retrievability after S days = %v, want 0.9", r)
+	}
+	if i := s.NextInterval(1e9); i != fsrsMaxInterval {
+		t.Errorf("interval = %d, want the maximum %d", i, fsrsMaxInterval)
+	}
+}
+
+func TestReplayReviews(t *testing.T) {
+	logs := []ReviewLog{
+		{Grade: 4, Reviewed: days(0)},
+		{Grade: 4, Reviewed: days(1)},
+		{Grade: 2, Reviewed: days(7)},
+		{Grade: 5, Reviewed: days(8)},
+	}
+	for name, s := range schedulers {
+		t.Run(name, func(t *testing.T) {
+			if ReplayReviews(s, 1, 2, time.Time{}, nil) != nil {
+				t.Fatal("replaying no reviews should give no state")
+			}
+			got := ReplayReviews(s, 1, 2, time.Time{}, logs)
+			want := NewCardState(1, 2, days(0))
+			for _, l := range logs {
+				want = s.Schedule(want, l.Grade, l.Reviewed)
+			}
+			if *got != want {
+				t.Errorf("replayed state = %+v, want %+v", *got, want)
+			}
+			if got.AccountID != 1 || got.CardID != 2 || !got.Introduced.Equal(days(0)) {
+				t.Errorf("replayed state belongs to %d/%d introduced %v", got.AccountID, got.CardID, got.Introduced)
+			}
+		})
+	}
+
+	// An earlier introduction is kept
+	introduced := days(-3)
+	for name, s := range schedulers {
+		got := ReplayReviews(s, 1, 2, introduced, logs)
+		if !got.Introduced.Equal(introduced) {
+			t.Errorf("%s replay introduced %v, want %v", name, got.Introduced, introduced)
+		}
+	}
+
+	// Switching algorithms rebuilds the state from the same log
+	sm2 := ReplayReviews(SM2Scheduler{}, 1, 2, time.Time{}, logs)
+	if sm2.Interval != 1 || sm2.Repetitions != 1 || sm2.Lapses != 1 || !approx(sm2.Ease, 2.28) {
+		t.Errorf("sm2 replay = %+v", *sm2)
+	}
+	leitner := ReplayReviews(LeitnerScheduler{Intervals: DefaultLeitnerIntervals}, 1, 2, time.Time{}, logs)
+	if leitner.Interval != 2 || leitner.Repetitions != 2 || leitner.Lapses != 1 {
+		t.Errorf("leitner replay = %+v", *leitner)
+	}
+}
+
+func TestGetScheduler(t *testing.T) {
+	for _, name := range []string{"sm2", "fsrs", "leitner"} {
+		s, err := GetScheduler(name)
+		if err != nil || s.Name() != name {
+			t.Errorf("GetScheduler(%q) = %v, %v", name, s, err)
+		}
+	}
+	if _, err := GetScheduler("anki"); err == nil {
+		t.Error("GetScheduler accepted an unknown algorithm")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// A set or card matching a search. Title and snippet are HTML-escaped with
+// matched terms wrapped in <mark></mark>.
+type SearchResult struct {
+	Type    string  `json:"type"`
+	ID      int     `json:"id"`
+	SetID   int     `json:"set_id"`
+	Title   string  `json:"title"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"per_page"`
+	HasMore bool           `json:"has_more"`
+}
+
+type SearchHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewSearchHandler(db *pgxpool.Pool) *SearchHandler {
+	return &SearchHandler{db: db}
+}
+
+const maxQueryLength = 200
+
+// Options for ts_headline
+const headlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2"
+
+////////////
+// ROUTES
+
+var (
+	SearchRE = regexp.MustCompile(`^\/search\/?$`)
+)
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// SEARCH ROUTE
+	case SearchRE.MatchString(url) && r.Method == http.MethodGet:
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			writeJSONError(w, "missing q", http.StatusBadRequest)
+			return
+		}
+		if len(query) > maxQueryLength {
+			writeJSONError(w, "q is too long", http.StatusBadRequest)
+			return
+		}
+		page, perPage, err := getPagination(r)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		accountID := -1
+		if claims := claimsFromRequest(r); claims != nil {
+			accountID = claims.UserID
+		}
+		result, err := h.Search(accountID, query, page, perPage)
+		if err != nil {
+			log.Printf("error searching for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error searching", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Escapes text returned by ts_headline while keeping its highlight markers
+func escapeHeadline(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, "&lt;mark&gt;", "<mark>")
+	return strings.ReplaceAll(s, "&lt;/mark&gt;", "</mark>")
+}
+
+//////////
+// READ
+
+// Searches set names and descriptions and card fronts and backs visible to
+// the account: its own sets, sets it collaborates on, and public sets.
+// Anonymous callers (accountID -1) only see public sets. Full-text matches
+// are combined with trigram word similarity so that typos still match.
+func (h *SearchHandler) Search(accountID int, query string, page int, perPage int) (*SearchPage, error) {
+	rows, err := h.db.Query(context.Background(),
+		`WITH q AS (
+		   SELECT websearch_to_tsquery('simple', $2) AS query, $2::text AS raw
+		 ), visible AS (
+		   SELECT s.* FROM sets s
+		   LEFT JOIN set_collaborators sc ON sc.set_id = s.id AND sc.account_id = $1
+		   WHERE s.visibility = 'public' OR s.account_id = $1 OR sc.account_id IS NOT NULL
+		 )
+		 SELECT type, id, set_id, title, snippet, rank FROM (
+		   SELECT 'set' AS type, s.id, s.id AS set_id,
+		          ts_headline('simple', COALESCE(s.name, ''), q.query, $3) AS title,
+		          ts_headline('simple', COALESCE(s.description, ''), q.query, $3) AS snippet,
+		          ts_rank(s.search, q.query) + word_similarity(q.raw, COALESCE(s.name, '')) AS rank
+		   FROM visible s CROSS JOIN q
+		   WHERE s.search @@ q.query OR q.raw <% s.name
+		   UNION ALL
+		   SELECT 'card', c.id, c.set_id,
+		          ts_headline('simple', COALESCE(c.front, ''), q.query, $3),
+		          ts_headline('simple', COALESCE(c.back, ''), q.query, $3),
+		          ts_rank(c.search, q.query) + GREATEST(
+		            word_similarity(q.raw, COALESCE(c.front, '')),
+		            word_similarity(q.raw, COALESCE(c.back, '')))
+		   FROM cards c
+		   JOIN visible s ON s.id = c.set_id
+		   CROSS JOIN q
+		   WHERE c.search @@ q.query OR q.raw <% c.front OR q.raw <% c.back
+		 ) results
+		 ORDER BY rank DESC, type DESC, id ASC
+		 LIMIT $4 OFFSET $5`,
+		accountID, query, headlineOptions, perPage+1, (page-1)*perPage)
+	if err != nil {
+		return nil, fmt.Errorf("error searching: %w", err)
+	}
+	defer rows.Close()
+	result := SearchPage{
+		Query:   query,
+		Results: []SearchResult{},
+		Page:    page,
+		PerPage: perPage,
+	}
+	for rows.Next() {
+		var s SearchResult
+		err := rows.Scan(&s.Type, &s.ID, &s.SetID, &s.Title, &s.Snippet, &s.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		s.Title = escapeHeadline(s.Title)
+		s.Snippet = escapeHeadline(s.Snippet)
+		result.Results = append(result.Results, s)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error searching: %w", rows.Err())
+	}
+	// One extra row was requested to know whether there is another page
+	if len(result.Results) > perPage {
+		result.Results = result.Results[:perPage]
+		result.HasMore = true
+	}
+	return &result, nil
+}
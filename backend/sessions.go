@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// A place the account is logged in, i.e. a refresh token family. Revoking
+// a session deletes its tokens, so its next refresh fails and it is logged
+// out once its current access token expires.
+type Session struct {
+	ID        int       `json:"id"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used"`
+	UserAgent string    `json:"user_agent"`
+	ClientIP  string    `json:"client_ip"`
+	Current   bool      `json:"current"`
+}
+
+type SessionHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionHandler(db *pgxpool.Pool) *SessionHandler {
+	return &SessionHandler{db: db}
+}
+
+var errNoCurrentSession = errors.New("request has no refresh token")
+
+////////////
+// ROUTES
+
+var (
+	SessionsRE            = regexp.MustCompile(`^\/sessions\/?$`)
+	SessionREWithID       = regexp.MustCompile(`^\/sessions\/(\d+)\/?$`)
+	RevokeOtherSessionsRE = regexp.MustCompile(`^\/sessions\/revoke-others\/?$`)
+)
+
+func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// LIST SESSIONS ROUTE
+	case SessionsRE.MatchString(url) && r.Method == http.MethodGet:
+		current, err := h.currentSession(r)
+		if err != nil && !errors.Is(err, errNoCurrentSession) {
+			log.Printf("error getting current session for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting sessions", http.StatusInternalServerError)
+			return
+		}
+		sessions, err := h.GetSessions(claims.UserID, current)
+		if err != nil {
+			log.Printf("error getting sessions for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting sessions", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(sessions)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	// REVOKE OTHER SESSIONS ROUTE
+	case RevokeOtherSessionsRE.MatchString(url) && r.Method == http.MethodPost:
+		current, err := h.currentSession(r)
+		if errors.Is(err, errNoCurrentSession) {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error getting current session for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error revoking sessions", http.StatusInternalServerError)
+			return
+		}
+		err = h.RevokeOtherSessions(claims.UserID, current)
+		if err != nil {
+			log.Printf("error revoking sessions for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error revoking sessions", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	// REVOKE SESSION ROUTE
+	case SessionREWithID.MatchString(url) && r.Method == http.MethodDelete:
+		groups := SessionREWithID.FindStringSubmatch(url)
+		id, err := strconv.Atoi(groups[1])
+		if err != nil {
+			writeJSONError(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		found, err := h.RevokeSession(claims.UserID, id)
+		if err != nil {
+			log.Printf("error revoking session for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error revoking session", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			writeJSONError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Returns the session of the request's refresh cookie. The cookie may have
+// just been replaced by a refresh, so used tokens count as well.
+func (h *SessionHandler) currentSession(r *http.Request) (int, error) {
+	refreshCookie, err := r.Cookie("refresh")
+	if err != nil {
+		return -1, errNoCurrentSession
+	}
+	var family int
+	err = h.db.QueryRow(context.Background(),
+		`SELECT family FROM refreshtokens WHERE token_hash=$1`, hashToken(refreshCookie.Value)).Scan(&family)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, errNoCurrentSession
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error querying refresh token: %w", err)
+	}
+	return family, nil
+}
+
+//////////
+// READ
+
+// Returns the account's sessions, most recently used first. current is
+// the session making the request, or -1.
+func (h *SessionHandler) GetSessions(accountID int, current int) ([]Session, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT family, created, last_used, user_agent, client_ip
+		 FROM refreshtokens
+		 WHERE account_id=$1 AND used IS NULL AND expires > NOW()
+		 ORDER BY last_used DESC`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying sessions: %w", err)
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.Created, &s.LastUsed, &s.UserAgent, &s.ClientIP)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning session: %w", err)
+		}
+		s.Current = s.ID == current
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+////////////
+// DELETE
+
+// Revokes one of the account's sessions. Returns false if there is no
+// such session.
+func (h *SessionHandler) RevokeSession(accountID int, id int) (bool, error) {
+	tag, err := h.db.Exec(context.Background(),
+		`DELETE FROM refreshtokens WHERE account_id=$1 AND family=$2`, accountID, id)
+	if err != nil {
+		return false, fmt.Errorf("error deleting session: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Revokes every session of the account except current
+func (h *SessionHandler) RevokeOtherSessions(accountID int, current int) error {
+	_, err := h.db.Exec(context.Background(),
+		`DELETE FROM refreshtokens WHERE account_id=$1 AND family<>$2`, accountID, current)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %w", err)
+	}
+	return nil
+}
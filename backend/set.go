@@ -20,6 +20,9 @@ type Set struct {
 	AccountID   int         `json:"account_id"`
 	Name        pgtype.Text `json:"name"`
 	Description pgtype.Text `json:"description"`
+	Algorithm   string      `json:"algorithm"`
+	Visibility  string      `json:"visibility"`
+	ShareToken  *string     `json:"share_token,omitempty"`
 	Created     time.Time   `json:"created"`
 	Cards       *[]Card     `json:"cards"`
 }
@@ -27,13 +30,29 @@ type Set struct {
 type SetUpdate struct {
 	Name        *string       `json:"name"`
 	Description *string       `json:"description"`
+	Algorithm   *string       `json:"algorithm"`
+	Visibility  *string       `json:"visibility"`
 	Cards       *[]CardUpdate `json:"cards"`
 }
 
 type SetHandler struct {
 	db             *pgxpool.Pool
+	authorizer     *Authorizer
 	accountHandler *AccountHandler
 	cardHandler    *CardHandler
+	studyHandler   *StudyHandler
+	statsHandler   *StatsHandler
+	ankiHandler    *AnkiHandler
+}
+
+type Collaborator struct {
+	AccountID int    `json:"account_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+}
+
+type CollaboratorData struct {
+	Role string `json:"role"`
 }
 
 type CardData struct {
@@ -41,14 +60,26 @@ type CardData struct {
 	Back  string `json:"back"`
 }
 
-func NewSetHandler(db *pgxpool.Pool, accountHandler *AccountHandler, cardHandler *CardHandler) *SetHandler {
-	return &SetHandler{db: db, accountHandler: accountHandler, cardHandler: cardHandler}
+func NewSetHandler(db *pgxpool.Pool, authorizer *Authorizer, accountHandler *AccountHandler,
+	cardHandler *CardHandler, studyHandler *StudyHandler, statsHandler *StatsHandler,
+	ankiHandler *AnkiHandler) *SetHandler {
+	return &SetHandler{
+		db:             db,
+		authorizer:     authorizer,
+		accountHandler: accountHandler,
+		cardHandler:    cardHandler,
+		studyHandler:   studyHandler,
+		statsHandler:   statsHandler,
+		ankiHandler:    ankiHandler,
+	}
 }
 
 var (
 	SetRE           = regexp.MustCompile((`^\/sets\/?$`))
 	SetREWithID     = regexp.MustCompile(`^\/sets\/(\d+)\/?$`)
 	CardREWithSetID = regexp.MustCompile(`^\/sets\/(\d+)\/?$`)
+	CollaboratorsRE = regexp.MustCompile(`^\/sets\/(\d+)\/collaborators\/?$`)
+	CollaboratorRE  = regexp.MustCompile(`^\/sets\/(\d+)\/collaborators\/(\d+)\/?$`)
 )
 
 func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -58,6 +89,26 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 
+	// SET STUDY QUEUE ROUTE
+	case SetStudyQueueRE.MatchString(url):
+		h.studyHandler.ServeHTTP(w, r)
+		return
+
+	// SET STATS ROUTE
+	case SetStatsRE.MatchString(url):
+		h.statsHandler.ServeHTTP(w, r)
+		return
+
+	// IMPORT CARDS ROUTE
+	case SetImportRE.MatchString(url) && r.Method == http.MethodPost:
+		h.serveImport(w, r)
+		return
+
+	// EXPORT SET ROUTE
+	case SetExportRE.MatchString(url) && r.Method == http.MethodGet:
+		h.serveExport(w, r)
+		return
+
 	// CREATE SET ROUTE
 	case SetRE.MatchString(url) && r.Method == http.MethodPost:
 		setID, err := h.CreateSet(claims.UserID)
@@ -88,12 +139,19 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid id", http.StatusBadRequest)
 			return
 		}
+		if !h.authorizer.RequireSet(w, r, setID, PermissionRead) {
+			return
+		}
 		set, err := h.GetSetByIDWithCards(setID)
 		if err != nil {
 			http.Error(w, "error getting set", http.StatusNotFound)
 			log.Printf("error getting set: %v\n", err)
 			return
 		}
+		// Only the owner gets the share link
+		if claims == nil || claims.UserID != set.AccountID {
+			set.ShareToken = nil
+		}
 		data, err := json.Marshal(set)
 		if err != nil {
 			http.Error(w, "error marshalling json", http.StatusInternalServerError)
@@ -130,6 +188,10 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("error parsing id from url: %v\n", err)
 			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, set_id, PermissionWrite) {
+			return
 		}
 		var update SetUpdate
 		defer r.Body.Close()
@@ -145,12 +207,34 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "error unmarshalling json", http.StatusBadRequest)
 			return
 		}
+		// Both reach past the set's content: visibility decides who can see
+		// it, and the algorithm reschedules every learner's cards
+		if (update.Visibility != nil || update.Algorithm != nil) &&
+			!h.authorizer.RequireSet(w, r, set_id, PermissionAdmin) {
+			return
+		}
 		if update.Name != nil {
 			h.UpdateName(set_id, *update.Name)
 		}
 		if update.Description != nil {
 			h.UpdateDescription(set_id, *update.Description)
 		}
+		if update.Visibility != nil {
+			err := h.UpdateVisibility(set_id, *update.Visibility)
+			if err != nil {
+				log.Printf("error updating visibility for %s: %v\n", clientIP, err)
+				http.Error(w, "error updating visibility", http.StatusBadRequest)
+				return
+			}
+		}
+		if update.Algorithm != nil {
+			err := h.UpdateAlgorithm(set_id, *update.Algorithm)
+			if err != nil {
+				log.Printf("error updating algorithm for %s: %v\n", clientIP, err)
+				http.Error(w, "error updating algorithm", http.StatusBadRequest)
+				return
+			}
+		}
 		if update.Cards != nil {
 			// update/create cards
 			for _, u := range *update.Cards {
@@ -162,17 +246,23 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					}
 
 				case "update":
+					if !h.cardInSet(u.ID, set_id) {
+						log.Printf("%s tried to update card outside of set %d\n", clientIP, set_id)
+						continue
+					}
 					err := h.cardHandler.UpdateCard(u)
 					if err != nil {
 						log.Printf("error updating card for %s: %v\n", clientIP, err)
 					}
 
 				case "delete":
-					if u.ID != nil {
-						err := h.cardHandler.DeleteCard(*u.ID)
-						if err != nil {
-							log.Printf("error deleting card for %s: %v\n", clientIP, err)
-						}
+					if !h.cardInSet(u.ID, set_id) {
+						log.Printf("%s tried to delete card outside of set %d\n", clientIP, set_id)
+						continue
+					}
+					err := h.cardHandler.DeleteCard(*u.ID)
+					if err != nil {
+						log.Printf("error deleting card for %s: %v\n", clientIP, err)
 					}
 				}
 			}
@@ -211,6 +301,10 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("error parsing id from url: %v\n", err)
 			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, set_id, PermissionWrite) {
+			return
 		}
 		var cardData CardData
 		defer r.Body.Close()
@@ -255,6 +349,9 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "bad id", http.StatusBadRequest)
 			return
 		}
+		if !h.authorizer.RequireSet(w, r, set_id, PermissionAdmin) {
+			return
+		}
 		err = h.DeleteSet(set_id)
 		if err != nil {
 			log.Printf("%s error deleting set: %v\n", clientIP, err)
@@ -264,11 +361,145 @@ func (h *SetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 
+	// GET COLLABORATORS ROUTE
+	case CollaboratorsRE.MatchString(url) && r.Method == http.MethodGet:
+		groups := CollaboratorsRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			writeJSONError(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		set_id, err := strconv.Atoi(groups[1])
+		if err != nil {
+			writeJSONError(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, set_id, PermissionRead) {
+			return
+		}
+		collaborators, err := h.GetCollaborators(set_id)
+		if err != nil {
+			log.Printf("error getting collaborators for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting collaborators", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(collaborators)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	// ADD OR UPDATE COLLABORATOR ROUTE
+	case CollaboratorRE.MatchString(url) && r.Method == http.MethodPut:
+		set_id, account_id, err := getCollaboratorIDsFromURL(url)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, set_id, PermissionAdmin) {
+			return
+		}
+		var data CollaboratorData
+		defer r.Body.Close()
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(bytes, &data)
+		if err != nil {
+			writeJSONError(w, "error unmarshalling json", http.StatusBadRequest)
+			return
+		}
+		if data.Role != RoleViewer && data.Role != RoleEditor {
+			writeJSONError(w, "role must be viewer or editor", http.StatusBadRequest)
+			return
+		}
+		if account_id == claims.UserID {
+			writeJSONError(w, "owner cannot be a collaborator", http.StatusBadRequest)
+			return
+		}
+		acc, err := h.accountHandler.GetAccountByID(account_id)
+		if err != nil {
+			log.Printf("error getting account for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting account", http.StatusInternalServerError)
+			return
+		}
+		if acc == nil {
+			writeJSONError(w, "account not found", http.StatusNotFound)
+			return
+		}
+		err = h.SetCollaborator(set_id, account_id, data.Role)
+		if err != nil {
+			log.Printf("error setting collaborator for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error setting collaborator", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+
+	// REMOVE COLLABORATOR ROUTE
+	case CollaboratorRE.MatchString(url) && r.Method == http.MethodDelete:
+		set_id, account_id, err := getCollaboratorIDsFromURL(url)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Collaborators may remove themselves
+		required := PermissionAdmin
+		if account_id == claims.UserID {
+			required = PermissionRead
+		}
+		if !h.authorizer.RequireSet(w, r, set_id, required) {
+			return
+		}
+		err = h.DeleteCollaborator(set_id, account_id)
+		if err != nil {
+			log.Printf("error removing collaborator for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error removing collaborator", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+
 	default:
 		return
 	}
 }
 
+/////////////
+// HELPERS
+
+func getCollaboratorIDsFromURL(url string) (set_id int, account_id int, err error) {
+	groups := CollaboratorRE.FindStringSubmatch(url)
+	if len(groups) != 3 {
+		return -1, -1, fmt.Errorf("invalid URL")
+	}
+	set_id, err = strconv.Atoi(groups[1])
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid set ID")
+	}
+	account_id, err = strconv.Atoi(groups[2])
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid account ID")
+	}
+	return set_id, account_id, nil
+}
+
+// Checks that a card id from a set update refers to a card in that set
+func (h *SetHandler) cardInSet(card_id *int, set_id int) bool {
+	if card_id == nil {
+		return false
+	}
+	card, err := h.cardHandler.GetCardByID(*card_id)
+	if err != nil || card == nil {
+		return false
+	}
+	return card.SetID == set_id
+}
+
 ////////////
 // CREATE
 
@@ -312,7 +543,7 @@ func (h *SetHandler) CreateSet(account_id int) (id int, err error) {
 
 func (h *SetHandler) GetSetByID(set_id int) (*Set, error) {
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, account_id, name, description, created
+		`SELECT id, account_id, name, description, algorithm, visibility, share_token, created
 		 FROM sets WHERE id=$1`, set_id)
 	if err != nil {
 		return nil, fmt.Errorf("error getting set: %w", err)
@@ -322,7 +553,8 @@ func (h *SetHandler) GetSetByID(set_id int) (*Set, error) {
 		return nil, nil
 	}
 	var s Set
-	err = rows.Scan(&s.ID, &s.AccountID, &s.Name, &s.Description, &s.Created)
+	err = rows.Scan(&s.ID, &s.AccountID, &s.Name, &s.Description, &s.Algorithm,
+		&s.Visibility, &s.ShareToken, &s.Created)
 	if err != nil {
 		return nil, fmt.Errorf("error scanning row: %w", err)
 	}
@@ -334,6 +566,9 @@ func (h *SetHandler) GetSetByIDWithCards(set_id int) (*Set, error) {
 	if err != nil {
 		return nil, err
 	}
+	if set == nil {
+		return nil, fmt.Errorf("set does not exist")
+	}
 	cards, err := h.cardHandler.GetCardsBySetID(set_id)
 	if err != nil {
 		return nil, err
@@ -353,7 +588,7 @@ func (h *SetHandler) GetSetsByAccountID(account_id int) (*[]Set, error) {
 	}
 	// Get sets
 	rows, err := h.db.Query(context.Background(),
-		`SELECT id, account_id, name, description, created
+		`SELECT id, account_id, name, description, algorithm, visibility, share_token, created
 		 FROM sets WHERE account_id=$1
 		 ORDER BY id DESC`, account_id)
 	if err != nil {
@@ -363,7 +598,8 @@ func (h *SetHandler) GetSetsByAccountID(account_id int) (*[]Set, error) {
 	var sets []Set
 	for rows.Next() {
 		var s Set
-		err := rows.Scan(&s.ID, &s.AccountID, &s.Name, &s.Description, &s.Created)
+		err := rows.Scan(&s.ID, &s.AccountID, &s.Name, &s.Description, &s.Algorithm,
+			&s.Visibility, &s.ShareToken, &s.Created)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
@@ -375,9 +611,45 @@ func (h *SetHandler) GetSetsByAccountID(account_id int) (*[]Set, error) {
 	return &sets, nil
 }
 
+func (h *SetHandler) GetCollaborators(set_id int) ([]Collaborator, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT a.id, a.username, sc.role
+		 FROM set_collaborators sc
+		 JOIN accounts a ON a.id = sc.account_id
+		 WHERE sc.set_id=$1
+		 ORDER BY a.username ASC`, set_id)
+	if err != nil {
+		return nil, fmt.Errorf("error querying collaborators: %w", err)
+	}
+	defer rows.Close()
+	collaborators := []Collaborator{}
+	for rows.Next() {
+		var c Collaborator
+		err := rows.Scan(&c.AccountID, &c.Username, &c.Role)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		collaborators = append(collaborators, c)
+	}
+	return collaborators, nil
+}
+
 ////////////
 // UPDATE
 
+// Adds a collaborator to a set or changes their role
+func (h *SetHandler) SetCollaborator(set_id int, account_id int, role string) error {
+	_, err := h.db.Exec(context.Background(),
+		`INSERT INTO set_collaborators (set_id, account_id, role)
+		 VALUES($1, $2, $3)
+		 ON CONFLICT (set_id, account_id) DO UPDATE SET role=EXCLUDED.role`,
+		set_id, account_id, role)
+	if err != nil {
+		return fmt.Errorf("error setting collaborator: %w", err)
+	}
+	return nil
+}
+
 func (h *SetHandler) UpdateName(set_id int, name string) error {
 	_, err := h.db.Exec(context.Background(),
 		`UPDATE sets SET name=$1 WHERE id=$2`, name, set_id)
@@ -396,9 +668,121 @@ func (h *SetHandler) UpdateDescription(set_id int, description string) error {
 	return nil
 }
 
+// Changes who can read a set. Unlisted sets get a share token that must
+// be sent as the share query parameter; other visibilities drop it.
+func (h *SetHandler) UpdateVisibility(set_id int, visibility string) error {
+	var err error
+	switch visibility {
+	case VisibilityUnlisted:
+		token, errToken := GenerateToken(16)
+		if errToken != nil {
+			return fmt.Errorf("error generating share token: %w", errToken)
+		}
+		_, err = h.db.Exec(context.Background(),
+			`UPDATE sets SET visibility=$1, share_token=COALESCE(share_token, $2)
+			 WHERE id=$3`, visibility, token, set_id)
+	case VisibilityPrivate, VisibilityPublic:
+		_, err = h.db.Exec(context.Background(),
+			`UPDATE sets SET visibility=$1, share_token=NULL
+			 WHERE id=$2`, visibility, set_id)
+	default:
+		return fmt.Errorf("invalid visibility %q", visibility)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating visibility: %w", err)
+	}
+	return nil
+}
+
+// Switches the scheduling algorithm of a set and rebuilds the state of
+// every card in it from the review log
+func (h *SetHandler) UpdateAlgorithm(set_id int, algorithm string) error {
+	scheduler, err := GetScheduler(algorithm)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE sets SET algorithm=$1 WHERE id=$2`, scheduler.Name(), set_id)
+	if err != nil {
+		return fmt.Errorf("error updating algorithm: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("set does not exist")
+	}
+	// Cards keep the day they were introduced, which the daily new card
+	// limit counts by
+	rows, err := tx.Query(ctx,
+		`SELECT r.account_id, r.card_id, r.grade, r.reviewed, cs.introduced
+		 FROM reviews r JOIN cards c ON c.id = r.card_id
+		 LEFT JOIN card_states cs ON cs.account_id = r.account_id AND cs.card_id = r.card_id
+		 WHERE c.set_id=$1
+		 ORDER BY r.account_id, r.card_id, r.reviewed, r.id`, set_id)
+	if err != nil {
+		return fmt.Errorf("error querying reviews: %w", err)
+	}
+	// Group the log by account and card
+	type key struct{ accountID, cardID int }
+	var order []key
+	logs := map[key][]ReviewLog{}
+	introduced := map[key]time.Time{}
+	for rows.Next() {
+		var k key
+		var l ReviewLog
+		var in pgtype.Timestamptz
+		err := rows.Scan(&k.accountID, &k.cardID, &l.Grade, &l.Reviewed, &in)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		if _, ok := logs[k]; !ok {
+			order = append(order, k)
+			introduced[k] = in.Time
+		}
+		logs[k] = append(logs[k], l)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return fmt.Errorf("error reading reviews: %w", rows.Err())
+	}
+	_, err = tx.Exec(ctx,
+		`DELETE FROM card_states
+		 WHERE card_id IN (SELECT id FROM cards WHERE set_id=$1)`, set_id)
+	if err != nil {
+		return fmt.Errorf("error clearing card states: %w", err)
+	}
+	for _, k := range order {
+		state := ReplayReviews(scheduler, k.accountID, k.cardID, introduced[k], logs[k])
+		err = saveCardState(ctx, tx, *state)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
 ////////////
 // DELETE
 
+func (h *SetHandler) DeleteCollaborator(set_id int, account_id int) error {
+	_, err := h.db.Exec(context.Background(),
+		`DELETE FROM set_collaborators WHERE set_id=$1 AND account_id=$2`, set_id, account_id)
+	if err != nil {
+		return fmt.Errorf("error deleting collaborator: %w", err)
+	}
+	return nil
+}
+
 func (h *SetHandler) DeleteSet(set_id int) error {
 	// Check exists
 	set, err := h.GetSetByID(set_id)
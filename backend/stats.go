@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+type DayCount struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+type RetentionBucket struct {
+	Interval  string  `json:"interval"`
+	Reviews   int     `json:"reviews"`
+	Passed    int     `json:"passed"`
+	Retention float64 `json:"retention"`
+}
+
+type CardCounts struct {
+	New      int `json:"new"`
+	Learning int `json:"learning"`
+	Young    int `json:"young"`
+	Mature   int `json:"mature"`
+}
+
+type Stats struct {
+	Timezone      string            `json:"timezone"`
+	Heatmap       []DayCount        `json:"heatmap"`
+	CurrentStreak int               `json:"current_streak"`
+	LongestStreak int               `json:"longest_streak"`
+	Retention     []RetentionBucket `json:"retention"`
+	Cards         CardCounts        `json:"cards"`
+	Forecast      []DayCount        `json:"forecast"`
+}
+
+type StatsHandler struct {
+	db         *pgxpool.Pool
+	authorizer *Authorizer
+}
+
+func NewStatsHandler(db *pgxpool.Pool, authorizer *Authorizer) *StatsHandler {
+	return &StatsHandler{db: db, authorizer: authorizer}
+}
+
+const (
+	heatmapDays  = 365
+	forecastDays = 30
+	// Cards with an interval of at least this many days are mature
+	matureInterval = 21
+)
+
+// Labels of the interval buckets used for retention, by bucket number
+var retentionBuckets = map[int]string{
+	1: "1-6",
+	2: "7-20",
+	3: "21-89",
+	4: "90+",
+}
+
+////////////
+// ROUTES
+
+var (
+	AccountStatsRE = regexp.MustCompile(`^\/accounts\/(\d+)\/stats\/?$`)
+	SetStatsRE     = regexp.MustCompile(`^\/sets\/(\d+)\/stats\/?$`)
+)
+
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	var stats *Stats
+	switch {
+	// ACCOUNT STATS ROUTE
+	case AccountStatsRE.MatchString(url) && r.Method == http.MethodGet:
+		groups := AccountStatsRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			http.Error(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		accountID, err := strconv.Atoi(groups[1])
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if accountID != claims.UserID {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		stats, err = h.GetStats(accountID, nil, time.Now())
+		if err != nil {
+			log.Printf("error getting account stats for %s: %v\n", clientIP, err)
+			http.Error(w, "error getting stats", http.StatusInternalServerError)
+			return
+		}
+
+	// SET STATS ROUTE
+	case SetStatsRE.MatchString(url) && r.Method == http.MethodGet:
+		groups := SetStatsRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			http.Error(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		setID, err := strconv.Atoi(groups[1])
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, setID, PermissionRead) {
+			return
+		}
+		stats, err = h.GetStats(claims.UserID, &setID, time.Now())
+		if err != nil {
+			log.Printf("error getting set stats for %s: %v\n", clientIP, err)
+			http.Error(w, "error getting stats", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+//////////
+// READ
+
+// Aggregates the review log of an account, optionally limited to a single
+// set. Days are calendar days in the account's time zone.
+func (h *StatsHandler) GetStats(accountID int, setID *int, now time.Time) (*Stats, error) {
+	ctx := context.Background()
+	setFilter := pgtype.Int4{}
+	if setID != nil {
+		setFilter = pgtype.Int4{Int32: int32(*setID), Valid: true}
+	}
+	stats := Stats{
+		Heatmap:   []DayCount{},
+		Retention: []RetentionBucket{},
+		Forecast:  []DayCount{},
+	}
+
+	err := h.db.QueryRow(ctx,
+		`SELECT timezone FROM accounts WHERE id=$1`, accountID).Scan(&stats.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("error querying account: %w", err)
+	}
+
+	// Reviews per day
+	rows, err := h.db.Query(ctx,
+		`SELECT to_char((r.reviewed AT TIME ZONE $3)::date, 'YYYY-MM-DD') AS day, COUNT(*)
+		 FROM reviews r
+		 JOIN cards c ON c.id = r.card_id
+		 WHERE r.account_id=$1 AND ($2::int IS NULL OR c.set_id=$2)
+		   AND r.reviewed >= $4::timestamptz - make_interval(days => $5)
+		 GROUP BY day ORDER BY day`,
+		accountID, setFilter, stats.Timezone, now, heatmapDays)
+	if err != nil {
+		return nil, fmt.Errorf("error querying heatmap: %w", err)
+	}
+	for rows.Next() {
+		var d DayCount
+		err := rows.Scan(&d.Day, &d.Count)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		stats.Heatmap = append(stats.Heatmap, d)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error querying heatmap: %w", rows.Err())
+	}
+
+	// Streaks are runs of consecutive days with at least one review. The
+	// current streak is still alive if the last review was yesterday.
+	err = h.db.QueryRow(ctx,
+		`WITH days AS (
+		   SELECT DISTINCT (r.reviewed AT TIME ZONE $3)::date AS day
+		   FROM reviews r
+		   JOIN cards c ON c.id = r.card_id
+		   WHERE r.account_id=$1 AND ($2::int IS NULL OR c.set_id=$2)
+		 ), streaks AS (
+		   SELECT MAX(day) AS last, COUNT(*) AS length
+		   FROM (SELECT day, day - (ROW_NUMBER() OVER (ORDER BY day))::int AS grp FROM days) islands
+		   GROUP BY grp
+		 )
+		 SELECT COALESCE(MAX(length) FILTER (WHERE last >= ($4::timestamptz AT TIME ZONE $3)::date - 1), 0),
+		        COALESCE(MAX(length), 0)
+		 FROM streaks`,
+		accountID, setFilter, stats.Timezone, now).Scan(&stats.CurrentStreak, &stats.LongestStreak)
+	if err != nil {
+		return nil, fmt.Errorf("error querying streaks: %w", err)
+	}
+
+	// True retention: share of passing grades on cards that were already
+	// in review, grouped by the interval they were reviewed at
+	rows, err = h.db.Query(ctx,
+		`SELECT CASE
+		          WHEN r.prev_interval < 7 THEN 1
+		          WHEN r.prev_interval < 21 THEN 2
+		          WHEN r.prev_interval < 90 THEN 3
+		          ELSE 4
+		        END AS bucket,
+		        COUNT(*), COUNT(*) FILTER (WHERE r.grade >= 3)
+		 FROM reviews r
+		 JOIN cards c ON c.id = r.card_id
+		 WHERE r.account_id=$1 AND ($2::int IS NULL OR c.set_id=$2)
+		   AND r.prev_interval > 0
+		 GROUP BY bucket ORDER BY bucket`, accountID, setFilter)
+	if err != nil {
+		return nil, fmt.Errorf("error querying retention: %w", err)
+	}
+	for rows.Next() {
+		var bucket int
+		var b RetentionBucket
+		err := rows.Scan(&bucket, &b.Reviews, &b.Passed)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		b.Interval = retentionBuckets[bucket]
+		if b.Reviews > 0 {
+			b.Retention = float64(b.Passed) / float64(b.Reviews)
+		}
+		stats.Retention = append(stats.Retention, b)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error querying retention: %w", rows.Err())
+	}
+
+	// Card maturity. Account-wide counts cover the account's own sets and
+	// any other card it has studied.
+	err = h.db.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE cs.card_id IS NULL),
+		        COUNT(*) FILTER (WHERE cs.state IN ('learning', 'relearning')),
+		        COUNT(*) FILTER (WHERE cs.state = 'review' AND cs.interval < $3),
+		        COUNT(*) FILTER (WHERE cs.state = 'review' AND cs.interval >= $3)
+		 FROM cards c
+		 JOIN sets s ON s.id = c.set_id
+		 LEFT JOIN card_states cs ON cs.card_id = c.id AND cs.account_id = $1
+		 WHERE c.set_id = $2
+		    OR ($2 IS NULL AND (s.account_id = $1 OR cs.card_id IS NOT NULL))`,
+		accountID, setFilter, matureInterval).Scan(
+		&stats.Cards.New, &stats.Cards.Learning, &stats.Cards.Young, &stats.Cards.Mature)
+	if err != nil {
+		return nil, fmt.Errorf("error querying card counts: %w", err)
+	}
+
+	// Cards due on each of the coming days; overdue cards count towards today
+	rows, err = h.db.Query(ctx,
+		`WITH t AS (
+		   SELECT ($4::timestamptz AT TIME ZONE $3)::date AS today
+		 ), due AS (
+		   SELECT GREATEST((cs.due AT TIME ZONE $3)::date, t.today) AS day
+		   FROM card_states cs
+		   JOIN cards c ON c.id = cs.card_id
+		   CROSS JOIN t
+		   WHERE cs.account_id=$1 AND ($2::int IS NULL OR c.set_id=$2)
+		 )
+		 SELECT to_char(g.day, 'YYYY-MM-DD'), COUNT(due.day)
+		 FROM t
+		 CROSS JOIN generate_series(t.today, t.today + ($5::int - 1), INTERVAL '1 day') AS g(day)
+		 LEFT JOIN due ON due.day = g.day::date
+		 GROUP BY g.day ORDER BY g.day`,
+		accountID, setFilter, stats.Timezone, now, forecastDays)
+	if err != nil {
+		return nil, fmt.Errorf("error querying forecast: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DayCount
+		err := rows.Scan(&d.Day, &d.Count)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		stats.Forecast = append(stats.Forecast, d)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error querying forecast: %w", rows.Err())
+	}
+	return &stats, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// A card in the study queue along with its scheduling state
+type QueueCard struct {
+	Card
+	State string     `json:"state"`
+	Due   *time.Time `json:"due"`
+}
+
+type StudyQueue struct {
+	Cards           []QueueCard `json:"cards"`
+	NewRemaining    int         `json:"new_remaining"`
+	ReviewRemaining int         `json:"review_remaining"`
+}
+
+// Daily limits used to build a study queue
+type StudyLimits struct {
+	NewPerDay    int
+	ReviewPerDay int
+	Batch        int
+}
+
+type StudyHandler struct {
+	db         *pgxpool.Pool
+	authorizer *Authorizer
+}
+
+func NewStudyHandler(db *pgxpool.Pool, authorizer *Authorizer) *StudyHandler {
+	return &StudyHandler{db: db, authorizer: authorizer}
+}
+
+const (
+	defaultQueueLimit = 50
+	maxQueueLimit     = 500
+)
+
+////////////
+// ROUTES
+
+var (
+	StudyQueueRE    = regexp.MustCompile(`^\/study\/queue\/?$`)
+	SetStudyQueueRE = regexp.MustCompile(`^\/sets\/(\d+)\/study-queue\/?$`)
+)
+
+func (h *StudyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// ACCOUNT STUDY QUEUE ROUTE
+	case StudyQueueRE.MatchString(url) && r.Method == http.MethodGet:
+		limits, err := h.GetStudyLimits(claims.UserID, r)
+		if err != nil {
+			log.Printf("error getting study limits for %s: %v\n", clientIP, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queue, err := h.GetStudyQueue(claims.UserID, nil, limits, time.Now())
+		if err != nil {
+			log.Printf("error getting study queue for %s: %v\n", clientIP, err)
+			http.Error(w, "error getting study queue", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(queue)
+		if err != nil {
+			http.Error(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	// SET STUDY QUEUE ROUTE
+	case SetStudyQueueRE.MatchString(url) && r.Method == http.MethodGet:
+		groups := SetStudyQueueRE.FindStringSubmatch(url)
+		if len(groups) != 2 {
+			http.Error(w, "invalid URL", http.StatusBadRequest)
+			return
+		}
+		setID, err := strconv.Atoi(groups[1])
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		if !h.authorizer.RequireSet(w, r, setID, PermissionRead) {
+			return
+		}
+		limits, err := h.GetStudyLimits(claims.UserID, r)
+		if err != nil {
+			log.Printf("error getting study limits for %s: %v\n", clientIP, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queue, err := h.GetStudyQueue(claims.UserID, &setID, limits, time.Now())
+		if err != nil {
+			log.Printf("error getting study queue for %s: %v\n", clientIP, err)
+			http.Error(w, "error getting study queue", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(queue)
+		if err != nil {
+			http.Error(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+// Reads the account's daily limits, overridden by the
+// new_limit, review_limit and limit query parameters
+func (h *StudyHandler) GetStudyLimits(accountID int, r *http.Request) (StudyLimits, error) {
+	limits := StudyLimits{Batch: defaultQueueLimit}
+	err := h.db.QueryRow(context.Background(),
+		`SELECT daily_new_limit, daily_review_limit
+		 FROM accounts WHERE id=$1`, accountID).Scan(&limits.NewPerDay, &limits.ReviewPerDay)
+	if err != nil {
+		return limits, fmt.Errorf("error querying account limits: %w", err)
+	}
+	query := r.URL.Query()
+	params := []struct {
+		name  string
+		value *int
+	}{
+		{"new_limit", &limits.NewPerDay},
+		{"review_limit", &limits.ReviewPerDay},
+		{"limit", &limits.Batch},
+	}
+	for _, p := range params {
+		raw := query.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return limits, fmt.Errorf("invalid %s", p.name)
+		}
+		*p.value = n
+	}
+	if limits.Batch > maxQueueLimit {
+		limits.Batch = maxQueueLimit
+	}
+	return limits, nil
+}
+
+// Spreads new cards evenly between review cards so that a batch
+// is never front-loaded with unseen material
+func interleaveQueue(reviews []QueueCard, newCards []QueueCard) []QueueCard {
+	if len(newCards) == 0 {
+		return reviews
+	}
+	queue := make([]QueueCard, 0, len(reviews)+len(newCards))
+	step := (len(reviews) + len(newCards)) / len(newCards)
+	r, n := 0, 0
+	for i := 0; r < len(reviews) || n < len(newCards); i++ {
+		if n < len(newCards) && (r == len(reviews) || i%step == step-1) {
+			queue = append(queue, newCards[n])
+			n++
+		} else {
+			queue = append(queue, reviews[r])
+			r++
+		}
+	}
+	return queue
+}
+
+//////////
+// READ
+
+// Builds the study queue for an account, either for a single set or
+// across every set the account studies: its own sets, sets shared with it,
+// and public or unlisted sets it has started reviewing. Cards in (re)learning come first,
+// followed by due reviews interleaved with new cards, each ordered by
+// due date and then by card id.
+func (h *StudyHandler) GetStudyQueue(accountID int, setID *int, limits StudyLimits, now time.Time) (*StudyQueue, error) {
+	ctx := context.Background()
+
+	// Work out what is left of today's limits, where today starts at
+	// midnight in the account's time zone
+	var newToday, reviewsToday int
+	err := h.db.QueryRow(ctx,
+		`WITH d AS (
+		   SELECT date_trunc('day', $2::timestamptz AT TIME ZONE timezone) AT TIME ZONE timezone AS start
+		   FROM accounts WHERE id=$1
+		 )
+		 SELECT COUNT(*) FILTER (WHERE cs.introduced >= d.start),
+		        COUNT(*) FILTER (WHERE cs.introduced < d.start AND cs.last_reviewed >= d.start)
+		 FROM card_states cs CROSS JOIN d
+		 WHERE cs.account_id=$1`, accountID, now).Scan(&newToday, &reviewsToday)
+	if err != nil {
+		return nil, fmt.Errorf("error counting today's reviews: %w", err)
+	}
+	queue := StudyQueue{
+		Cards:           []QueueCard{},
+		NewRemaining:    max(limits.NewPerDay-newToday, 0),
+		ReviewRemaining: max(limits.ReviewPerDay-reviewsToday, 0),
+	}
+	if limits.Batch == 0 {
+		return &queue, nil
+	}
+
+	setFilter := pgtype.Int4{}
+	if setID != nil {
+		setFilter = pgtype.Int4{Int32: int32(*setID), Valid: true}
+	}
+
+	learning, err := h.getDueCards(ctx, accountID, setFilter, now, true, limits.Batch)
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := h.getDueCards(ctx, accountID, setFilter, now, false, min(limits.Batch, queue.ReviewRemaining))
+	if err != nil {
+		return nil, err
+	}
+	newCards, err := h.getNewCards(ctx, accountID, setFilter, min(limits.Batch, queue.NewRemaining))
+	if err != nil {
+		return nil, err
+	}
+
+	queue.Cards = append(queue.Cards, learning...)
+	queue.Cards = append(queue.Cards, interleaveQueue(reviews, newCards)...)
+	if len(queue.Cards) > limits.Batch {
+		queue.Cards = queue.Cards[:limits.Batch]
+	}
+	return &queue, nil
+}
+
+// Returns due cards that are either in (re)learning or in review. Across
+// sets, cards of sets the account can no longer read are left out.
+func (h *StudyHandler) getDueCards(ctx context.Context, accountID int, setID pgtype.Int4, now time.Time, learning bool, limit int) ([]QueueCard, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := h.db.Query(ctx,
+		`SELECT c.id, c.set_id, c.front, c.back, c.created, cs.state, cs.due
+		 FROM card_states cs
+		 JOIN cards c ON c.id = cs.card_id
+		 JOIN sets s ON s.id = c.set_id
+		 WHERE cs.account_id=$1 AND cs.due <= $2
+		   AND (cs.state IN ('learning', 'relearning')) = $3
+		   AND (c.set_id = $4 OR ($4 IS NULL AND (
+		     s.account_id = $1 OR s.visibility <> 'private' OR EXISTS (
+		       SELECT 1 FROM set_collaborators sc
+		       WHERE sc.set_id = s.id AND sc.account_id = $1))))
+		 ORDER BY cs.due ASC, c.id ASC
+		 LIMIT $5`, accountID, now, learning, setID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying due cards: %w", err)
+	}
+	defer rows.Close()
+	var cards []QueueCard
+	for rows.Next() {
+		var c QueueCard
+		err := rows.Scan(&c.ID, &c.SetID, &c.Front, &c.Back, &c.Created, &c.State, &c.Due)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
+
+// Returns cards the account has never reviewed. Across sets, public and
+// unlisted sets only count once the account has reviewed one of their
+// cards.
+func (h *StudyHandler) getNewCards(ctx context.Context, accountID int, setID pgtype.Int4, limit int) ([]QueueCard, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := h.db.Query(ctx,
+		`SELECT c.id, c.set_id, c.front, c.back, c.created
+		 FROM cards c
+		 JOIN sets s ON s.id = c.set_id
+		 LEFT JOIN card_states cs ON cs.card_id = c.id AND cs.account_id = $1
+		 WHERE cs.card_id IS NULL
+		   AND (c.set_id = $2 OR ($2 IS NULL AND (
+		     s.account_id = $1 OR EXISTS (
+		       SELECT 1 FROM set_collaborators sc
+		       WHERE sc.set_id = s.id AND sc.account_id = $1) OR (
+		     s.visibility <> 'private' AND EXISTS (
+		       SELECT 1 FROM card_states studied
+		       JOIN cards sibling ON sibling.id = studied.card_id
+		       WHERE studied.account_id = $1 AND sibling.set_id = s.id)))))
+		 ORDER BY c.set_id ASC, c.id ASC
+		 LIMIT $3`, accountID, setID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying new cards: %w", err)
+	}
+	defer rows.Close()
+	var cards []QueueCard
+	for rows.Next() {
+		c := QueueCard{State: CardStateNew}
+		err := rows.Scan(&c.ID, &c.SetID, &c.Front, &c.Back, &c.Created)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
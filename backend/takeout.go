@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// An archive of everything tied to an account. Archives are built in the
+// background and kept on disk until they expire.
+type Takeout struct {
+	ID        int                `json:"id"`
+	AccountID int                `json:"account_id"`
+	Status    string             `json:"status"`
+	Size      pgtype.Int8        `json:"size"`
+	Error     pgtype.Text        `json:"error"`
+	Created   time.Time          `json:"created"`
+	Completed pgtype.Timestamptz `json:"completed"`
+	Expires   *time.Time         `json:"expires,omitempty"`
+}
+
+// Profile and settings written to account.json
+type TakeoutAccount struct {
+	Account
+	Timezone         string `json:"timezone"`
+	DailyNewLimit    int    `json:"daily_new_limit"`
+	DailyReviewLimit int    `json:"daily_review_limit"`
+}
+
+// A set written to sets/{id}.json. It extends the JSON export format, so
+// each file can be imported again with POST /sets/{id}/import?format=json.
+type TakeoutSet struct {
+	SetExport
+	ID         int           `json:"id"`
+	Visibility string        `json:"visibility"`
+	Created    time.Time     `json:"created"`
+	Cards      []TakeoutCard `json:"cards"`
+}
+
+type TakeoutCard struct {
+	ID      int       `json:"id"`
+	Front   string    `json:"front"`
+	Back    string    `json:"back"`
+	Created time.Time `json:"created"`
+}
+
+type TakeoutCollaboration struct {
+	SetID int    `json:"set_id"`
+	Role  string `json:"role"`
+}
+
+type TakeoutHandler struct {
+	db  *pgxpool.Pool
+	dir string
+	// Holds the uploaded pictures copied into archives
+	store BlobStore
+}
+
+func NewTakeoutHandler(db *pgxpool.Pool, dir string, store BlobStore) *TakeoutHandler {
+	return &TakeoutHandler{db: db, dir: dir, store: store}
+}
+
+// Takeout statuses
+const (
+	TakeoutPending = "pending"
+	TakeoutReady   = "ready"
+	TakeoutFailed  = "failed"
+	TakeoutExpired = "expired"
+)
+
+const (
+	takeoutLifetime = 7 * 24 * time.Hour
+	// Pending archives older than this were lost, e.g. to a restart
+	takeoutTimeout       = time.Hour
+	takeoutPurgeInterval = time.Hour
+)
+
+////////////
+// ROUTES
+
+var (
+	TakeoutRE = regexp.MustCompile(`^\/accounts\/(\d+)\/export\/?$`)
+)
+
+func (h *TakeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	groups := TakeoutRE.FindStringSubmatch(url)
+	if len(groups) != 2 {
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+	accountID, err := strconv.Atoi(groups[1])
+	if err != nil {
+		writeJSONError(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+	if claims.UserID != accountID {
+		writeJSONError(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	// REQUEST TAKEOUT ROUTE
+	case r.Method == http.MethodPost:
+		takeout, created, err := h.CreateTakeout(accountID)
+		if err != nil {
+			log.Printf("error creating takeout for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error creating export", http.StatusInternalServerError)
+			return
+		}
+		if created {
+			go h.BuildTakeout(takeout.ID, accountID)
+		}
+		writeTakeout(w, takeout, http.StatusAccepted)
+		return
+
+	// GET TAKEOUT ROUTE
+	case r.Method == http.MethodGet:
+		takeout, err := h.GetLatestTakeout(accountID)
+		if err != nil {
+			log.Printf("error getting takeout for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting export", http.StatusInternalServerError)
+			return
+		}
+		if takeout == nil {
+			writeJSONError(w, "no export requested", http.StatusNotFound)
+			return
+		}
+		if takeout.Status != TakeoutReady {
+			writeTakeout(w, takeout, http.StatusOK)
+			return
+		}
+		file, err := os.Open(h.takeoutPath(takeout.ID))
+		if err != nil {
+			log.Printf("error opening takeout for %s: %v\n", clientIP, err)
+			writeJSONError(w, "export is no longer available", http.StatusGone)
+			return
+		}
+		defer file.Close()
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="disco-export-%d.zip"`, takeout.ID))
+		http.ServeContent(w, r, "", takeout.Completed.Time, file)
+		return
+
+	default:
+		writeJSONError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+func writeTakeout(w http.ResponseWriter, takeout *Takeout, status int) {
+	data, err := json.Marshal(takeout)
+	if err != nil {
+		writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (h *TakeoutHandler) takeoutPath(id int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("takeout-%d.zip", id))
+}
+
+// Writes v as an indented JSON file in the archive
+func writeZipJSON(archive *zip.Writer, name string, v any) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Copies a stored blob into an archive. A missing blob is left out rather
+// than failing the whole export.
+func (h *TakeoutHandler) writeZipBlob(ctx context.Context, archive *zip.Writer, name string, key string) error {
+	blob, err := h.store.Get(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", key, err)
+	}
+	defer blob.Body.Close()
+	// Images are compressed already
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+	_, err = io.Copy(f, blob.Body)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Collects rows into a slice, returning an empty slice instead of nil so
+// that the JSON files always hold arrays
+func collectRows[T any](rows pgx.Rows, err error) ([]T, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+	if items == nil {
+		items = []T{}
+	}
+	return items, err
+}
+
+////////////
+// CREATE
+
+// Starts a takeout for an account. Only one archive is built at a time,
+// so if one is already pending it is returned instead and created is false.
+func (h *TakeoutHandler) CreateTakeout(accountID int) (takeout *Takeout, created bool, err error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// A lost build would otherwise hold the pending slot forever
+	_, err = tx.Exec(ctx,
+		`UPDATE takeouts SET status='failed', error='export timed out', completed=NOW()
+		 WHERE account_id=$1 AND status='pending' AND created < $2`,
+		accountID, time.Now().Add(-takeoutTimeout))
+	if err != nil {
+		return nil, false, fmt.Errorf("error failing lost takeouts: %w", err)
+	}
+	// takeouts_pending_idx makes a concurrent request wait here, then
+	// find the row inserted by the first one
+	var t Takeout
+	err = tx.QueryRow(ctx,
+		`INSERT INTO takeouts (account_id) VALUES($1)
+		 ON CONFLICT (account_id) WHERE status='pending' DO NOTHING
+		 RETURNING id, account_id, status, size, error, created, completed`, accountID).Scan(
+		&t.ID, &t.AccountID, &t.Status, &t.Size, &t.Error, &t.Created, &t.Completed)
+	created = err == nil
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = tx.QueryRow(ctx,
+			`SELECT id, account_id, status, size, error, created, completed
+			 FROM takeouts WHERE account_id=$1 AND status='pending'`, accountID).Scan(
+			&t.ID, &t.AccountID, &t.Status, &t.Size, &t.Error, &t.Created, &t.Completed)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error inserting takeout: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("error committing takeout: %w", err)
+	}
+	return &t, created, nil
+}
+
+// Builds the archive for a takeout and records the outcome. Meant to run
+// in its own goroutine.
+func (h *TakeoutHandler) BuildTakeout(id int, accountID int) {
+	size, err := h.writeArchive(id, accountID)
+	ctx := context.Background()
+	if err != nil {
+		log.Printf("error building takeout %d: %v\n", id, err)
+		_, err = h.db.Exec(ctx,
+			`UPDATE takeouts SET status='failed', error=$2, completed=NOW()
+			 WHERE id=$1`, id, "error building export")
+	} else {
+		var tag pgconn.CommandTag
+		tag, err = h.db.Exec(ctx,
+			`UPDATE takeouts SET status='ready', size=$2, completed=NOW()
+			 WHERE id=$1`, id, size)
+		// The account was deleted while the archive was being written
+		if err == nil && tag.RowsAffected() == 0 {
+			h.removeTakeoutFiles([]int{id})
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("error updating takeout %d: %v\n", id, err)
+	}
+	h.removeOldTakeouts(accountID, id)
+}
+
+// Writes the archive to a temporary file and moves it into place once it
+// is complete. Returns the size of the archive.
+func (h *TakeoutHandler) writeArchive(id int, accountID int) (int64, error) {
+	ctx := context.Background()
+	err := os.MkdirAll(h.dir, 0o700)
+	if err != nil {
+		return 0, fmt.Errorf("error creating takeout dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(h.dir, "takeout-*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("error creating archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	archive := zip.NewWriter(tmp)
+
+	// account.json
+	var account TakeoutAccount
+	err = h.db.QueryRow(ctx,
+		`SELECT id, email, email_verified, username, picture, bio, created, timezone,
+		        daily_new_limit, daily_review_limit
+		 FROM accounts WHERE id=$1`, accountID).Scan(
+		&account.ID, &account.Email, &account.EmailVerified, &account.Username, &account.Picture, &account.Bio,
+		&account.Created, &account.Timezone, &account.DailyNewLimit, &account.DailyReviewLimit)
+	if err != nil {
+		return 0, fmt.Errorf("error querying account: %w", err)
+	}
+	err = writeZipJSON(archive, "account.json", account)
+	if err != nil {
+		return 0, err
+	}
+
+	// media/picture/{size}.{ext}
+	for _, key := range pictureKeys(account.Picture.String) {
+		err = h.writeZipBlob(ctx, archive, "media/picture/"+path.Base(key), key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// sets/{id}.json
+	rows, err := h.db.Query(ctx,
+		`SELECT id, name, description, algorithm, visibility, created
+		 FROM sets WHERE account_id=$1 ORDER BY id`, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("error querying sets: %w", err)
+	}
+	var sets []TakeoutSet
+	for rows.Next() {
+		s := TakeoutSet{SetExport: SetExport{Version: SetExportVersion}}
+		err := rows.Scan(&s.ID, &s.Name, &s.Description, &s.Algorithm, &s.Visibility, &s.Created)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning row: %w", err)
+		}
+		sets = append(sets, s)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("error querying sets: %w", rows.Err())
+	}
+	for _, s := range sets {
+		s.Cards, err = collectRows[TakeoutCard](h.db.Query(ctx,
+			`SELECT id, front, back, created FROM cards WHERE set_id=$1 ORDER BY id`, s.ID))
+		if err != nil {
+			return 0, fmt.Errorf("error querying cards: %w", err)
+		}
+		err = writeZipJSON(archive, fmt.Sprintf("sets/%d.json", s.ID), s)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// collaborations.json
+	collaborations, err := collectRows[TakeoutCollaboration](h.db.Query(ctx,
+		`SELECT set_id, role FROM set_collaborators WHERE account_id=$1 ORDER BY set_id`, accountID))
+	if err != nil {
+		return 0, fmt.Errorf("error querying collaborations: %w", err)
+	}
+	err = writeZipJSON(archive, "collaborations.json", collaborations)
+	if err != nil {
+		return 0, err
+	}
+
+	// card_states.json
+	states, err := collectRows[CardState](h.db.Query(ctx,
+		`SELECT account_id, card_id, ease, interval, repetitions, lapses,
+		        stability, difficulty, state, due, introduced, last_reviewed
+		 FROM card_states WHERE account_id=$1 ORDER BY card_id`, accountID))
+	if err != nil {
+		return 0, fmt.Errorf("error querying card states: %w", err)
+	}
+	err = writeZipJSON(archive, "card_states.json", states)
+	if err != nil {
+		return 0, err
+	}
+
+	// reviews.json
+	reviews, err := collectRows[Review](h.db.Query(ctx,
+		`SELECT id, account_id, card_id, grade, duration_ms, prev_interval, new_interval, reviewed
+		 FROM reviews WHERE account_id=$1 ORDER BY reviewed, id`, accountID))
+	if err != nil {
+		return 0, fmt.Errorf("error querying reviews: %w", err)
+	}
+	err = writeZipJSON(archive, "reviews.json", reviews)
+	if err != nil {
+		return 0, err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error closing archive: %w", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading archive size: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error closing archive: %w", err)
+	}
+	err = os.Rename(tmp.Name(), h.takeoutPath(id))
+	if err != nil {
+		return 0, fmt.Errorf("error moving archive: %w", err)
+	}
+	return info.Size(), nil
+}
+
+//////////
+// READ
+
+// Returns the most recent takeout of an account, or nil if none was
+// requested. Archives past their lifetime are reported as expired and
+// pending ones that never finished as failed.
+func (h *TakeoutHandler) GetLatestTakeout(accountID int) (*Takeout, error) {
+	var t Takeout
+	err := h.db.QueryRow(context.Background(),
+		`SELECT id, account_id, status, size, error, created, completed
+		 FROM takeouts WHERE account_id=$1
+		 ORDER BY created DESC, id DESC LIMIT 1`, accountID).Scan(
+		&t.ID, &t.AccountID, &t.Status, &t.Size, &t.Error, &t.Created, &t.Completed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying takeout: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case t.Status == TakeoutPending && now.Sub(t.Created) > takeoutTimeout:
+		t.Status = TakeoutFailed
+	case t.Status == TakeoutReady || t.Status == TakeoutExpired:
+		expires := t.Completed.Time.Add(takeoutLifetime)
+		t.Expires = &expires
+		if now.After(expires) {
+			t.Status = TakeoutExpired
+		}
+	}
+	return &t, nil
+}
+
+////////////
+// DELETE
+
+// Deletes the archives of an account's earlier takeouts
+func (h *TakeoutHandler) removeOldTakeouts(accountID int, keepID int) {
+	rows, err := h.db.Query(context.Background(),
+		`DELETE FROM takeouts WHERE account_id=$1 AND id <> $2 RETURNING id`, accountID, keepID)
+	if err != nil {
+		log.Printf("error deleting old takeouts: %v\n", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		log.Printf("error deleting old takeouts: %v\n", err)
+		return
+	}
+	h.removeTakeoutFiles(ids)
+}
+
+// Marks takeouts past their lifetime as expired and deletes their
+// archives. Returns the number of archives deleted.
+func (h *TakeoutHandler) PurgeTakeouts() (int, error) {
+	rows, err := h.db.Query(context.Background(),
+		`UPDATE takeouts SET status='expired'
+		 WHERE status='ready' AND completed < $1 RETURNING id`, time.Now().Add(-takeoutLifetime))
+	if err != nil {
+		return 0, fmt.Errorf("error expiring takeouts: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, fmt.Errorf("error expiring takeouts: %w", err)
+	}
+	h.removeTakeoutFiles(ids)
+	return len(ids), nil
+}
+
+// Deletes the archives of takeouts whose rows are gone or expired
+func (h *TakeoutHandler) removeTakeoutFiles(ids []int) {
+	for _, id := range ids {
+		err := os.Remove(h.takeoutPath(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing takeout %d: %v\n", id, err)
+		}
+	}
+}
+
+// Purges expired takeouts every interval until ctx is done
+func (h *TakeoutHandler) StartTakeoutPurge(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := h.PurgeTakeouts()
+			if err != nil {
+				log.Printf("%v\n", err)
+			} else if purged > 0 {
+				log.Printf("purged %d expired takeouts\n", purged)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
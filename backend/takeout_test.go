@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"image/color"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateTakeoutOnePending(t *testing.T) {
+	db := newTestDB(t)
+	h := NewTakeoutHandler(db, t.TempDir(), nil)
+	accountID := createTestAccount(t, db, "alice", "")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ids := map[int]bool{}
+	created := 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			takeout, c, err := h.CreateTakeout(accountID)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ids[takeout.ID] = true
+			if c {
+				created++
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || len(ids) != 1 {
+		t.Fatalf("%d takeouts created with %d ids, want one", created, len(ids))
+	}
+
+	// A lost build does not block the next request
+	_, err := db.Exec(context.Background(),
+		`UPDATE takeouts SET created=$1`, time.Now().Add(-2*takeoutTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeout, c, err := h.CreateTakeout(accountID)
+	if err != nil || !c || ids[takeout.ID] {
+		t.Fatalf("CreateTakeout after a lost build = %+v, %v, %v", takeout, c, err)
+	}
+}
+
+func TestPurgeTakeouts(t *testing.T) {
+	db := newTestDB(t)
+	h := NewTakeoutHandler(db, t.TempDir(), nil)
+	accountID := createTestAccount(t, db, "alice", "")
+	ctx := context.Background()
+
+	var fresh, old int
+	err := db.QueryRow(ctx,
+		`INSERT INTO takeouts (account_id, status, completed) VALUES($1, 'ready', NOW()) RETURNING id`,
+		accountID).Scan(&fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(ctx,
+		`INSERT INTO takeouts (account_id, status, created, completed) VALUES($1, 'ready', $2, $2) RETURNING id`,
+		accountID, time.Now().Add(-takeoutLifetime-time.Hour)).Scan(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{fresh, old} {
+		err := os.WriteFile(h.takeoutPath(id), []byte("zip"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := h.PurgeTakeouts()
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeTakeouts = %d, %v, want 1", purged, err)
+	}
+	if _, err := os.Stat(h.takeoutPath(old)); !os.IsNotExist(err) {
+		t.Error("expired archive was not removed")
+	}
+	if _, err := os.Stat(h.takeoutPath(fresh)); err != nil {
+		t.Errorf("fresh archive was removed: %v", err)
+	}
+	var status string
+	err = db.QueryRow(ctx, `SELECT status FROM takeouts WHERE id=$1`, old).Scan(&status)
+	if err != nil || status != TakeoutExpired {
+		t.Errorf("expired takeout status = %q, %v", status, err)
+	}
+}
+
+func TestWriteZipBlob(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := []byte("not really a jpeg")
+	err = store.Put(ctx, "pictures/1/v/64.jpg", "image/jpeg", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &TakeoutHandler{store: store}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	err = h.writeZipBlob(ctx, archive, "media/picture/64.jpg", "pictures/1/v/64.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.writeZipBlob(ctx, archive, "media/picture/128.jpg", "pictures/1/v/128.jpg")
+	if err != nil {
+		t.Fatalf("missing blob = %v, want it left out", err)
+	}
+	archive.Close()
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 1 || r.File[0].Name != "media/picture/64.jpg" {
+		t.Fatalf("archive holds %v", r.File)
+	}
+	f, _ := r.File[0].Open()
+	got, _ := io.ReadAll(f)
+	if !bytes.Equal(got, data) {
+		t.Errorf("archived %q, want %q", got, data)
+	}
+}
+
+func TestTakeoutIncludesPicture(t *testing.T) {
+	db := newTestDB(t)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewTakeoutHandler(db, t.TempDir(), store)
+	accountID := createTestAccount(t, db, "alice", "")
+	picture := encodePNG(t, halvesImage(80, 80, color.White, color.Black))
+	upload, err := NewPictureHandler(db, store).UploadPicture(accountID, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	takeout, _, err := h.CreateTakeout(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.BuildTakeout(takeout.ID, accountID)
+	archive, err := zip.OpenReader(h.takeoutPath(takeout.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	for _, key := range pictureKeys(upload.Picture) {
+		name := "media/picture/" + path.Base(key)
+		f, ok := files[name]
+		if !ok {
+			t.Errorf("%s missing from the archive", name)
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(r)
+		r.Close()
+		blob, err := store.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := io.ReadAll(blob.Body)
+		blob.Body.Close()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the stored picture", name)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Personal access tokens let scripts call the API with an
+// "Authorization: Bearer" header instead of cookies. Only a hash of each
+// token is stored; the token itself is shown once, when it is created.
+type AccessToken struct {
+	ID       int                `json:"id"`
+	Name     string             `json:"name"`
+	Scope    string             `json:"scope"`
+	Expires  pgtype.Timestamptz `json:"expires"`
+	LastUsed pgtype.Timestamptz `json:"last_used"`
+	Created  time.Time          `json:"created"`
+}
+
+// Returned once on creation
+type NewAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
+
+type AccessTokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// Days until the token expires, or null for a token that does not
+	ExpiresInDays *int `json:"expires_in_days"`
+}
+
+type TokenHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewTokenHandler(db *pgxpool.Pool) *TokenHandler {
+	return &TokenHandler{db: db}
+}
+
+// What a token may do
+const (
+	ScopeRead  = "read"  // GET requests, besides sessions, 2FA and providers
+	ScopeWrite = "write" // also changes to sets and cards
+	ScopeAdmin = "admin" // also account, session, 2FA and provider settings
+)
+
+const (
+	// Prefix of every token, so that leaked tokens are easy to spot
+	accessTokenPrefix   = "disco_pat_"
+	maxAccessTokens     = 50
+	maxTokenNameLength  = 100
+	maxTokenExpiryDays  = 365
+	tokenLastUsedPeriod = time.Minute
+)
+
+var (
+	errInvalidAccessToken = errors.New("invalid or expired access token")
+	errTooManyTokens      = errors.New("too many access tokens")
+)
+
+////////////
+// ROUTES
+
+var (
+	TokensRE      = regexp.MustCompile(`^\/tokens\/?$`)
+	TokenREWithID = regexp.MustCompile(`^\/tokens\/(\d+)\/?$`)
+	// Routes that need the admin scope. Account routes only need it for
+	// changes.
+	tokenAdminRE   = regexp.MustCompile(`^\/(sessions|2fa|tokens|oidc)(\/|$)`)
+	tokenAccountRE = regexp.MustCompile(`^\/accounts(\/|$)`)
+)
+
+func (h *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	// A leaked token must not be able to mint more tokens
+	if claims.Scope != "" {
+		writeJSONError(w, "access tokens cannot manage tokens", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	// LIST TOKENS ROUTE
+	case TokensRE.MatchString(url) && r.Method == http.MethodGet:
+		tokens, err := h.GetTokens(claims.UserID)
+		if err != nil {
+			log.Printf("error getting tokens for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting tokens", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(tokens)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+
+	// CREATE TOKEN ROUTE
+	case TokensRE.MatchString(url) && r.Method == http.MethodPost:
+		defer r.Body.Close()
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		var req AccessTokenRequest
+		err = json.Unmarshal(bytes, &req)
+		if err != nil {
+			writeJSONError(w, "error unmarshalling json", http.StatusBadRequest)
+			return
+		}
+		err = validateTokenRequest(&req)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token, err := h.CreateToken(claims.UserID, req)
+		if errors.Is(err, errTooManyTokens) {
+			writeJSONError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("error creating token for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error creating token", http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(token)
+		if err != nil {
+			writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+		return
+
+	// REVOKE TOKEN ROUTE
+	case TokenREWithID.MatchString(url) && r.Method == http.MethodDelete:
+		groups := TokenREWithID.FindStringSubmatch(url)
+		id, err := strconv.Atoi(groups[1])
+		if err != nil {
+			writeJSONError(w, "invalid token id", http.StatusBadRequest)
+			return
+		}
+		found, err := h.DeleteToken(claims.UserID, id)
+		if err != nil {
+			log.Printf("error deleting token for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error deleting token", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			writeJSONError(w, "token not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+/////////////
+// HELPERS
+
+func validateTokenRequest(req *AccessTokenRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if len(req.Name) > maxTokenNameLength {
+		return fmt.Errorf("name is too long")
+	}
+	switch req.Scope {
+	case ScopeRead, ScopeWrite, ScopeAdmin:
+	default:
+		return fmt.Errorf("scope must be read, write or admin")
+	}
+	if req.ExpiresInDays != nil && (*req.ExpiresInDays < 1 || *req.ExpiresInDays > maxTokenExpiryDays) {
+		return fmt.Errorf("expires_in_days must be between 1 and %d", maxTokenExpiryDays)
+	}
+	return nil
+}
+
+// Returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Reports whether a token scope covers a request. Claims from cookies have
+// no scope and may do anything.
+func scopeAllows(scope string, r *http.Request) bool {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+	admin := tokenAdminRE.MatchString(r.URL.Path) ||
+		(tokenAccountRE.MatchString(r.URL.Path) && !safe)
+	switch scope {
+	case "", ScopeAdmin:
+		return true
+	case ScopeWrite:
+		return !admin
+	case ScopeRead:
+		return !admin && safe
+	}
+	return false
+}
+
+// Returns the claims of a personal access token
+func (h *AuthMiddleware) AuthenticateAccessToken(token string) (*Claims, error) {
+	if !strings.HasPrefix(token, accessTokenPrefix) {
+		return nil, errInvalidAccessToken
+	}
+	ctx := context.Background()
+	var id int
+	var lastUsed pgtype.Timestamptz
+	claims := Claims{}
+	err := h.db.QueryRow(ctx,
+		`SELECT t.id, t.scope, t.last_used, a.id, a.username, a.email_verified
+		 FROM access_tokens t JOIN accounts a ON a.id = t.account_id
+		 WHERE t.token_hash=$1 AND (t.expires IS NULL OR t.expires > NOW())`,
+		hashToken(token)).Scan(&id, &claims.Scope, &lastUsed, &claims.UserID, &claims.Username, &claims.Verified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidAccessToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying access token: %w", err)
+	}
+	// Recorded at most once a minute to spare a write on every request
+	if !lastUsed.Valid || time.Since(lastUsed.Time) > tokenLastUsedPeriod {
+		_, err = h.db.Exec(ctx,
+			`UPDATE access_tokens SET last_used=NOW() WHERE id=$1`, id)
+		if err != nil {
+			return nil, fmt.Errorf("error updating access token: %w", err)
+		}
+	}
+	return &claims, nil
+}
+
+////////////
+// CREATE
+
+// Creates a token for the account. The token is only returned here.
+func (h *TokenHandler) CreateToken(accountID int, req AccessTokenRequest) (*NewAccessToken, error) {
+	ctx := context.Background()
+	var count int
+	err := h.db.QueryRow(ctx,
+		`SELECT COUNT(*) FROM access_tokens WHERE account_id=$1`, accountID).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("error counting tokens: %w", err)
+	}
+	if count >= maxAccessTokens {
+		return nil, errTooManyTokens
+	}
+	secret, err := GenerateToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("error generating token: %w", err)
+	}
+	token := NewAccessToken{Token: accessTokenPrefix + secret}
+	var expires *time.Time
+	if req.ExpiresInDays != nil {
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expires = &t
+	}
+	err = h.db.QueryRow(ctx,
+		`INSERT INTO access_tokens (account_id, name, scope, token_hash, expires)
+		 VALUES($1, $2, $3, $4, $5)
+		 RETURNING id, name, scope, expires, last_used, created`,
+		accountID, req.Name, req.Scope, hashToken(token.Token), expires).Scan(
+		&token.ID, &token.Name, &token.Scope, &token.Expires, &token.LastUsed, &token.Created)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting token: %w", err)
+	}
+	return &token, nil
+}
+
+//////////
+// READ
+
+// Returns the account's tokens, newest first. Expired tokens are listed
+// until they are deleted.
+func (h *TokenHandler) GetTokens(accountID int) ([]AccessToken, error) {
+	rows, err := h.db.Query(context.Background(),
+		`SELECT id, name, scope, expires, last_used, created
+		 FROM access_tokens WHERE account_id=$1
+		 ORDER BY created DESC`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tokens: %w", err)
+	}
+	defer rows.Close()
+	tokens := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		err := rows.Scan(&t.ID, &t.Name, &t.Scope, &t.Expires, &t.LastUsed, &t.Created)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+////////////
+// DELETE
+
+// Revokes one of the account's tokens. Returns false if there is no such
+// token.
+func (h *TokenHandler) DeleteToken(accountID int, id int) (bool, error) {
+	tag, err := h.db.Exec(context.Background(),
+		`DELETE FROM access_tokens WHERE account_id=$1 AND id=$2`, accountID, id)
+	if err != nil {
+		return false, fmt.Errorf("error deleting token: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScopeAllows(t *testing.T) {
+	for _, tt := range []struct {
+		method string
+		path   string
+		read   bool
+		write  bool
+	}{
+		{http.MethodGet, "/sets", true, true},
+		{http.MethodPost, "/sets", false, true},
+		{http.MethodDelete, "/sets/3", false, true},
+		{http.MethodGet, "/accounts/1", true, true},
+		{http.MethodHead, "/accounts/1", true, true},
+		{http.MethodPatch, "/accounts/1", false, false},
+		{http.MethodPost, "/accounts/1/password", false, false},
+		{http.MethodDelete, "/accounts/1", false, false},
+		{http.MethodGet, "/sessions", false, false},
+		{http.MethodPost, "/sessions/revoke-others", false, false},
+		{http.MethodGet, "/2fa", false, false},
+		{http.MethodPost, "/2fa/disable", false, false},
+		{http.MethodGet, "/tokens", false, false},
+		{http.MethodPost, "/tokens", false, false},
+		{http.MethodDelete, "/tokens/4", false, false},
+		{http.MethodGet, "/oidc/identities", false, false},
+		{http.MethodPost, "/oidc/google/link", false, false},
+		// Only whole path segments count
+		{http.MethodGet, "/tokensets", true, true},
+		{http.MethodPost, "/accountsx", false, true},
+	} {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for _, scope := range []struct {
+			name string
+			want bool
+		}{
+			{"", true},
+			{ScopeAdmin, true},
+			{ScopeWrite, tt.write},
+			{ScopeRead, tt.read},
+			{"unknown", false},
+		} {
+			if got := scopeAllows(scope.name, r); got != scope.want {
+				t.Errorf("scope %q, %s %s: %v, want %v", scope.name, tt.method, tt.path, got, scope.want)
+			}
+		}
+	}
+}
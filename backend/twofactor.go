@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+///////////
+// TYPES
+
+// Optional TOTP (RFC 6238) second factor. Enrollment stores a secret that
+// only takes effect once a first code confirms it. Logging in to an account
+// with 2FA goes through a short-lived challenge instead of setting cookies
+// right away.
+type TwoFactorHandler struct {
+	db     *pgxpool.Pool
+	issuer string
+	// Clock used for codes and challenges, replaced in tests
+	now func() time.Time
+}
+
+func NewTwoFactorHandler(db *pgxpool.Pool, issuer string) *TwoFactorHandler {
+	return &TwoFactorHandler{db: db, issuer: issuer, now: time.Now}
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TwoFactorCode struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// Returned by /login in place of the auth cookies when the account has 2FA
+type LoginChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from one period before or after are accepted for clock drift
+	totpSkew         = 1
+	totpSecretBytes  = 20
+	recoveryCodeLen  = 10
+	recoveryCodeSize = 10 // bytes, written as 16 base32 characters
+
+	loginChallengeExpiration = 5 * time.Minute
+	loginChallengeAttempts   = 5
+)
+
+var (
+	errInvalidChallenge = errors.New("invalid or expired challenge")
+	errInvalidCode      = errors.New("invalid code")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+////////////
+// ROUTES
+
+var (
+	TwoFactorEnrollRE   = regexp.MustCompile(`^\/2fa\/enroll\/?$`)
+	TwoFactorQRRE       = regexp.MustCompile(`^\/2fa\/enroll\/qr\.png$`)
+	TwoFactorConfirmRE  = regexp.MustCompile(`^\/2fa\/confirm\/?$`)
+	TwoFactorDisableRE  = regexp.MustCompile(`^\/2fa\/disable\/?$`)
+	TwoFactorRecoveryRE = regexp.MustCompile(`^\/2fa\/recovery-codes\/?$`)
+	LoginTwoFactorRE    = regexp.MustCompile(`^\/login\/2fa\/?$`)
+)
+
+func (h *TwoFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Path
+	claims := r.Context().Value("claims").(*Claims)
+	clientIP := r.Context().Value("clientip").(string)
+
+	switch {
+	// START ENROLLMENT ROUTE
+	case TwoFactorEnrollRE.MatchString(url) && r.Method == http.MethodPost:
+		enrollment, err := h.Enroll(claims.UserID, claims.Username)
+		if errors.Is(err, errTwoFactorEnabled) {
+			writeJSONError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("error enrolling 2fa for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error enrolling", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, enrollment, http.StatusOK)
+		return
+
+	// ENROLLMENT QR CODE ROUTE
+	case TwoFactorQRRE.MatchString(url) && r.Method == http.MethodGet:
+		secret, enabled, err := h.getSecret(context.Background(), claims.UserID)
+		if err != nil {
+			log.Printf("error getting 2fa secret for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error getting secret", http.StatusInternalServerError)
+			return
+		}
+		if secret == "" || enabled {
+			writeJSONError(w, "no enrollment in progress", http.StatusNotFound)
+			return
+		}
+		png, err := qrcode.Encode(h.otpauthURI(claims.Username, secret), qrcode.Medium, 256)
+		if err != nil {
+			log.Printf("error encoding qr code for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error encoding qr code", http.StatusInternalServerError)
+			return
+		}
+		// The image holds the secret
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+
+	// CONFIRM ENROLLMENT ROUTE
+	case TwoFactorConfirmRE.MatchString(url) && r.Method == http.MethodPost:
+		var body TwoFactorCode
+		if !readJSONBody(w, r, &body) {
+			return
+		}
+		codes, err := h.Confirm(claims.UserID, body.Code)
+		if errors.Is(err, errInvalidCode) {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error confirming 2fa for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error confirming", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, RecoveryCodes{Codes: codes}, http.StatusOK)
+		return
+
+	// NEW RECOVERY CODES ROUTE
+	case TwoFactorRecoveryRE.MatchString(url) && r.Method == http.MethodPost:
+		var body TwoFactorCode
+		if !readJSONBody(w, r, &body) {
+			return
+		}
+		codes, err := h.RegenerateRecoveryCodes(claims.UserID, body.Code)
+		if errors.Is(err, errInvalidCode) {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error creating recovery codes for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error creating recovery codes", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, RecoveryCodes{Codes: codes}, http.StatusOK)
+		return
+
+	// DISABLE ROUTE
+	case TwoFactorDisableRE.MatchString(url) && r.Method == http.MethodPost:
+		var body TwoFactorCode
+		if !readJSONBody(w, r, &body) {
+			return
+		}
+		err := h.reauthenticate(claims.UserID, body.Password, body.Code)
+		if reauthFailed(err) {
+			writeJSONError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			err = h.Disable(claims.UserID)
+		}
+		if err != nil {
+			log.Printf("error disabling 2fa for %s: %v\n", clientIP, err)
+			writeJSONError(w, "error disabling", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		writeJSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+}
+
+// Handles POST /login/2fa, the second step of logging in to an account
+// with 2FA. Sets the auth cookies once the challenge is completed.
+func (h *AuthMiddleware) serveLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	err := r.ParseMultipartForm(0)
+	if err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	challenge := r.FormValue("challenge")
+	code := r.FormValue("code")
+	recoveryCode := r.FormValue("recovery_code")
+	if challenge == "" || (code == "" && recoveryCode == "") {
+		http.Error(w, "missing challenge or code", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	accountID, err := h.twoFactor.challengeAccount(ctx, challenge)
+	if errors.Is(err, errInvalidChallenge) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("error finishing 2fa login for %s: %v\n", clientIP, err)
+		http.Error(w, "error authenticating", http.StatusInternalServerError)
+		return
+	}
+	account, err := h.accountHandler.GetAccountByID(accountID)
+	if err != nil || account == nil {
+		log.Printf("error getting account for %s: %v\n", clientIP, err)
+		http.Error(w, "error authenticating", http.StatusInternalServerError)
+		return
+	}
+	// Wrong codes count as failed logins, so guessing them across many
+	// challenges ends in the same lockout as guessing passwords
+	attempt, ok := h.checkLoginLimit(w, r, account.Username)
+	if !ok {
+		return
+	}
+	_, err = h.twoFactor.FinishLogin(challenge, code, recoveryCode)
+	if errors.Is(err, errInvalidCode) {
+		err = h.limiter.Fail(ctx, attempt)
+		if err != nil {
+			log.Printf("error recording failed login for %s: %v\n", clientIP, err)
+		}
+		http.Error(w, errInvalidCode.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		h.limiter.Release(ctx, attempt)
+	}
+	if errors.Is(err, errInvalidChallenge) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("error finishing 2fa login for %s: %v\n", clientIP, err)
+		http.Error(w, "error authenticating", http.StatusInternalServerError)
+		return
+	}
+	err = h.limiter.Succeed(ctx, attempt)
+	if err != nil {
+		log.Printf("error recording login for %s: %v\n", clientIP, err)
+	}
+	h.SetAuthCookies(w, r, account.ID, account.Username)
+}
+
+/////////////
+// HELPERS
+
+var errTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+func writeJSON(w http.ResponseWriter, v any, status int) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeJSONError(w, "error marshalling json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Decodes a JSON request body, writing a 400 and returning false on failure
+func readJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	defer r.Body.Close()
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, "error reading body", http.StatusBadRequest)
+		return false
+	}
+	err = json.Unmarshal(bytes, v)
+	if err != nil {
+		writeJSONError(w, "error unmarshalling json", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (h *TwoFactorHandler) otpauthURI(username string, secret string) string {
+	label := url.PathEscape(h.issuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", h.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Computes the code for a time step as described in RFC 4226 and 6238
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// Checks a code against the steps around t. Steps at or before lastStep
+// were already used and are rejected so that a code cannot be replayed.
+// Returns the matching step.
+func ValidateTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Recovery codes are compared without dashes, spaces or case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32NoPad.EncodeToString(b))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// Returns the account's secret, which is pending until enabled is true
+func (h *TwoFactorHandler) getSecret(ctx context.Context, accountID int) (string, bool, error) {
+	var secret pgtype.Text
+	var enabled bool
+	err := h.db.QueryRow(ctx,
+		`SELECT totp_secret, totp_enabled FROM accounts WHERE id=$1`, accountID).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, fmt.Errorf("error querying totp secret: %w", err)
+	}
+	return secret.String, enabled, nil
+}
+
+// Confirms that the account owner is present: the password, or for
+// accounts without one a recent sign in through GET
+// /oidc/{provider}/reauth, and a current code if 2FA is enabled. Returns
+// errWrongPassword, errReauthRequired or errInvalidCode.
+func (h *TwoFactorHandler) reauthenticate(accountID int, password string, code string) error {
+	var hash string
+	var reauthenticated pgtype.Timestamptz
+	err := h.db.QueryRow(context.Background(),
+		`SELECT password, oidc_reauthenticated FROM accounts WHERE id=$1`, accountID).Scan(&hash, &reauthenticated)
+	if err != nil {
+		return fmt.Errorf("error querying password: %w", err)
+	}
+	if hash == noPassword {
+		if !reauthenticated.Valid || time.Since(reauthenticated.Time) > oidcReauthExpiration {
+			return errReauthRequired
+		}
+	} else if !VerifyPassword(password, hash) {
+		return errWrongPassword
+	}
+	_, enabled, err := h.getSecret(context.Background(), accountID)
+	if err != nil || !enabled {
+		return err
+	}
+	ok, err := h.CheckCode(accountID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// Reports whether reauthenticate turned the caller away, as opposed to
+// failing
+func reauthFailed(err error) bool {
+	return errors.Is(err, errWrongPassword) || errors.Is(err, errReauthRequired) || errors.Is(err, errInvalidCode)
+}
+
+// Returns the account a live login challenge belongs to
+func (h *TwoFactorHandler) challengeAccount(ctx context.Context, challenge string) (int, error) {
+	var accountID int
+	err := h.db.QueryRow(ctx,
+		`SELECT account_id FROM login_challenges
+		 WHERE token_hash=$1 AND expires > $2 AND attempts < $3`,
+		hashToken(challenge), h.now(), loginChallengeAttempts).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, errInvalidChallenge
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error querying challenge: %w", err)
+	}
+	return accountID, nil
+}
+
+// Validates a TOTP code inside a transaction, locking the account row so
+// that two requests cannot use the same code
+func (h *TwoFactorHandler) useCode(ctx context.Context, tx pgx.Tx, accountID int, code string, enabled bool) (bool, error) {
+	var secret pgtype.Text
+	var isEnabled bool
+	var lastStep pgtype.Int8
+	err := tx.QueryRow(ctx,
+		`SELECT totp_secret, totp_enabled, totp_last_step FROM accounts
+		 WHERE id=$1 FOR UPDATE`, accountID).Scan(&secret, &isEnabled, &lastStep)
+	if err != nil {
+		return false, fmt.Errorf("error querying totp secret: %w", err)
+	}
+	if !secret.Valid || isEnabled != enabled {
+		return false, nil
+	}
+	step, ok := ValidateTOTP(secret.String, strings.TrimSpace(code), h.now(), lastStep.Int64)
+	if !ok {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET totp_last_step=$2 WHERE id=$1`, accountID, step)
+	if err != nil {
+		return false, fmt.Errorf("error updating totp step: %w", err)
+	}
+	return true, nil
+}
+
+// Uses up one of the account's recovery codes
+func (h *TwoFactorHandler) useRecoveryCode(ctx context.Context, tx pgx.Tx, accountID int, code string) (bool, error) {
+	tag, err := tx.Exec(ctx,
+		`UPDATE recovery_codes SET used=$3
+		 WHERE account_id=$1 AND code_hash=$2 AND used IS NULL`,
+		accountID, hashToken(normalizeRecoveryCode(code)), h.now())
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+////////////
+// CREATE
+
+// Starts enrollment with a new secret, replacing any earlier pending one
+func (h *TwoFactorHandler) Enroll(accountID int, username string) (*TOTPEnrollment, error) {
+	key := make([]byte, totpSecretBytes)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("error generating secret: %w", err)
+	}
+	secret := base32NoPad.EncodeToString(key)
+	tag, err := h.db.Exec(context.Background(),
+		`UPDATE accounts SET totp_secret=$2, totp_last_step=NULL
+		 WHERE id=$1 AND NOT totp_enabled`, accountID, secret)
+	if err != nil {
+		return nil, fmt.Errorf("error storing secret: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, errTwoFactorEnabled
+	}
+	return &TOTPEnrollment{Secret: secret, URI: h.otpauthURI(username, secret)}, nil
+}
+
+// Replaces the account's recovery codes and returns the new ones. They
+// are only ever shown this once.
+func (h *TwoFactorHandler) replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, accountID int) ([]string, error) {
+	_, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE account_id=$1`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	codes := make([]string, recoveryCodeLen)
+	for i := range codes {
+		codes[i], err = generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("error generating recovery code: %w", err)
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO recovery_codes (account_id, code_hash) VALUES($1, $2)`,
+			accountID, hashToken(normalizeRecoveryCode(codes[i])))
+		if err != nil {
+			return nil, fmt.Errorf("error inserting recovery code: %w", err)
+		}
+	}
+	return codes, nil
+}
+
+// Issues a login challenge if the account has 2FA enabled. Returns an
+// empty token otherwise.
+func (h *TwoFactorHandler) StartLogin(accountID int) (string, error) {
+	ctx := context.Background()
+	var enabled bool
+	err := h.db.QueryRow(ctx,
+		`SELECT totp_enabled FROM accounts WHERE id=$1`, accountID).Scan(&enabled)
+	if err != nil {
+		return "", fmt.Errorf("error querying account: %w", err)
+	}
+	if !enabled {
+		return "", nil
+	}
+	token, err := GenerateToken(32)
+	if err != nil {
+		return "", fmt.Errorf("error generating challenge: %w", err)
+	}
+	now := h.now()
+	_, err = h.db.Exec(ctx,
+		`DELETE FROM login_challenges WHERE expires < $1`, now)
+	if err != nil {
+		return "", fmt.Errorf("error deleting expired challenges: %w", err)
+	}
+	_, err = h.db.Exec(ctx,
+		`INSERT INTO login_challenges (account_id, token_hash, expires)
+		 VALUES($1, $2, $3)`, accountID, hashToken(token), now.Add(loginChallengeExpiration))
+	if err != nil {
+		return "", fmt.Errorf("error inserting challenge: %w", err)
+	}
+	return token, nil
+}
+
+////////////
+// UPDATE
+
+// Enables 2FA once the first code from the authenticator app matches.
+// Returns the recovery codes.
+func (h *TwoFactorHandler) Confirm(accountID int, code string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	ok, err := h.useCode(ctx, tx, accountID, code, false)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidCode
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET totp_enabled=TRUE WHERE id=$1`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("error enabling totp: %w", err)
+	}
+	codes, err := h.replaceRecoveryCodes(ctx, tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// Replaces the recovery codes of an account with 2FA enabled. Needs a
+// current code so that a stolen session alone cannot take them.
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(accountID int, code string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	ok, err := h.useCode(ctx, tx, accountID, code, true)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidCode
+	}
+	codes, err := h.replaceRecoveryCodes(ctx, tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// Checks and uses up a current code of an account with 2FA enabled, for
+// confirming sensitive changes
+func (h *TwoFactorHandler) CheckCode(accountID int, code string) (bool, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	ok, err := h.useCode(ctx, tx, accountID, code, true)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Completes a login challenge with a TOTP code or a recovery code and
+// returns the account it belongs to. A challenge survives a few wrong
+// codes and is used up by the right one.
+func (h *TwoFactorHandler) FinishLogin(challenge string, code string, recoveryCode string) (int, error) {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var id, accountID, attempts int
+	err = tx.QueryRow(ctx,
+		`SELECT id, account_id, attempts FROM login_challenges
+		 WHERE token_hash=$1 AND expires > $2
+		 FOR UPDATE`, hashToken(challenge), h.now()).Scan(&id, &accountID, &attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, errInvalidChallenge
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error querying challenge: %w", err)
+	}
+	if attempts >= loginChallengeAttempts {
+		return -1, errInvalidChallenge
+	}
+	var ok bool
+	if recoveryCode != "" {
+		ok, err = h.useRecoveryCode(ctx, tx, accountID, recoveryCode)
+	} else {
+		ok, err = h.useCode(ctx, tx, accountID, code, true)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if ok {
+		_, err = tx.Exec(ctx, `DELETE FROM login_challenges WHERE id=$1`, id)
+	} else {
+		_, err = tx.Exec(ctx,
+			`UPDATE login_challenges SET attempts=attempts+1 WHERE id=$1`, id)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error updating challenge: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("error committing transaction: %w", err)
+	}
+	if !ok {
+		return -1, errInvalidCode
+	}
+	return accountID, nil
+}
+
+////////////
+// DELETE
+
+func (h *TwoFactorHandler) Disable(accountID int) error {
+	ctx := context.Background()
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET totp_secret=NULL, totp_enabled=FALSE, totp_last_step=NULL
+		 WHERE id=$1`, accountID)
+	if err != nil {
+		return fmt.Errorf("error disabling totp: %w", err)
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE account_id=$1`, accountID)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, _ := base32NoPad.DecodeString(rfcTOTPSecret)
+	// RFC 6238 appendix B, cut to the last 6 digits
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	key, _ := base32NoPad.DecodeString(rfcTOTPSecret)
+	const step = 1000
+	code := totpCode(key, step)
+	at := func(s int64) time.Time { return time.Unix(s*totpPeriod+7, 0) }
+
+	for _, tt := range []struct {
+		name string
+		now  int64
+		ok   bool
+	}{
+		{"current step", step, true},
+		{"one step late", step + 1, true},
+		{"one step early", step - 1, true},
+		{"two steps late", step + 2, false},
+		{"two steps early", step - 2, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ValidateTOTP(rfcTOTPSecret, code, at(tt.now), 0)
+			if ok != tt.ok || (ok && got != step) {
+				t.Errorf("ValidateTOTP = %d, %v, want step %d, %v", got, ok, step, tt.ok)
+			}
+		})
+	}
+
+	if _, ok := ValidateTOTP(rfcTOTPSecret, code, at(step), step); ok {
+		t.Error("a code was accepted again for a step already used")
+	}
+	if _, ok := ValidateTOTP(rfcTOTPSecret, code, at(step), step+1); ok {
+		t.Error("a code was accepted for a step before the last one used")
+	}
+	if got, ok := ValidateTOTP(rfcTOTPSecret, code, at(step), step-1); !ok || got != step {
+		t.Errorf("ValidateTOTP after an earlier step = %d, %v", got, ok)
+	}
+	if _, ok := ValidateTOTP(rfcTOTPSecret, "12345", at(step), 0); ok {
+		t.Error("a short code was accepted")
+	}
+	if _, ok := ValidateTOTP("not base32!", code, at(step), 0); ok {
+		t.Error("a code was accepted for an invalid secret")
+	}
+}
+
+// A 2FA handler on a clock the test moves, and an account enrolled with it
+type twoFactorFixture struct {
+	h         *TwoFactorHandler
+	now       *time.Time
+	accountID int
+	key       []byte
+	recovery  []string
+}
+
+func newTwoFactorFixture(t *testing.T) *twoFactorFixture {
+	t.Helper()
+	db := newTestDB(t)
+	now := time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+	f := &twoFactorFixture{now: &now}
+	f.h = &TwoFactorHandler{db: db, issuer: "disco", now: func() time.Time { return *f.now }}
+	f.accountID = createTestAccount(t, db, "alice", "")
+	enrollment, err := f.h.Enroll(f.accountID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.key, _ = base32NoPad.DecodeString(enrollment.Secret)
+	f.recovery, err = f.h.Confirm(f.accountID, f.code())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The code used to confirm cannot log in
+	f.advance(totpPeriod * time.Second)
+	return f
+}
+
+func (f *twoFactorFixture) code() string {
+	return totpCode(f.key, f.now.Unix()/totpPeriod)
+}
+
+// A code that is not valid at any step in the current window
+func (f *twoFactorFixture) wrongCode() string {
+	step := f.now.Unix() / totpPeriod
+	for _, candidate := range []string{"000000", "111111", "222222", "333333"} {
+		valid := false
+		for s := step - totpSkew; s <= step+totpSkew; s++ {
+			valid = valid || totpCode(f.key, s) == candidate
+		}
+		if !valid {
+			return candidate
+		}
+	}
+	panic("no wrong code found")
+}
+
+func (f *twoFactorFixture) advance(d time.Duration) {
+	*f.now = f.now.Add(d)
+}
+
+func TestFinishLoginCodesWorkOnce(t *testing.T) {
+	f := newTwoFactorFixture(t)
+
+	challenge, err := f.h.StartLogin(f.accountID)
+	if err != nil || challenge == "" {
+		t.Fatalf("StartLogin = %q, %v", challenge, err)
+	}
+	code := f.code()
+	id, err := f.h.FinishLogin(challenge, code, "")
+	if err != nil || id != f.accountID {
+		t.Fatalf("FinishLogin = %d, %v", id, err)
+	}
+	if _, err := f.h.FinishLogin(challenge, f.code(), ""); !errors.Is(err, errInvalidChallenge) {
+		t.Errorf("reusing a completed challenge = %v, want errInvalidChallenge", err)
+	}
+
+	// The same code on a new challenge is a replay
+	challenge, _ = f.h.StartLogin(f.accountID)
+	if _, err := f.h.FinishLogin(challenge, code, ""); !errors.Is(err, errInvalidCode) {
+		t.Errorf("replayed code = %v, want errInvalidCode", err)
+	}
+
+	// Recovery codes work once, written any way
+	recovery := f.recovery[0]
+	challenge, _ = f.h.StartLogin(f.accountID)
+	id, err = f.h.FinishLogin(challenge, "", " "+recovery[:4]+recovery[5:]+" ")
+	if err != nil || id != f.accountID {
+		t.Fatalf("FinishLogin with a recovery code = %d, %v", id, err)
+	}
+	challenge, _ = f.h.StartLogin(f.accountID)
+	if _, err := f.h.FinishLogin(challenge, "", recovery); !errors.Is(err, errInvalidCode) {
+		t.Errorf("reused recovery code = %v, want errInvalidCode", err)
+	}
+	if id, err := f.h.FinishLogin(challenge, "", f.recovery[1]); err != nil || id != f.accountID {
+		t.Errorf("another recovery code = %d, %v", id, err)
+	}
+}
+
+func TestFinishLoginAttemptCap(t *testing.T) {
+	f := newTwoFactorFixture(t)
+
+	challenge, _ := f.h.StartLogin(f.accountID)
+	for i := range loginChallengeAttempts {
+		if _, err := f.h.FinishLogin(challenge, f.wrongCode(), ""); !errors.Is(err, errInvalidCode) {
+			t.Fatalf("attempt %d = %v, want errInvalidCode", i, err)
+		}
+	}
+	if _, err := f.h.FinishLogin(challenge, f.code(), ""); !errors.Is(err, errInvalidChallenge) {
+		t.Errorf("right code after the attempts ran out = %v, want errInvalidChallenge", err)
+	}
+
+	challenge, _ = f.h.StartLogin(f.accountID)
+	f.advance(loginChallengeExpiration + time.Second)
+	if _, err := f.h.FinishLogin(challenge, f.code(), ""); !errors.Is(err, errInvalidChallenge) {
+		t.Errorf("right code after the challenge expired = %v, want errInvalidChallenge", err)
+	}
+}
+
+func TestLoginTwoFactorLockout(t *testing.T) {
+	f := newTwoFactorFixture(t)
+	db := f.h.db
+	accounts := func(ctx context.Context, name string) (*Account, error) { return findLoginAccount(ctx, db, name) }
+	limiter := &LoginLimiter{store: NewMemoryLimiterStore(), accounts: accounts, mailer: &LogMailer{}, now: f.h.now}
+	auth := &AuthMiddleware{db: db, accountHandler: &AccountHandler{db: db}, twoFactor: f.h, limiter: limiter}
+
+	post := func(challenge string, code string) int {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("challenge", challenge)
+		form.WriteField("code", code)
+		form.Close()
+		r := httptest.NewRequest(http.MethodPost, "/login/2fa", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r = r.WithContext(context.WithValue(r.Context(), "clientip", "10.0.0.1"))
+		w := httptest.NewRecorder()
+		auth.serveLoginTwoFactor(w, r)
+		return w.Code
+	}
+
+	// Wrong codes spread over several challenges, waiting out the delay
+	// between failures each time
+	var challenge string
+	for i := range accountLockoutLimit {
+		if i%loginChallengeAttempts == 0 {
+			challenge, _ = f.h.StartLogin(f.accountID)
+		}
+		if status := post(challenge, f.wrongCode()); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d got status %d, want 401", i, status)
+		}
+		f.advance(maxLoginDelay)
+	}
+
+	challenge, _ = f.h.StartLogin(f.accountID)
+	if status := post(challenge, f.code()); status != http.StatusTooManyRequests {
+		t.Errorf("right code on a locked account got status %d, want 429", status)
+	}
+	var limited *loginLimitError
+	_, err := limiter.Check(context.Background(), "10.0.0.2", "alice")
+	if !errors.As(err, &limited) || !limited.Locked {
+		t.Errorf("password login after the lockout = %v, want a lock", err)
+	}
+}
+
+// The fixture account has no password, so it disables 2FA by signing in
+// with its provider again
+func TestDisableWithoutPassword(t *testing.T) {
+	f := newTwoFactorFixture(t)
+	post := func(code string) int {
+		body := strings.NewReader(`{"code": "` + code + `"}`)
+		r := httptest.NewRequest(http.MethodPost, "/2fa/disable", body)
+		ctx := context.WithValue(r.Context(), "claims", &Claims{UserID: f.accountID, Username: "alice"})
+		r = r.WithContext(context.WithValue(ctx, "clientip", "10.0.0.1"))
+		w := httptest.NewRecorder()
+		f.h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if status := post(f.code()); status != http.StatusForbidden {
+		t.Fatalf("disable before signing in again got status %d, want 403", status)
+	}
+	_, err := f.h.db.Exec(context.Background(),
+		`UPDATE accounts SET oidc_reauthenticated=now() WHERE id=$1`, f.accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := post(f.wrongCode()); status != http.StatusForbidden {
+		t.Fatalf("disable with a wrong code got status %d, want 403", status)
+	}
+	if status := post(f.code()); status != http.StatusNoContent {
+		t.Fatalf("disable got status %d, want 204", status)
+	}
+	if _, enabled, err := f.h.getSecret(context.Background(), f.accountID); err != nil || enabled {
+		t.Errorf("2FA still enabled after disabling, %v", err)
+	}
+}
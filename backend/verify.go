@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+///////////
+// TYPES
+
+// Sends and confirms email verification tokens, both for the address an
+// account registers with and for changes of address. A changed address
+// only replaces the current one once it is confirmed.
+type EmailVerifier struct {
+	db     *pgxpool.Pool
+	mailer Mailer
+	policy string
+}
+
+func NewEmailVerifier(db *pgxpool.Pool, mailer Mailer, policy string) (*EmailVerifier, error) {
+	switch policy {
+	case "":
+		policy = UnverifiedFull
+	case UnverifiedFull, UnverifiedReadOnly, UnverifiedNone:
+	default:
+		return nil, fmt.Errorf("unknown unverified account policy %q", policy)
+	}
+	return &EmailVerifier{db: db, mailer: mailer, policy: policy}, nil
+}
+
+// What accounts whose email is not verified may do, set by the
+// UNVERIFIED_POLICY environment variable
+const (
+	UnverifiedFull     = "full"      // everything
+	UnverifiedReadOnly = "read-only" // only GET requests
+	UnverifiedNone     = "none"      // nothing besides verifying
+)
+
+const (
+	emailVerificationExpiration = 24 * time.Hour
+	// Minimum time between two verification emails to an account
+	verificationResendInterval = time.Minute
+	// Maximum verification emails to an account in a day
+	verificationDailyLimit = 5
+)
+
+var (
+	errInvalidVerificationToken = errors.New("invalid or expired verification token")
+	errAlreadyVerified          = errors.New("email is already verified")
+	errEmailTaken               = errors.New("account with email already exists")
+)
+
+// Returned when too many verification emails were requested
+type throttleError struct {
+	RetryAfter time.Duration
+}
+
+func (e *throttleError) Error() string {
+	return "too many verification emails, try again later"
+}
+
+////////////
+// ROUTES
+
+var (
+	VerifyEmailRE = regexp.MustCompile(`^\/email\/verify\/?$`)
+	ResendEmailRE = regexp.MustCompile(`^\/email\/resend\/?$`)
+)
+
+// Handles POST /email/verify. Does not need a session, since the link may
+// be opened on another device.
+func (v *EmailVerifier) serveVerify(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.Context().Value("clientip").(string)
+	err := r.ParseMultipartForm(0)
+	if err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	err = v.VerifyEmail(token)
+	switch {
+	case errors.Is(err, errInvalidVerificationToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errEmailTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("error verifying email for %s: %v\n", clientIP, err)
+		http.Error(w, "error verifying email", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handles POST /email/resend for a logged in account
+func (v *EmailVerifier) serveResend(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	clientIP := r.Context().Value("clientip").(string)
+	err := v.ResendVerification(claims.UserID)
+	var throttled *throttleError
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errAlreadyVerified):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("error resending verification for %s: %v\n", clientIP, err)
+		http.Error(w, "error sending verification email", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+/////////////
+// HELPERS
+
+// Reports whether the account policy lets an unverified caller make a request
+func (v *EmailVerifier) Allows(claims *Claims, r *http.Request) bool {
+	if claims.Verified {
+		return true
+	}
+	switch v.policy {
+	case UnverifiedFull:
+		return true
+	case UnverifiedReadOnly:
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	return false
+}
+
+// Checks how many verification emails an account was sent recently
+func (v *EmailVerifier) checkThrottle(ctx context.Context, tx pgx.Tx, accountID int, now time.Time) error {
+	var last, oldest pgtype.Timestamptz
+	var count int
+	err := tx.QueryRow(ctx,
+		`SELECT MAX(created), MIN(created), COUNT(*)
+		 FROM email_verifications
+		 WHERE account_id=$1 AND created > $2`, accountID, now.Add(-24*time.Hour)).Scan(
+		&last, &oldest, &count)
+	if err != nil {
+		return fmt.Errorf("error counting verification emails: %w", err)
+	}
+	if last.Valid && now.Sub(last.Time) < verificationResendInterval {
+		return &throttleError{RetryAfter: verificationResendInterval - now.Sub(last.Time)}
+	}
+	if count >= verificationDailyLimit {
+		return &throttleError{RetryAfter: oldest.Time.Add(24 * time.Hour).Sub(now)}
+	}
+	return nil
+}
+
+////////////
+// CREATE
+
+// Issues a token that confirms email for the account and mails a link to it
+func (v *EmailVerifier) SendVerification(accountID int, email string) error {
+	ctx := context.Background()
+	tx, err := v.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	msg, err := v.issueVerification(ctx, tx, accountID, email)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing verification token: %w", err)
+	}
+	v.sendMail(accountID, msg)
+	return nil
+}
+
+// Stores a verification token in tx and returns the mail with its link,
+// to be sent once tx is committed
+func (v *EmailVerifier) issueVerification(ctx context.Context, tx pgx.Tx, accountID int, email string) (Message, error) {
+	now := time.Now()
+	err := v.checkThrottle(ctx, tx, accountID, now)
+	if err != nil {
+		return Message{}, err
+	}
+	token, err := GenerateToken(32)
+	if err != nil {
+		return Message{}, fmt.Errorf("error generating token: %w", err)
+	}
+	var username string
+	err = tx.QueryRow(ctx,
+		`SELECT username FROM accounts WHERE id=$1`, accountID).Scan(&username)
+	if err != nil {
+		return Message{}, fmt.Errorf("error querying account: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO email_verifications (account_id, email, token_hash, expires)
+		 VALUES($1, $2, $3, $4)`, accountID, email, hashToken(token), now.Add(emailVerificationExpiration))
+	if err != nil {
+		return Message{}, fmt.Errorf("error inserting verification token: %w", err)
+	}
+	link := fmt.Sprintf("%s/verify-email?token=%s", os.Getenv("ORIGIN"), url.QueryEscape(token))
+	return Message{
+		To:      email,
+		Subject: "Confirm your email for disco",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm that this is your email address by opening this link\n"+
+			"within the next 24 hours:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n", username, link),
+	}, nil
+}
+
+// Sends a verification mail in the background
+func (v *EmailVerifier) sendMail(accountID int, msg Message) {
+	go func() {
+		err := v.mailer.Send(msg)
+		if err != nil {
+			log.Printf("error sending verification mail to account %d: %v\n", accountID, err)
+		}
+	}()
+}
+
+// Sends a new token for the account's latest pending email change, or for
+// its current email if that is not verified yet
+func (v *EmailVerifier) ResendVerification(accountID int) error {
+	ctx := context.Background()
+	var email string
+	var verified bool
+	err := v.db.QueryRow(ctx,
+		`SELECT email, email_verified FROM accounts WHERE id=$1`, accountID).Scan(&email, &verified)
+	if err != nil {
+		return fmt.Errorf("error querying account: %w", err)
+	}
+	var pending string
+	err = v.db.QueryRow(ctx,
+		`SELECT email FROM email_verifications
+		 WHERE account_id=$1 AND used IS NULL AND email <> $2
+		 ORDER BY created DESC LIMIT 1`, accountID, email).Scan(&pending)
+	switch {
+	case err == nil:
+		email = pending
+	case !errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("error querying pending email: %w", err)
+	case verified:
+		return errAlreadyVerified
+	}
+	return v.SendVerification(accountID, email)
+}
+
+////////////
+// UPDATE
+
+// Confirms the email a token was sent to. For a change of address the new
+// email replaces the old one; outstanding tokens for other addresses are
+// used up.
+func (v *EmailVerifier) VerifyEmail(token string) error {
+	ctx := context.Background()
+	tx, err := v.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var accountID int
+	var email string
+	err = tx.QueryRow(ctx,
+		`UPDATE email_verifications SET used=NOW()
+		 WHERE token_hash=$1 AND used IS NULL AND expires > NOW()
+		 RETURNING account_id, email`, hashToken(token)).Scan(&accountID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInvalidVerificationToken
+	}
+	if err != nil {
+		return fmt.Errorf("error using verification token: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET email=$2, email_verified=TRUE WHERE id=$1`, accountID, email)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// Someone else took the address after the change was requested
+		return errEmailTaken
+	}
+	if err != nil {
+		return fmt.Errorf("error updating email: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE email_verifications SET used=NOW()
+		 WHERE account_id=$1 AND used IS NULL`, accountID)
+	if err != nil {
+		return fmt.Errorf("error invalidating verification tokens: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+// Starts a change of address in tx and returns the confirmation mail, to
+// be sent with sendMail once tx is committed. The current email stays in
+// place until the new one is confirmed.
+func (v *EmailVerifier) RequestEmailChange(ctx context.Context, tx pgx.Tx, accountID int, email string) (Message, error) {
+	return v.issueVerification(ctx, tx, accountID, strings.TrimSpace(email))
+}
@@ -0,0 +1,38 @@
+-- Brings the refreshtokens table of a database created from an older
+-- SCHEMA.sql in line with the current one: hashed tokens, rotation
+-- families and the session details listed by GET /sessions. SCHEMA.sql only
+-- runs when the database volume is first initialised, so apply this once to
+-- existing databases, with the backend stopped:
+--
+--   psql "$DATABASE_URL" -f migrations/001_refresh_token_hashes.sql
+--
+-- Stored plain tokens cannot be turned into the hashes the backend looks
+-- up, so every existing refresh token is deleted: all sessions are logged
+-- out and users sign in again.
+
+BEGIN;
+
+CREATE SEQUENCE IF NOT EXISTS refreshtoken_families;
+
+DELETE FROM refreshtokens;
+
+ALTER TABLE refreshtokens
+  DROP COLUMN IF EXISTS token,
+  ADD COLUMN IF NOT EXISTS family INT NOT NULL DEFAULT nextval('refreshtoken_families'),
+  ADD COLUMN IF NOT EXISTS token_hash TEXT NOT NULL UNIQUE,
+  ADD COLUMN IF NOT EXISTS used TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS created TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN IF NOT EXISTS last_used TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Deleting an account takes its sessions with it
+ALTER TABLE refreshtokens
+  DROP CONSTRAINT IF EXISTS refreshtokens_account_id_fkey,
+  ADD CONSTRAINT refreshtokens_account_id_fkey
+    FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS refreshtokens_family_idx ON refreshtokens (family);
+CREATE INDEX IF NOT EXISTS refreshtokens_expires_idx ON refreshtokens (expires);
+
+COMMIT;